@@ -0,0 +1,161 @@
+/* Air Dates
+ *
+ * Daily shows are released by the date they aired instead of an episode
+ * number, and release names write the date in a handful of ways. AirDate
+ * holds the date itself and is always stored and shown as 2006.01.02.
+ */
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const airDateFormat = "2006.01.02"
+
+// AirDate is a calendar day in UTC. The zero AirDate is no date.
+type AirDate struct {
+	time.Time
+}
+
+func NewAirDate(year int, month time.Month, day int) AirDate {
+	return AirDate{time.Date(year, month, day, 0, 0, 0, 0, time.UTC)}
+}
+
+// Today is the date in gumshoe's local time zone.
+func Today() AirDate {
+	y, m, d := time.Now().Date()
+	return NewAirDate(y, m, d)
+}
+
+var (
+	airDateMonths = map[string]time.Month{
+		"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+		"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+		"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+	}
+	airDateSep = `[.\-_ /]`
+	airDateMon = `(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*`
+	airDateDay = `(\d{1,2})(?:st|nd|rd|th)?`
+	airDateYr  = `((?:19|20)\d{2})`
+	// The ways release names write a date, tried in order.
+	airDatePatterns = []struct {
+		re         *regexp.Regexp
+		y, m, d    int
+		monthFirst bool // a number month comes before the day, see below
+	}{
+		// 2015.03.26
+		{re: airDateRegexp(airDateYr + airDateSep + `(\d{1,2})` + airDateSep + `(\d{1,2})`), y: 1, m: 2, d: 3},
+		// 26 Mar 2015
+		{re: airDateRegexp(airDateDay + airDateSep + `+` + airDateMon + airDateSep + `+` + airDateYr), y: 3, m: 2, d: 1},
+		// March 26th, 2015
+		{re: airDateRegexp(airDateMon + airDateSep + `+` + airDateDay + `,?` + airDateSep + `+` + airDateYr), y: 3, m: 1, d: 2},
+		// 03.26.2015 or 26.03.2015
+		{re: airDateRegexp(`(\d{1,2})` + airDateSep + `(\d{1,2})` + airDateSep + airDateYr), y: 3, m: 1, d: 2, monthFirst: true},
+	}
+)
+
+// airDateRegexp makes a date pattern only match whole words. Like the other
+// release patterns, a match includes the separators around it.
+func airDateRegexp(p string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(?:^|[. _\-\[(])` + p + `(?:[. _\-\])]|$)`)
+}
+
+// findAirDate finds the first date in a release name. loc is where it is,
+// separators included, like regexp's FindStringIndex.
+func findAirDate(s string) (d AirDate, loc []int, err error) {
+	for _, p := range airDatePatterns {
+		m := p.re.FindStringSubmatchIndex(s)
+		if m == nil {
+			continue
+		}
+		if loc != nil && m[0] >= loc[0] {
+			continue
+		}
+		part := func(i int) string { return s[m[2*i]:m[2*i+1]] }
+		year, day := GetInt(part(p.y)), GetInt(part(p.d))
+		month := time.Month(GetInt(part(p.m)))
+		if mon := strings.ToLower(part(p.m)); len(mon) >= 3 {
+			month = airDateMonths[mon[:3]]
+		}
+		// Americans put the month first, everyone else the day. Either way
+		// a number over 12 has to be the day.
+		if p.monthFirst && month > 12 && day <= 12 {
+			month, day = time.Month(day), int(month)
+		}
+		nd := NewAirDate(year, month, day)
+		if nd.Month() != month || nd.Day() != day || month < 1 {
+			err = fmt.Errorf("%s is not a valid date", s[m[0]:m[1]])
+			continue
+		}
+		d, loc, err = nd, []int{m[0], m[1]}, nil
+	}
+	if loc == nil && err == nil {
+		err = fmt.Errorf("No date found in %s", s)
+	}
+	return d, loc, err
+}
+
+// ParseAirDate reads a date in any of the forms found in release names.
+func ParseAirDate(s string) (AirDate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return AirDate{}, nil
+	}
+	d, _, err := findAirDate(s)
+	return d, err
+}
+
+func (d AirDate) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(airDateFormat)
+}
+
+// Weekend reports whether the date is a Saturday or a Sunday.
+func (d AirDate) Weekend() bool {
+	w := d.Weekday()
+	return w == time.Saturday || w == time.Sunday
+}
+
+func (d AirDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *AirDate) UnmarshalJSON(b []byte) error {
+	s := ""
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	n, err := ParseAirDate(s)
+	if err != nil {
+		return err
+	}
+	*d = n
+	return nil
+}
+
+// Value stores the date as text, so it sorts and compares in SQL.
+func (d AirDate) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// Scan reads a stored date. Anything that isn't a date reads as no date.
+func (d *AirDate) Scan(v interface{}) error {
+	switch t := v.(type) {
+	case time.Time:
+		*d = NewAirDate(t.Date())
+	case []byte:
+		*d, _ = ParseAirDate(string(t))
+	case string:
+		*d, _ = ParseAirDate(t)
+	default:
+		*d = AirDate{}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAirDate(t *testing.T) {
+	want := NewAirDate(2015, time.March, 26)
+	for _, s := range []string{
+		"2015.03.26",
+		"2015-03-26",
+		"2015 3 26",
+		"26.03.2015",
+		"03.26.2015",
+		"26 Mar 2015",
+		"26th.March.2015",
+		"March 26th, 2015",
+		"mar.26.2015",
+	} {
+		d, err := ParseAirDate(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, d, s)
+	}
+
+	// Ambiguous dates are read month first.
+	d, err := ParseAirDate("04.05.2015")
+	assert.NoError(t, err)
+	assert.Equal(t, NewAirDate(2015, time.April, 5), d)
+
+	for _, s := range []string{"2015.02.30", "2015.13.01", "not a date"} {
+		_, err := ParseAirDate(s)
+		assert.Error(t, err, s)
+	}
+	d, err = ParseAirDate("")
+	assert.NoError(t, err)
+	assert.True(t, d.IsZero())
+}
+
+func TestFindAirDate(t *testing.T) {
+	d, loc, err := findAirDate("Conan.26.Mar.2015.Will.Ferrell.720p")
+	assert.NoError(t, err)
+	assert.Equal(t, "2015.03.26", d.String())
+	assert.Equal(t, []int{5, 18}, loc)
+
+	_, loc, _ = findAirDate("Show.Name.S01E02.720p.HDTV.x264-GRP")
+	assert.Nil(t, loc)
+}
+
+func TestAirDateJSON(t *testing.T) {
+	b, err := json.Marshal(Episode{AirDate: NewAirDate(2015, time.March, 26)})
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"airdate":"2015.03.26"`)
+
+	e := Episode{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"airdate": "2015-03-26"}`), &e))
+	assert.Equal(t, NewAirDate(2015, time.March, 26), e.AirDate)
+	assert.NoError(t, json.Unmarshal([]byte(`{"airdate": ""}`), &e))
+	assert.True(t, e.AirDate.IsZero())
+}
+
+func TestDailyShowOptions(t *testing.T) {
+	s := newShow("late night daily", "720p", false)
+	s.SkipWeekends = true
+	s.SkipReruns = true
+	s.MaxAge = 30
+	assert.NoError(t, s.AddShow())
+	defer s.DeleteShow()
+
+	// The Monday before today is always a weekday within the last week.
+	day := Today()
+	for day.Weekday() != time.Monday {
+		day = AirDate{day.AddDate(0, 0, -1)}
+	}
+	rel, err := ParseRelease("Late.Night.Daily." + day.String() + ".Guest.720p.HDTV.x264-GRP")
+	assert.NoError(t, err)
+	e := episodeFromRelease(*s, rel)
+	assert.Equal(t, "", s.Skips(e))
+	assert.True(t, e.IsNewEpisode())
+	assert.NoError(t, e.RecordEpisode())
+	assert.Equal(t, "Guest", e.Title)
+
+	// The same date in another format is the same episode.
+	rel, _ = ParseRelease("Late.Night.Daily." + day.Format("02.Jan.2006") + ".Guest.1080p.WEB-DL")
+	e = episodeFromRelease(*s, rel)
+	assert.False(t, e.IsNewEpisode())
+
+	// Daily shows ignore any numbering in the release.
+	e = episodeFromRelease(*s, &Release{Season: 2015, Episodes: []int{40}, AirDate: day})
+	assert.True(t, e.IsDaily())
+
+	sunday := &Episode{ShowID: s.ID, AirDate: AirDate{day.AddDate(0, 0, -1)}}
+	assert.Contains(t, s.Skips(sunday), "weekends")
+	assert.False(t, sunday.IsNewEpisode())
+
+	old := &Episode{ShowID: s.ID, AirDate: AirDate{day.AddDate(0, 0, -70)}}
+	assert.Contains(t, s.Skips(old), "30 days")
+
+	rel, _ = ParseRelease("Late.Night.Daily." + day.AddDate(0, 0, -7).Format("2006.01.02") + ".RERUN.720p.HDTV.x264-GRP")
+	assert.True(t, rel.Rerun)
+	assert.Contains(t, s.Skips(episodeFromRelease(*s, rel)), "rerun")
+}
+
+func TestMigrateAirDates(t *testing.T) {
+	e := &Episode{ShowID: 3, AirDate: NewAirDate(2014, time.June, 2), State: EpisodeDownloaded}
+	require.NoError(t, gDb.Insert(e))
+	defer gDb.Delete(e)
+
+	for stored, want := range map[string]string{
+		"2014-06-02": "2014.06.02",
+		"2 Jun 2014": "2014.06.02",
+		"2014.6.2":   "2014.06.02",
+		"2014.06.02": "2014.06.02",
+		"not a date": "not a date",
+	} {
+		_, err := gDb.Exec("update episode set AirDate=? where ID=?", stored, e.ID)
+		require.NoError(t, err)
+		assert.NoError(t, migrateAirDates(gDb))
+		got, err := gDb.SelectStr("select AirDate from episode where ID=?", e.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, stored)
+	}
+}
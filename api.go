@@ -0,0 +1,361 @@
+/* REST API
+ *
+ * What every /api/v1 handler shares. Requests and responses are JSON, a
+ * failed request gets an error body with the matching status code, and lists
+ * are paginated with ?offset= and ?limit=.
+ *
+ * The paths from before /api/v1 still work. They redirect to their new home,
+ * except for the few whose method changed, which are served in place.
+ */
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	apiPrefix = "/api/v1"
+	// Lists are cut into pages of this many items unless ?limit= says
+	// otherwise, up to maxPageSize.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	// Largest request body read, config updates being the biggest.
+	maxBodySize = 1 << 20
+)
+
+// APIError is the body of every failed API request, as {"error": {...}}.
+// Fields lists the problems with each field of the request, when there are
+// any.
+type APIError struct {
+	Status  int              `json:"status"`
+	Message string           `json:"message"`
+	Fields  ValidationErrors `json:"fields,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func apiErrorf(status int, format string, a ...interface{}) *APIError {
+	return &APIError{Status: status, Message: fmt.Sprintf(format, a...)}
+}
+
+// toAPIError picks the status of an error. A missing database row is a 404,
+// a ValidationErrors a 400, and anything else a 500.
+func toAPIError(err error) *APIError {
+	switch e := err.(type) {
+	case *APIError:
+		return e
+	case ValidationErrors:
+		return &APIError{Status: http.StatusBadRequest, Message: "Invalid request.", Fields: e}
+	}
+	if err == sql.ErrNoRows {
+		return apiErrorf(http.StatusNotFound, "Not found.")
+	}
+	return apiErrorf(http.StatusInternalServerError, "%s", err)
+}
+
+// badRequest makes err a 400, unless it already has a status.
+func badRequest(err error) error {
+	if _, ok := err.(*APIError); ok || err == sql.ErrNoRows {
+		return err
+	}
+	return apiErrorf(http.StatusBadRequest, "%s", err)
+}
+
+// apiResponse sends body with a status other than 200.
+type apiResponse struct {
+	status int
+	body   interface{}
+}
+
+func created(v interface{}) apiResponse {
+	return apiResponse{http.StatusCreated, v}
+}
+
+func accepted(v interface{}) apiResponse {
+	return apiResponse{http.StatusAccepted, v}
+}
+
+var noContent = apiResponse{status: http.StatusNoContent}
+
+// apiHandler handles an API request. What it returns is sent as JSON with a
+// 200, or the status of an apiResponse. Errors are sent as an APIError.
+type apiHandler func(w http.ResponseWriter, r *http.Request) (interface{}, error)
+
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v, err := h(w, r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if res, ok := v.(apiResponse); ok {
+		status, v = res.status, res.body
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(map[string]*APIError{"error": toAPIError(err)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	e := toAPIError(err)
+	if e.Status == http.StatusInternalServerError {
+		log.Printf("[ERROR] API: %s\n", e.Message)
+	}
+	writeJSON(w, e.Status, map[string]*APIError{"error": e})
+}
+
+// pathID reads the path parameter name as a database id.
+func pathID(r *http.Request, name string) (int64, error) {
+	s := r.PathValue(name)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		return 0, apiErrorf(http.StatusBadRequest, "%s is not a valid id.", s)
+	}
+	return id, nil
+}
+
+// decodeBody reads the JSON request body into v, and makes sure the fields
+// tagged binding:"required" are set.
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(v); err != nil {
+		return apiErrorf(http.StatusBadRequest, "Invalid JSON: %s", err)
+	}
+	if verr := requiredFields(v); len(verr) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func requiredFields(v interface{}) ValidationErrors {
+	verr := ValidationErrors{}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return verr
+	}
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("binding") != "required" || !rv.Field(i).IsZero() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		verr.add(name, "Required.")
+	}
+	return verr
+}
+
+// paginate picks the page of a list of n items asked for by ?offset= and
+// ?limit=, and returns its bounds. The size of the whole list is sent in
+// X-Total-Count, and the pages around this one in a Link header.
+func paginate(w http.ResponseWriter, r *http.Request, n int) (start, end int, err error) {
+	q := r.URL.Query()
+	limit, offset := defaultPageSize, 0
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, apiErrorf(http.StatusBadRequest, "limit must be a number from 1 to %d.", maxPageSize)
+		}
+	}
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, apiErrorf(http.StatusBadRequest, "offset must be a number of at least 0.")
+		}
+	}
+	start, end = n, n
+	if offset < n {
+		start = offset
+	}
+	if start+limit < n {
+		end = start + limit
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(n))
+	links := []string{}
+	if end < n {
+		links = append(links, pageLink(r, end, limit, "next"))
+	}
+	if start > 0 {
+		prev := start - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(r, prev, limit, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	return start, end, nil
+}
+
+func pageLink(r *http.Request, offset, limit int, rel string) string {
+	u := *r.URL
+	q := u.Query()
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.RequestURI(), rel)
+}
+
+// A path from before /api/v1, and where it went. A route whose method is
+// different in /api/v1 can't be redirected, browsers would change the method
+// or drop the body, so it is served in place.
+//
+// The old paths overlap, e.g. /api/show/update/{id} and /api/show/{id}/aliases,
+// which the mux refuses. They are matched in order instead.
+type legacyRoute struct {
+	method, path  string
+	newMethod, to string
+}
+
+var legacyParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// match returns the path parameters when the request is for this route.
+func (l legacyRoute) match(r *http.Request) (map[string]string, bool) {
+	want, got := strings.Split(l.path, "/"), strings.Split(r.URL.Path, "/")
+	if r.Method != l.method || len(want) != len(got) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, w := range want {
+		if m := legacyParam.FindStringSubmatch(w); m != nil && m[0] == w && got[i] != "" {
+			params[m[1]] = got[i]
+		} else if w != got[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (l legacyRoute) serve(w http.ResponseWriter, r *http.Request, params map[string]string, api http.Handler) {
+	to := apiPrefix + legacyParam.ReplaceAllStringFunc(l.to, func(p string) string {
+		return params[p[1:len(p)-1]]
+	})
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, to))
+	if l.newMethod == l.method {
+		if r.URL.RawQuery != "" {
+			to += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, to, http.StatusPermanentRedirect)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.Method = l.newMethod
+	r2.URL.Path = to
+	r2.URL.RawPath = ""
+	r2.RequestURI = r2.URL.RequestURI()
+	api.ServeHTTP(w, r2)
+}
+
+// apiRouter answers requests the mux has no route for with a JSON error
+// instead of the mux's plain text one.
+type apiRouter struct {
+	mux    *http.ServeMux
+	legacy []legacyRoute
+}
+
+func newAPIRouter() *apiRouter {
+	return &apiRouter{mux: http.NewServeMux()}
+}
+
+// Handle adds the route "METHOD /path" under /api/v1.
+func (a *apiRouter) Handle(method, path string, h apiHandler) {
+	a.mux.Handle(method+" "+apiPrefix+path, h)
+}
+
+// HandleFunc adds a route that writes its own response, like a stream.
+func (a *apiRouter) HandleFunc(method, path string, h http.HandlerFunc) {
+	a.mux.Handle(method+" "+apiPrefix+path, h)
+}
+
+// Legacy adds old paths. Where they go must be added with Handle.
+func (a *apiRouter) Legacy(routes []legacyRoute) {
+	a.legacy = append(a.legacy, routes...)
+}
+
+func (a *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, pattern := a.mux.Handler(r)
+	if pattern != "" {
+		// Only the mux fills in the path parameters.
+		a.mux.ServeHTTP(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		for _, l := range a.legacy {
+			if params, ok := l.match(r); ok {
+				l.serve(w, r, params, a)
+				return
+			}
+		}
+	}
+	// Find out whether the mux would have said 404 or 405.
+	rec := &statusRecorder{header: http.Header{}}
+	h.ServeHTTP(rec, r)
+	if allow := rec.header.Get("Allow"); allow != "" {
+		w.Header().Set("Allow", allow)
+	}
+	writeAPIError(w, apiErrorf(rec.status, "%s.", http.StatusText(rec.status)))
+}
+
+// statusRecorder keeps the status and headers of a response, and throws
+// away the body.
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (s *statusRecorder) Header() http.Header {
+	return s.header
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// recoverPanics turns a panic in a handler into a 500, instead of a dropped
+// connection.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("[ERROR] Panic serving %s %s: %v\n", r.Method, r.URL.Path, err)
+				writeAPIError(w, apiErrorf(http.StatusInternalServerError, "Internal error."))
+			}
+		}()
+		PrintDebugf("%s %s\n", r.Method, r.URL.RequestURI())
+		h.ServeHTTP(w, r)
+	})
+}
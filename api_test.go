@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testToken string
+
+// apiRequest sends a request to the whole HTTP handler, with an API token,
+// and returns the recorded response.
+func apiRequest(method, path, body string) *httptest.ResponseRecorder {
+	if testToken == "" {
+		testToken, _, _ = CreateAPIToken("tests")
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	newHTTPHandler(pwd).ServeHTTP(w, req)
+	return w
+}
+
+func apiErrorOf(t *testing.T, w *httptest.ResponseRecorder) *APIError {
+	body := map[string]*APIError{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body["error"]
+}
+
+func TestAPIShows(t *testing.T) {
+	w := apiRequest("POST", "/api/v1/shows", `{"title": "api show", "quality": "720p", "episodal": true}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	s := Show{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &s))
+	assert.Equal(t, "Api Show", s.Title)
+	defer s.DeleteShow()
+
+	path := fmt.Sprintf("/api/v1/shows/%d", s.ID)
+	w = apiRequest("PUT", path, `{"title": "api show", "quality": "1080p", "episodal": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	got, _ := GetShow(s.ID)
+	assert.Equal(t, "1080p", got.Quality)
+
+	w = apiRequest("GET", path+"/episodes", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("X-Total-Count"))
+
+	w = apiRequest("DELETE", path, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = apiRequest("GET", path, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, fmt.Sprintf("Show %d doesn't exist.", s.ID), apiErrorOf(t, w).Message)
+}
+
+func TestAPIErrors(t *testing.T) {
+	w := apiRequest("POST", "/api/v1/shows", `{"quality": "720p"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	e := apiErrorOf(t, w)
+	if assert.NotNil(t, e) && assert.Len(t, e.Fields, 1) {
+		assert.Equal(t, "title", e.Fields[0].Field)
+	}
+
+	w = apiRequest("POST", "/api/v1/shows", `{`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = apiRequest("GET", "/api/v1/shows/abc", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = apiRequest("PATCH", "/api/v1/shows", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Contains(t, w.Header().Get("Allow"), "POST")
+	assert.Equal(t, http.StatusMethodNotAllowed, apiErrorOf(t, w).Status)
+
+	w = apiRequest("GET", "/api/v1/nothing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "Not Found.", apiErrorOf(t, w).Message)
+
+	w = apiRequest("GET", "/api/v1/config/nothing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAPIPagination(t *testing.T) {
+	w := apiRequest("GET", "/api/v1/shows?limit=1&offset=1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	shows := []Show{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &shows))
+	assert.Len(t, shows, 1)
+	link := w.Header().Get("Link")
+	assert.Contains(t, link, `</api/v1/shows?limit=1&offset=2>; rel="next"`)
+	assert.Contains(t, link, `</api/v1/shows?limit=1&offset=0>; rel="prev"`)
+
+	w = apiRequest("GET", "/api/v1/shows?offset=1000", "")
+	assert.Equal(t, "[]", w.Body.String())
+
+	w = apiRequest("GET", "/api/v1/shows?limit=0", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAPILegacyRoutes(t *testing.T) {
+	w := apiRequest("GET", "/api/shows?limit=5", "")
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "/api/v1/shows?limit=5", w.Header().Get("Location"))
+
+	w = apiRequest("DELETE", "/api/queue/delete/12", "")
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "/api/v1/queue/12", w.Header().Get("Location"))
+
+	// Updates went from POST to PUT, so they're answered in place.
+	w = apiRequest("POST", "/api/show/update/1", `{"title": "walking bread", "quality": "720p", "episodal": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `</api/v1/shows/1>; rel="successor-version"`, w.Header().Get("Link"))
+}
@@ -0,0 +1,430 @@
+/* Authentication
+ *
+ * Everything but /status and the web interface's files needs either an API
+ * token, sent as "Authorization: Bearer <token>", or the session cookie the
+ * web interface gets by logging in with the web password.
+ *
+ * Tokens are only ever shown when they're created, the token table keeps a
+ * SHA-256 of them. The daemon makes one for gumshoe-cli at startup and leaves
+ * it in the data_dir, which is how the CLI gets in to make the others. The
+ * web password is kept in the config as a bcrypt hash.
+ *
+ * Browsers may only call the API from another site when that site is in the
+ * cors_origins list, and then only with a token.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	tokenPrefix = "gs_"
+	// gumshoe-cli reads its token from this file in the data_dir.
+	cliTokenFile = "cli.token"
+	cliTokenName = "gumshoe-cli"
+
+	sessionCookie  = "gumshoe_session"
+	sessionTimeout = 7 * 24 * time.Hour
+	minPasswordLen = 8
+	// A token's LastUsed is written at most this often.
+	tokenUseGranularity = time.Minute
+)
+
+type APIToken struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// The first characters of the token, so it can be told apart from others.
+	Prefix   string `json:"prefix"`
+	Hash     string `json:"-"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"last_used"`
+}
+
+// newTokenString makes a random token. The gs_ prefix makes a leaked one
+// easy to search for.
+func newTokenString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(t string) string {
+	h := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(h[:])
+}
+
+// Start User Functions
+
+// CreateAPIToken stores a new token called name. The token itself is only
+// returned here.
+func CreateAPIToken(name string) (string, *APIToken, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", nil, errors.New("A token needs a name.")
+	}
+	s, err := newTokenString()
+	if err != nil {
+		return "", nil, err
+	}
+	t := &APIToken{
+		Name:    name,
+		Prefix:  s[:len(tokenPrefix)+6],
+		Hash:    hashToken(s),
+		Created: time.Now().Unix(),
+	}
+	checkDBLock <- 1
+	err = gDb.Insert(t)
+	<-checkDBLock
+	if err != nil {
+		return "", nil, err
+	}
+	return s, t, nil
+}
+
+func ListAPITokens() ([]APIToken, error) {
+	ts := []APIToken{}
+	checkDBLock <- 1
+	_, err := gDb.Select(&ts, "select * from api_token order by ID")
+	<-checkDBLock
+	return ts, err
+}
+
+// RevokeAPIToken deletes a token, which stops working straight away.
+func RevokeAPIToken(id int64) error {
+	checkDBLock <- 1
+	res, err := gDb.Exec("delete from api_token where ID=?", id)
+	<-checkDBLock
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CheckAPIToken reports whether s is a token that hasn't been revoked.
+func CheckAPIToken(s string) bool {
+	if !strings.HasPrefix(s, tokenPrefix) {
+		return false
+	}
+	t := APIToken{}
+	checkDBLock <- 1
+	defer func() { <-checkDBLock }()
+	if err := gDb.SelectOne(&t, "select * from api_token where Hash=?", hashToken(s)); err != nil {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(t.LastUsed, 0)) > tokenUseGranularity {
+		gDb.Exec("update api_token set LastUsed=? where ID=?", now.Unix(), t.ID)
+	}
+	return true
+}
+
+// EnsureCLIToken makes sure the token file gumshoe-cli reads holds a working
+// token, making a new one if it doesn't.
+func EnsureCLIToken() error {
+	f := CreateLocalPath(currentConfig(), cliTokenFile)
+	if b, err := ioutil.ReadFile(f); err == nil && CheckAPIToken(strings.TrimSpace(string(b))) {
+		return nil
+	}
+	s, _, err := CreateAPIToken(cliTokenName)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f, []byte(s+"\n"), 0600)
+}
+
+// End User Functions
+
+// SetWebPassword replaces the web password and logs out every session.
+func SetWebPassword(p string) error {
+	if len(p) < minPasswordLen {
+		v := ValidationErrors{}
+		v.add("password", "Must be at least %d characters.", minPasswordLen)
+		return v
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	err = SaveConfig(func(c *TrackerConfig) (*TrackerConfig, error) {
+		n := *c
+		n.Operations.PasswordHash = string(h)
+		return &n, nil
+	})
+	if err != nil {
+		return err
+	}
+	sessions.Clear()
+	return nil
+}
+
+var errNoPassword = errors.New("No web password is set. Set one with \"gumshoe-cli password\".")
+
+// checkWebPassword compares p to the bcrypt hash in the config.
+func checkWebPassword(p string) error {
+	h := currentConfig().Operations.PasswordHash
+	if h == "" {
+		return errNoPassword
+	}
+	return bcrypt.CompareHashAndPassword([]byte(h), []byte(p))
+}
+
+// sessionStore holds the logged in web sessions. They're kept in memory, so a
+// restart logs everyone out.
+type sessionStore struct {
+	sync.Mutex
+	expires map[string]time.Time
+}
+
+var sessions = &sessionStore{expires: map[string]time.Time{}}
+
+func (s *sessionStore) New() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for k, e := range s.expires {
+		if now.After(e) {
+			delete(s.expires, k)
+		}
+	}
+	s.expires[id] = now.Add(sessionTimeout)
+	return id, nil
+}
+
+func (s *sessionStore) Valid(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.expires[id]
+	return ok && time.Now().Before(e)
+}
+
+func (s *sessionStore) Delete(id string) {
+	s.Lock()
+	delete(s.expires, id)
+	s.Unlock()
+}
+
+func (s *sessionStore) Clear() {
+	s.Lock()
+	s.expires = map[string]time.Time{}
+	s.Unlock()
+}
+
+// authorized reports whether r carries a token or a session. The session
+// cookie only counts for changes made from gumshoe's own pages, so another
+// site can't post a form to the API with it.
+func authorized(r *http.Request) bool {
+	if h := r.Header.Get("Authorization"); h != "" {
+		t := strings.TrimPrefix(h, "Bearer ")
+		return t != h && CheckAPIToken(strings.TrimSpace(t))
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || !sessions.Valid(c.Value) {
+		return false
+	}
+	if o := r.Header.Get("Origin"); o != "" && r.Method != "GET" && r.Method != "HEAD" {
+		u, err := url.Parse(o)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
+
+// requireAuth answers requests without a token or session with a 401.
+func requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gumshoe"`)
+			writeAPIError(w, apiErrorf(http.StatusUnauthorized, "Log in or send an API token."))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowedOrigin reports whether a page from origin may call the API.
+func allowedOrigin(origin string) bool {
+	for _, o := range currentConfig().Operations.CORSOrigins {
+		if strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors lets the sites in cors_origins call the API. Preflight requests are
+// answered here, before they need a token.
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		ok := allowedOrigin(origin)
+		if ok {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count")
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type loginRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// login checks the web password and starts a session.
+func login(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	l := loginRequest{}
+	if err := decodeBody(r, &l); err != nil {
+		return nil, err
+	}
+	if err := checkWebPassword(l.Password); err != nil {
+		if err == errNoPassword {
+			return nil, apiErrorf(http.StatusForbidden, "%s", err)
+		}
+		log.Printf("[WARN] Failed web login from %s\n", r.RemoteAddr)
+		return nil, apiErrorf(http.StatusUnauthorized, "Wrong password.")
+	}
+	id, err := sessions.New()
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return noContent, nil
+}
+
+func logout(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sessions.Delete(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	return noContent, nil
+}
+
+type passwordUpdate struct {
+	Password string `json:"password" binding:"required"`
+}
+
+func updatePassword(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	p := passwordUpdate{}
+	if err := decodeBody(r, &p); err != nil {
+		return nil, err
+	}
+	if err := SetWebPassword(p.Password); err != nil {
+		return nil, err
+	}
+	return noContent, nil
+}
+
+func getTokens(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	ts, err := ListAPITokens()
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := paginate(w, r, len(ts))
+	if err != nil {
+		return nil, err
+	}
+	return ts[start:end], nil
+}
+
+type tokenRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// createToken returns the new token along with its details. It can't be
+// looked up again.
+func createToken(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	tr := tokenRequest{}
+	if err := decodeBody(r, &tr); err != nil {
+		return nil, err
+	}
+	s, t, err := CreateAPIToken(tr.Name)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	return created(struct {
+		*APIToken
+		Token string `json:"token"`
+	}{t, s}), nil
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	if err = RevokeAPIToken(id); err == sql.ErrNoRows {
+		return nil, apiErrorf(http.StatusNotFound, "Token %d doesn't exist.", id)
+	} else if err != nil {
+		return nil, err
+	}
+	return noContent, nil
+}
+
+var hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// validBindAddress reports whether a is an IP address or a host name.
+func validBindAddress(a string) bool {
+	return net.ParseIP(a) != nil || hostnameRegexp.MatchString(a)
+}
+
+// validOrigin reports whether o is a scheme and host, like a browser sends in
+// the Origin header.
+func validOrigin(o string) bool {
+	u, err := url.Parse(strings.TrimRight(o, "/"))
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.Path == "" && u.RawQuery == "" && u.User == nil
+}
+
+// httpAddress is where the webserver listens. An empty bind_address is every
+// interface.
+func httpAddress(o Operations) string {
+	return net.JoinHostPort(o.BindAddress, o.HttpPort)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// anonRequest sends a request without a token, with the given headers.
+func anonRequest(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	newHTTPHandler(pwd).ServeHTTP(w, req)
+	return w
+}
+
+func TestAPITokens(t *testing.T) {
+	for _, p := range []string{"/api/v1/shows", "/api/shows", "/settings", "/vars"} {
+		w := anonRequest("GET", p, "", nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, p)
+	}
+	assert.Equal(t, http.StatusOK, anonRequest("GET", "/status", "", nil).Code)
+
+	w := apiRequest("POST", "/api/v1/tokens", `{"name": "script"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	tok := struct {
+		APIToken
+		Token string `json:"token"`
+	}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tok))
+	assert.True(t, strings.HasPrefix(tok.Token, tok.Prefix))
+	assert.NotContains(t, w.Body.String(), hashToken(tok.Token))
+
+	bearer := map[string]string{"Authorization": "Bearer " + tok.Token}
+	assert.Equal(t, http.StatusOK, anonRequest("GET", "/api/v1/shows", "", bearer).Code)
+	assert.Equal(t, http.StatusUnauthorized, anonRequest("GET", "/api/v1/shows", "", map[string]string{"Authorization": "Bearer gs_nope"}).Code)
+
+	w = apiRequest("GET", "/api/v1/tokens", "")
+	assert.Contains(t, w.Body.String(), `"name":"script"`)
+
+	path := fmt.Sprintf("/api/v1/tokens/%d", tok.ID)
+	assert.Equal(t, http.StatusNoContent, apiRequest("DELETE", path, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, anonRequest("GET", "/api/v1/shows", "", bearer).Code)
+	assert.Equal(t, http.StatusNotFound, apiRequest("DELETE", path, "").Code)
+}
+
+func TestCLIToken(t *testing.T) {
+	f := CreateLocalPath(currentConfig(), cliTokenFile)
+	defer os.Remove(f)
+
+	assert.NoError(t, EnsureCLIToken())
+	b, err := ioutil.ReadFile(f)
+	assert.NoError(t, err)
+	fi, _ := os.Stat(f)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	first := strings.TrimSpace(string(b))
+	assert.True(t, CheckAPIToken(first))
+
+	// A working token is kept, a revoked one replaced.
+	assert.NoError(t, EnsureCLIToken())
+	b, _ = ioutil.ReadFile(f)
+	assert.Equal(t, first, strings.TrimSpace(string(b)))
+
+	ts, _ := ListAPITokens()
+	for _, tok := range ts {
+		if tok.Name == cliTokenName {
+			RevokeAPIToken(tok.ID)
+		}
+	}
+	assert.NoError(t, EnsureCLIToken())
+	b, _ = ioutil.ReadFile(f)
+	assert.NotEqual(t, first, strings.TrimSpace(string(b)))
+}
+
+func TestWebLogin(t *testing.T) {
+	useTestConfig(t, func(c *TrackerConfig) { c.Operations.PasswordHash = "" })
+	w := anonRequest("POST", "/api/v1/login", `{"password": "hunter22"}`, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	h, _ := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+	useTestConfig(t, func(c *TrackerConfig) { c.Operations.PasswordHash = string(h) })
+	w = anonRequest("POST", "/api/v1/login", `{"password": "hunter2"}`, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+
+	w = anonRequest("POST", "/api/v1/login", `{"password": "hunter22"}`, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	cookies := w.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	c := cookies[0]
+	assert.True(t, c.HttpOnly)
+	assert.Equal(t, http.SameSiteStrictMode, c.SameSite)
+	session := map[string]string{"Cookie": c.Name + "=" + c.Value}
+
+	assert.Equal(t, http.StatusOK, anonRequest("GET", "/settings", "", session).Code)
+	assert.Equal(t, http.StatusOK, anonRequest("GET", "/api/v1/shows", "", session).Code)
+	assert.NotContains(t, anonRequest("GET", "/settings", "", session).Body.String(), string(h))
+
+	// Changes from another site's pages aren't taken with the cookie.
+	session["Origin"] = "http://evil.example.com"
+	assert.Equal(t, http.StatusUnauthorized, anonRequest("POST", "/api/v1/backlog", "", session).Code)
+	delete(session, "Origin")
+
+	assert.Equal(t, http.StatusNoContent, anonRequest("POST", "/api/v1/logout", "", session).Code)
+	assert.Equal(t, http.StatusUnauthorized, anonRequest("GET", "/api/v1/shows", "", session).Code)
+}
+
+func TestCORS(t *testing.T) {
+	useTestConfig(t, func(c *TrackerConfig) { c.Operations.CORSOrigins = []string{"https://ui.example.com/"} })
+
+	preflight := map[string]string{
+		"Origin":                        "https://ui.example.com",
+		"Access-Control-Request-Method": "DELETE",
+	}
+	w := anonRequest("OPTIONS", "/api/v1/shows/1", "", preflight)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://ui.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	preflight["Origin"] = "https://other.example.com"
+	w = anonRequest("OPTIONS", "/api/v1/shows/1", "", preflight)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = apiRequest("GET", "/api/v1/shows", "")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	w = anonRequest("GET", "/api/v1/shows", "", map[string]string{"Origin": "https://ui.example.com"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "https://ui.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+}
+
+func TestBindAddress(t *testing.T) {
+	assert.Equal(t, ":8080", httpAddress(Operations{HttpPort: "8080"}))
+	assert.Equal(t, "127.0.0.1:8080", httpAddress(Operations{HttpPort: "8080", BindAddress: "127.0.0.1"}))
+	assert.Equal(t, "[::1]:8080", httpAddress(Operations{HttpPort: "8080", BindAddress: "::1"}))
+
+	c := &TrackerConfig{Operations: Operations{
+		HttpPort:    "8080",
+		BindAddress: "not an address",
+		CORSOrigins: []string{"https://ok.example.com", "example.com", "http://x.example.com/path"},
+	}}
+	verr := c.Validate().(ValidationErrors)
+	fields := []string{}
+	for _, e := range verr {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{"operations.bind_address", "operations.cors_origins[1]", "operations.cors_origins[2]"}, fields)
+
+	for _, a := range []string{"localhost", "0.0.0.0", "::", "nas.lan"} {
+		assert.True(t, validBindAddress(a), a)
+	}
+}
+
+// freePort is a port on 127.0.0.1 nothing is listening on.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// getUntil gets url with c until it answers, and fails the test if it
+// doesn't in a few seconds.
+func getUntil(t *testing.T, c *http.Client, url string) {
+	var err error
+	for i := 0; i < 50; i++ {
+		var resp *http.Response
+		if resp, err = c.Get(url); err == nil {
+			resp.Body.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s never answered: %s", url, err)
+}
+
+func TestRebindSamePort(t *testing.T) {
+	port := freePort(t)
+	addr := "127.0.0.1:" + port
+	rebind := make(chan httpListen)
+	done := make(chan bool)
+	go func() {
+		serveHTTP(newHTTPHandler(pwd), httpListen{Addr: addr}, rebind)
+		close(done)
+	}()
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	getUntil(t, c, "http://"+addr+"/status")
+
+	// Only the bind address changes, then back again.
+	for _, a := range []string{":" + port, addr} {
+		configStatus.Set("OK")
+		rebind <- httpListen{Addr: a}
+		getUntil(t, c, "http://"+addr+"/status")
+		assert.Equal(t, "OK", configStatus.Value(), a)
+	}
+
+	close(rebind)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The webserver didn't stop.")
+	}
+	l, err := net.Listen("tcp", addr)
+	if assert.NoError(t, err) {
+		l.Close()
+	}
+}
@@ -0,0 +1,232 @@
+/* Backlog Search
+ *
+ * The watchers only see releases as they are announced. Episodes that aired
+ * before a show was added, or that were missed while gumshoe was down, are
+ * found by searching the tracker for every missing episode now and then.
+ * Search results go through the same episode pipeline as announces.
+ */
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Search URLs have this where the search terms go.
+const searchQueryVar = "%query%"
+
+var (
+	// Time, in s, when the last backlog search finished
+	backlogTimestamp = expvar.NewInt("backlog_last_run_timestamp")
+	// String relating to the current state of the backlog search
+	backlogStatus = expvar.NewString("backlog_status")
+	// Most searches one run makes, so a long backlog doesn't hammer the
+	// tracker. The episodes searched for longest ago go first, the rest wait
+	// for the next run.
+	backlogSearchLimit = 50
+	// When the episodes guessed at by backlogEpisodes, which aren't stored,
+	// were last searched for, by show ID. Guarded by backlogLock.
+	guessSearched = map[int64]int64{}
+	backlogLock   sync.Mutex
+	// Starts a backlog search right away.
+	backlogWake = make(chan bool, 1)
+)
+
+// Searcher finds releases of an episode on a tracker.
+type Searcher interface {
+	Search(s Show, e Episode) ([]feedItem, error)
+}
+
+// feedSearcher searches by fetching a feed whose URL takes the search terms.
+type feedSearcher struct {
+	w *RSSWatcher
+}
+
+func newFeedSearcher(f RSSFeed) *feedSearcher {
+	return &feedSearcher{w: NewRSSWatcher(f)}
+}
+
+func (s *feedSearcher) Search(show Show, e Episode) ([]feedItem, error) {
+	w := *s.w
+	w.Feed.URL = strings.Replace(w.Feed.URL, searchQueryVar, url.QueryEscape(searchQuery(show, e)), -1)
+	return w.fetch()
+}
+
+// NewBacklogSearcher picks the search to use from the config. It returns nil
+// when there is nothing to search.
+func NewBacklogSearcher(c *TrackerConfig) Searcher {
+	if c.Backlog.SearchURL != "" {
+		// The search is on the same tracker as the feed, so it takes the same
+		// passkey.
+		f := c.RSS
+		f.URL = c.Backlog.SearchURL
+		f.Type = feedTypeRSS
+		return newFeedSearcher(f)
+	}
+	if c.RSS.isTorznab() {
+		return NewTorznab(c.RSS)
+	}
+	if strings.Contains(c.RSS.URL, searchQueryVar) {
+		return newFeedSearcher(c.RSS)
+	}
+	return nil
+}
+
+// searchQuery is what a release of the episode is searched for with.
+func searchQuery(s Show, e Episode) string {
+	if e.IsDaily() {
+		return fmt.Sprintf("%s %s", s.Title, e.AirDate.Format("2006 01 02"))
+	}
+	return fmt.Sprintf("%s S%02dE%02d", s.Title, e.Season, e.Episode)
+}
+
+// backlogEpisodes are the episodes of a show to search for. Shows without
+// metadata only know about the episodes we fetched, so the one after the last
+// of those is searched for instead.
+func backlogEpisodes(s Show) ([]Episode, error) {
+	eps, err := MissingEpisodes(s.ID)
+	if err != nil || len(eps) > 0 || s.MetadataID != 0 || !s.Episodal {
+		return eps, err
+	}
+	last, err := GetLastEpisode(s.ID)
+	if err != nil {
+		// Nothing fetched yet.
+		return eps, nil
+	}
+	return []Episode{{ShowID: s.ID, Season: last.Season, Episode: last.Episode + 1}}, nil
+}
+
+type backlogSearch struct {
+	show Show
+	ep   Episode
+}
+
+func (b backlogSearch) searched() int64 {
+	if b.ep.ID == 0 {
+		return guessSearched[b.show.ID]
+	}
+	return b.ep.Searched
+}
+
+func (b backlogSearch) markSearched() {
+	now := time.Now().UnixNano()
+	if b.ep.ID == 0 {
+		guessSearched[b.show.ID] = now
+		return
+	}
+	if err := SetEpisodeSearched(b.ep.ID, now); err != nil {
+		log.Printf("Unable to record the backlog search of %s: %s\n", searchQuery(b.show, b.ep), err)
+	}
+}
+
+// RunBacklog searches for the missing episodes of every show, those searched
+// for longest ago first, and sends the results through ProcessRelease. A show
+// or search that fails is logged and skipped. It returns the number of
+// searches made.
+func RunBacklog(s Searcher) (int, error) {
+	backlogLock.Lock()
+	defer backlogLock.Unlock()
+	shows, err := ListShows()
+	if err != nil {
+		return 0, err
+	}
+	todo := []backlogSearch{}
+	for _, show := range shows {
+		eps, err := backlogEpisodes(show)
+		if err != nil {
+			log.Printf("Unable to find the missing episodes of %s: %s\n", show.Title, err)
+			continue
+		}
+		for i := range eps {
+			if !eps[i].IsEpisodeQueued() {
+				todo = append(todo, backlogSearch{show, eps[i]})
+			}
+		}
+	}
+	sort.SliceStable(todo, func(i, j int) bool { return todo[i].searched() < todo[j].searched() })
+
+	searches, failed := 0, 0
+	for _, b := range todo {
+		if searches >= backlogSearchLimit {
+			PrintDebugln("Backlog search limit reached.")
+			break
+		}
+		q := searchQuery(b.show, b.ep)
+		items, err := s.Search(b.show, b.ep)
+		searches++
+		b.markSearched()
+		if err != nil {
+			failed++
+			log.Printf("Search for %s failed: %s\n", q, err)
+			continue
+		}
+		PrintDebugf("Backlog: %d results for %s\n", len(items), q)
+		for _, item := range items {
+			if item.Title == "" || item.Link == "" {
+				continue
+			}
+			if err := ProcessRelease("backlog", item.Title, item.Link, nil); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	if failed > 0 {
+		return searches, fmt.Errorf("%d of %d searches failed", failed, searches)
+	}
+	return searches, nil
+}
+
+func runBacklog() {
+	s := NewBacklogSearcher(currentConfig())
+	if s == nil {
+		backlogStatus.Set("No Search Configured")
+		return
+	}
+	backlogStatus.Set("Searching")
+	n, err := RunBacklog(s)
+	if err != nil {
+		log.Printf("Backlog search failed: %s\n", err)
+		backlogStatus.Set(fmt.Sprintf("Search Error: %s", err))
+		return
+	}
+	PrintDebugf("Backlog search done, %d searches.\n", n)
+	backlogTimestamp.Set(time.Now().Unix())
+	backlogStatus.Set("Idle")
+}
+
+// TriggerBacklog starts a backlog search without waiting for the interval.
+func TriggerBacklog() {
+	select {
+	case backlogWake <- true:
+	default:
+	}
+}
+
+// StartBacklog searches every Backlog.Interval minutes. The interval is read
+// again after every run, so config changes take effect on their own.
+func StartBacklog() {
+	backlogStatus.Set("Ready")
+	go func() {
+		for {
+			wait := time.Duration(currentConfig().Backlog.Interval) * time.Minute
+			if wait <= 0 {
+				// Turned off, check again later in case it's turned on.
+				wait = time.Minute
+			}
+			select {
+			case <-backlogWake:
+				runBacklog()
+			case <-time.After(wait):
+				if currentConfig().Backlog.Interval > 0 {
+					runBacklog()
+				}
+			}
+		}
+	}()
+}
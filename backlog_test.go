@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingEpisodes(t *testing.T) {
+	s := newShow("starting late", "720p", true)
+	s.StartSeason, s.StartEpisode = 3, 1
+	assert.NoError(t, s.AddShow())
+	defer s.DeleteShow()
+
+	missing, err := MissingEpisodes(s.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, missing, 1) {
+		assert.Equal(t, 3, missing[0].Season)
+		assert.Equal(t, 1, missing[0].Episode)
+		assert.Equal(t, EpisodeWanted, missing[0].State)
+	}
+
+	// Nothing before the start point is fetched.
+	assert.False(t, (&Episode{ShowID: s.ID, Season: 2, Episode: 9}).IsNewEpisode())
+	assert.True(t, (&Episode{ShowID: s.ID, Season: 3, Episode: 2}).IsNewEpisode())
+
+	e := &Episode{ShowID: s.ID, Season: 3, Episode: 1, Quality: "720p", State: EpisodeSnatched}
+	assert.NoError(t, e.RecordEpisode())
+	missing, _ = MissingEpisodes(s.ID)
+	assert.Len(t, missing, 0)
+	last, err := GetLastEpisode(s.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, EpisodeSnatched, last.State)
+	assert.Equal(t, 1, last.Episode)
+
+	// Skipped episodes aren't fetched.
+	e = &Episode{ShowID: s.ID, Season: 3, Episode: 2}
+	assert.NoError(t, e.AddEpisode())
+	assert.NoError(t, SetEpisodeState(e.ID, EpisodeSkipped))
+	assert.False(t, e.IsNewEpisode())
+	assert.Error(t, SetEpisodeState(e.ID, "lost"))
+
+	// Moving the start point skips the wanted episodes before it.
+	s.StartSeason, s.StartEpisode = 4, 1
+	assert.NoError(t, s.ApplyStart())
+	missing, _ = MissingEpisodes(s.ID)
+	if assert.Len(t, missing, 1) {
+		assert.Equal(t, 4, missing[0].Season)
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	s := Show{Title: "Daily Shown"}
+	assert.Equal(t, "Daily Shown 2015 03 26", searchQuery(s, Episode{AirDate: NewAirDate(2015, time.March, 26)}))
+	assert.Equal(t, "Daily Shown S02E05", searchQuery(s, Episode{Season: 2, Episode: 5}))
+}
+
+func TestNewBacklogSearcher(t *testing.T) {
+	c := &TrackerConfig{}
+	assert.Nil(t, NewBacklogSearcher(c))
+	c.RSS.URL = "http://localhost/rss?search=%query%"
+	assert.NotNil(t, NewBacklogSearcher(c))
+
+	// The feed itself is polled without a search.
+	u, err := NewRSSWatcher(c.RSS).FeedURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/rss?search=", u)
+}
+
+func TestRunBacklog(t *testing.T) {
+	queries := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("search")
+		queries = append(queries, q)
+		assert.Equal(t, "abc", r.URL.Query().Get("passkey"))
+		items := ""
+		if q == "Backlog Test S01E01" {
+			items = fmt.Sprintf(`<item><title>Backlog.Test.S01E01.720p.HDTV.x264-GRP</title><link>http://%s/1.torrent</link></item>`, r.Host)
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?><rss version="2.0"><channel>%s</channel></rss>`, items)
+	}))
+	defer ts.Close()
+
+	s := newShow("backlog test", "720p", true)
+	s.StartSeason, s.StartEpisode = 1, 1
+	assert.NoError(t, s.AddShow())
+	defer s.DeleteShow()
+
+	c := &TrackerConfig{
+		Backlog: Backlog{SearchURL: ts.URL + "/search?search=%query%"},
+		RSS:     RSSFeed{Passkey: "abc"},
+	}
+	n, err := RunBacklog(NewBacklogSearcher(c))
+	assert.NoError(t, err)
+	assert.True(t, n > 0)
+	assert.Contains(t, queries, "Backlog Test S01E01")
+
+	q, err := ListQueue(QueuePending)
+	assert.NoError(t, err)
+	found := false
+	for _, i := range q {
+		if i.ShowID == s.ID {
+			found = true
+			assert.Equal(t, 1, i.Episode)
+			CancelQueueItem(i.ID)
+		}
+	}
+	assert.True(t, found, "Backlog result wasn't queued.")
+}
+
+func TestRunBacklogRotates(t *testing.T) {
+	queries := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("search")
+		queries = append(queries, q)
+		if q == "Backlog Rotation A S01E01" {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel></channel></rss>`)
+	}))
+	defer ts.Close()
+
+	for _, title := range []string{"backlog rotation a", "backlog rotation b"} {
+		s := newShow(title, "720p", true)
+		s.StartSeason, s.StartEpisode = 1, 1
+		assert.NoError(t, s.AddShow())
+		defer s.DeleteShow()
+	}
+	searcher := NewBacklogSearcher(&TrackerConfig{Backlog: Backlog{SearchURL: ts.URL + "/search?search=%query%"}})
+
+	// A failed search doesn't stop the others.
+	n, err := RunBacklog(searcher)
+	assert.Error(t, err)
+	assert.Contains(t, queries, "Backlog Rotation A S01E01")
+	assert.Contains(t, queries, "Backlog Rotation B S01E01")
+
+	// Searching one episode a run goes through all of them in turn.
+	defer func(l int) { backlogSearchLimit = l }(backlogSearchLimit)
+	backlogSearchLimit = 1
+	first := queries
+	queries = []string{}
+	for i := 0; i < n; i++ {
+		RunBacklog(searcher)
+	}
+	assert.Equal(t, first, queries)
+}
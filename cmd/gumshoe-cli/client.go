@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Client talks to the REST API of a running gumshoe daemon. Token is sent
+// with every request.
+type Client struct {
+	Base       string
+	Token      string
+	HttpClient *http.Client
+}
+
+func NewClient(base string) *Client {
+	return &Client{
+		Base:       strings.TrimRight(base, "/"),
+		HttpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Do sends body, when not nil, as JSON and returns the raw response body.
+// Anything but a 2xx status is returned as an error.
+func (c *Client) Do(method, path string, body interface{}) ([]byte, error) {
+	b, _, err := c.send(method, path, body)
+	return b, err
+}
+
+func (c *Client) send(method, path string, body interface{}) ([]byte, http.Header, error) {
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.Base+path, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return out, resp.Header, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, errorMessage(out))
+	}
+	return out, resp.Header, nil
+}
+
+// errorMessage is the message of an API error body, or the whole body when
+// it isn't one.
+func errorMessage(b []byte) string {
+	e := struct {
+		Error struct {
+			Message string `json:"message"`
+			Fields  []struct {
+				Field   string `json:"field"`
+				Message string `json:"error"`
+			} `json:"fields"`
+		} `json:"error"`
+	}{}
+	if json.Unmarshal(b, &e) != nil || e.Error.Message == "" {
+		return strings.TrimSpace(string(b))
+	}
+	msg := []string{e.Error.Message}
+	for _, f := range e.Error.Fields {
+		msg = append(msg, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return strings.Join(msg, " ")
+}
+
+// Get decodes the JSON response of a GET into v.
+func (c *Client) Get(path string, v interface{}) ([]byte, error) {
+	b, err := c.Do("GET", path, nil)
+	if err != nil {
+		return b, err
+	}
+	if v != nil {
+		err = json.Unmarshal(b, v)
+	}
+	return b, err
+}
+
+var nextPage = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// List gets every page of a list and decodes the whole list into v. The
+// pages are returned as one JSON array.
+func (c *Client) List(path string, v interface{}) ([]byte, error) {
+	all := []json.RawMessage{}
+	for path != "" {
+		b, h, err := c.send("GET", path, nil)
+		if err != nil {
+			return b, err
+		}
+		page := []json.RawMessage{}
+		if err = json.Unmarshal(b, &page); err != nil {
+			return b, err
+		}
+		all = append(all, page...)
+		path = ""
+		if m := nextPage.FindStringSubmatch(h.Get("Link")); m != nil {
+			path = m[1]
+		}
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		err = json.Unmarshal(b, v)
+	}
+	return b, err
+}
+
+// How long Watch waits before reconnecting to a stream that dropped.
+var reconnectDelay = 2 * time.Second
+
+// Watch follows the event stream at path, handing each event to fn, and
+// reconnects where it left off when the stream drops. It only returns when
+// the server refuses the stream or fn returns an error.
+func (c *Client) Watch(path string, fn func(raw []byte, e Event) error) error {
+	last := ""
+	for {
+		err := c.stream(path, &last, fn)
+		if _, ok := err.(streamDropped); !ok {
+			return err
+		}
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// streamDropped is a stream that ended, and can be picked up again.
+type streamDropped struct {
+	error
+}
+
+func (c *Client) stream(path string, last *string, fn func([]byte, Event) error) error {
+	req, err := http.NewRequest("GET", c.Base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if *last != "" {
+		req.Header.Set("Last-Event-ID", *last)
+	}
+	// The stream runs for as long as it's watched, so no timeout.
+	resp, err := (&http.Client{Transport: c.HttpClient.Transport}).Do(req)
+	if err != nil {
+		return streamDropped{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, errorMessage(b))
+	}
+	sc := bufio.NewScanner(resp.Body)
+	id, data := "", []byte(nil)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = line[4:]
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, line[6:]...)
+		case line == "" && data != nil:
+			e := Event{}
+			if err = json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+			if err = fn(data, e); err != nil {
+				return err
+			}
+			*last, data = id, nil
+		}
+	}
+	if err = sc.Err(); err == nil {
+		err = io.EOF
+	}
+	return streamDropped{err}
+}
+
+// The parts of the daemon's JSON objects the CLI prints.
+
+type Event struct {
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	Time    int64  `json:"time"`
+	Watcher string `json:"watcher"`
+	Release string `json:"release"`
+	Message string `json:"message"`
+}
+
+type Show struct {
+	ID         int64  `json:"ID,omitempty"`
+	TvDbId     uint64 `json:"tvdbid"`
+	Title      string `json:"title"`
+	Quality    string `json:"quality"`
+	Episodal   bool   `json:"episodal"`
+	LastUpdate int64  `json:"last_update"`
+}
+
+type Episode struct {
+	ID      int64  `json:"id"`
+	ShowID  int64  `json:"show_id"`
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+	AirDate string `json:"airdate"`
+	State   string `json:"state"`
+	Added   int64  `json:"added"`
+}
+
+type QueueItem struct {
+	ID        int64  `json:"id"`
+	URL       string `json:"url"`
+	Title     string `json:"title"`
+	State     string `json:"state"`
+	Retries   int    `json:"retries"`
+	LastError string `json:"last_error"`
+	Added     int64  `json:"added"`
+}
+
+// PostResult is what post-processing did with one file.
+type PostResult struct {
+	File     string   `json:"file"`
+	Path     string   `json:"path"`
+	State    string   `json:"state"`
+	Episodes []string `json:"episodes"`
+	Error    string   `json:"error"`
+}
+
+type APIToken struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Prefix   string `json:"prefix"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"last_used"`
+	// Only sent when the token is created.
+	Token string `json:"token"`
+}
+
+type IRCChannel struct {
+	Name           string `json:"name"`
+	AnnounceRegexp string `json:"announce_regex"`
+	EpisodeRegexp  string `json:"episode_regex"`
+}
+
+type ReleaseTrace struct {
+	Release       string            `json:"release"`
+	Watcher       string            `json:"watcher"`
+	AnnounceRegex string            `json:"announce_regex"`
+	Link          string            `json:"link"`
+	EpisodeRegex  string            `json:"episode_regex"`
+	Groups        map[string]string `json:"groups"`
+	Parsed        *Release          `json:"parsed"`
+	ShowTitle     string            `json:"show_title"`
+	Show          *Show             `json:"show"`
+	QualityOK     bool              `json:"quality_ok"`
+	IsNew         bool              `json:"is_new"`
+	Queued        bool              `json:"already_queued"`
+	WouldFetch    bool              `json:"would_fetch"`
+	SaveLocation  string            `json:"save_location"`
+	Reason        string            `json:"reason"`
+}
+
+type Release struct {
+	Show       string `json:"show"`
+	Season     int    `json:"season"`
+	Episodes   []int  `json:"episodes"`
+	AirDate    string `json:"airdate"`
+	Resolution string `json:"resolution"`
+	Source     string `json:"source"`
+	Codec      string `json:"codec"`
+	Group      string `json:"group"`
+}
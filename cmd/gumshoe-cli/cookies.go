@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Cookie jar in the form the daemon stores it.
+type cookieJar struct {
+	Cookies []map[string]string `json:"cookies"`
+}
+
+// browserCookie is one cookie as the common browser extensions export them.
+type browserCookie struct {
+	Domain         string  `json:"domain"`
+	Name           string  `json:"name"`
+	Value          string  `json:"value"`
+	Path           string  `json:"path"`
+	ExpirationDate float64 `json:"expirationDate"`
+	Expires        float64 `json:"expires"`
+}
+
+func jarCookie(name, value, path, domain string, expires int64) map[string]string {
+	c := map[string]string{
+		"Name":   name,
+		"Value":  value,
+		"Path":   path,
+		"Domain": domain,
+	}
+	if expires > 0 {
+		c["Expires"] = strconv.FormatInt(expires, 10)
+	}
+	return c
+}
+
+// parseCookieExport reads a browser cookie export. Both the Netscape
+// cookies.txt format and the JSON written by cookie extensions are accepted,
+// as is a jar that is already in gumshoe's own format.
+func parseCookieExport(b []byte) (*cookieJar, error) {
+	jar := &cookieJar{Cookies: []map[string]string{}}
+	t := bytes.TrimSpace(b)
+	if len(t) == 0 {
+		return nil, errors.New("cookie export is empty")
+	}
+
+	switch t[0] {
+	case '{':
+		if err := json.Unmarshal(t, jar); err != nil {
+			return nil, err
+		}
+	case '[':
+		bc := []browserCookie{}
+		if err := json.Unmarshal(t, &bc); err != nil {
+			return nil, err
+		}
+		for _, c := range bc {
+			exp := c.ExpirationDate
+			if exp == 0 {
+				exp = c.Expires
+			}
+			jar.Cookies = append(jar.Cookies, jarCookie(c.Name, c.Value, c.Path, c.Domain, int64(exp)))
+		}
+	default:
+		s := bufio.NewScanner(bytes.NewReader(t))
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			f := strings.Split(line, "\t")
+			if len(f) != 7 {
+				return nil, fmt.Errorf("line %d is not a cookies.txt entry", n)
+			}
+			exp, _ := strconv.ParseInt(f[4], 10, 64)
+			jar.Cookies = append(jar.Cookies, jarCookie(f[5], f[6], f[2], f[0], exp))
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(jar.Cookies) == 0 {
+		return nil, errors.New("no cookies found in the export")
+	}
+	return jar, nil
+}
@@ -1,28 +1,88 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 var defaultConfigFile = filepath.Join(os.Getenv("HOME"), ".gumshoe", "config.json")
 var configFile = flag.String("c", defaultConfigFile,
 	"Location of the configuration file.")
+var server = flag.String("s", "",
+	"Address of the gumshoe server. Overrides the port in the configuration file.")
+var token = flag.String("t", "",
+	"API token. Overrides GUMSHOE_TOKEN and the token file the server writes.")
+var jsonOutput = flag.Bool("json", false, "Print the raw JSON returned by the server.")
 
-var usageString = `Usage: gumshoe-cli [options] <op> 
+const (
+	// The daemon writes a token for the CLI to this file in its data_dir.
+	cliTokenFile = "cli.token"
+	// The certificate the daemon makes when tls_self_signed is set.
+	selfSignedCert = "gumshoe.crt"
+)
+
+var usageString = `Usage: gumshoe-cli [options] <op>
 
 op:
-  add <url>     - add url to download queue
-  test <string> - test string against patterns, add to download queue if match found
-  status        - server status
-  patterns      - show configured patterns
-  config        - show config
+  add <url> [title]          - add url to download queue
+  test <string>              - show how an announce line or release name would be handled,
+                               nothing is downloaded
+  status                     - server status
+  patterns                   - show configured patterns
+  config                     - show config
+  config get <section>       - show one config section
+  config set <section> <json|@file>
+                             - replace one config section
+  shows list                 - list tracked shows
+  shows add <title> [quality] [daily]
+                             - track a new show
+  shows update <id> <title> [quality] [daily]
+                             - change a tracked show
+  shows delete <id>          - stop tracking a show
+  episodes <show>            - list episodes of a show, by id or title
+  missing <show>             - list aired episodes of a show that are still wanted
+  backlog                    - search for missing episodes now
+  postprocess [path]         - sort finished downloads into the library now, all of the
+                               download_dir or just path
+  queue list [state]         - list the download queue
+  queue add <url> [title]    - add url to download queue
+  queue rm <id>              - cancel a queued download
+  secrets list               - list the names in the secrets store
+  secrets set <name> <value> - store a secret, use it in the config as "secret:<name>"
+  secrets rm <name>          - delete a secret
+  cookies import <file>      - load a browser cookie export (cookies.txt or JSON)
+                               into the encrypted tracker cookie jar
+  tokens list                - list API tokens
+  tokens create <name>       - make an API token, it is only shown once
+  tokens revoke <id>         - revoke an API token
+  password                   - set the web interface password, read from stdin
+  watch [type,...]           - follow what gumshoe is doing, e.g. watch rejected,matched
 
 options:
   -c            - location of the configuration file
                   [default: %s]
+  -s            - gumshoe server address, e.g. http://localhost:20123
+  -t            - API token, also read from GUMSHOE_TOKEN
+                  [default: the cli.token file in the server's data_dir]
+  --json        - print JSON instead of tables
 `
 
 func usage() {
@@ -30,26 +90,686 @@ func usage() {
 	os.Exit(2)
 }
 
-func main() {
-	flag.Parse()
+// daemonConfig is what the CLI needs from the daemon's config file.
+type daemonConfig struct {
+	Directories map[string]string `json:"dir_options"`
+	Operations  struct {
+		HttpPort      string `json:"http_port"`
+		BindAddress   string `json:"bind_address"`
+		TLSCert       string `json:"tls_cert"`
+		TLSSelfSigned bool   `json:"tls_self_signed"`
+	} `json:"operations"`
+}
+
+// dataPath puts a relative path in the daemon's data_dir.
+func (c *daemonConfig) dataPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.Directories["user_dir"], c.Directories["data_dir"], p)
+}
+
+// certFile is the certificate the daemon serves HTTPS with, if it does.
+func (c *daemonConfig) certFile() string {
+	if c.Operations.TLSCert != "" {
+		return c.dataPath(c.Operations.TLSCert)
+	}
+	if c.Operations.TLSSelfSigned {
+		return c.dataPath(selfSignedCert)
+	}
+	return ""
+}
+
+func readConfig(cfg string) (*daemonConfig, error) {
+	b, err := ioutil.ReadFile(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config %s: %s", cfg, err)
+	}
+	c := &daemonConfig{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("Unable to parse config %s: %s", cfg, err)
+	}
+	return c, nil
+}
+
+// serverAddress works out where the daemon listens from the -s flag or the
+// http_port and bind_address in the config file.
+func serverAddress(cfg string) (string, error) {
+	if *server != "" {
+		return *server, nil
+	}
+	c, err := readConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+	if c.Operations.HttpPort == "" {
+		return "", errors.New("No http_port set in the config.")
+	}
+	host := c.Operations.BindAddress
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	scheme := "http://"
+	if c.certFile() != "" {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, c.Operations.HttpPort), nil
+}
 
-	// TODO(deekue) replace println with actual gumshoe function calls
-	switch flag.Arg(0) {
+// serverCerts trusts the daemon's own certificate, which is self-signed more
+// often than not, along with the system's.
+func serverCerts(cfg string) (*x509.CertPool, error) {
+	c, err := readConfig(cfg)
+	if err != nil || c.certFile() == "" {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(c.certFile())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the server certificate: %s", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificate found in %s", c.certFile())
+	}
+	return pool, nil
+}
+
+// apiToken finds the token to send, from -t, GUMSHOE_TOKEN or the token file
+// the daemon leaves in its data_dir.
+func apiToken(cfg string) (string, error) {
+	if *token != "" {
+		return *token, nil
+	}
+	if t := os.Getenv("GUMSHOE_TOKEN"); t != "" {
+		return t, nil
+	}
+	c, err := readConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+	f := c.dataPath(cliTokenFile)
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the API token: %s", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// CLI runs a single command against the daemon and writes the result to Out.
+type CLI struct {
+	Client *Client
+	In     io.Reader
+	Out    io.Writer
+	JSON   bool
+}
+
+func (c *CLI) printJSON(b []byte) error {
+	out := bytes.Buffer{}
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		_, err = c.Out.Write(b)
+		return err
+	}
+	fmt.Fprintln(c.Out, out.String())
+	return nil
+}
+
+func (c *CLI) table(header string, rows [][]string) {
+	w := tabwriter.NewWriter(c.Out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, r := range rows {
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	w.Flush()
+}
+
+func formatTime(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	// Show timestamps are stored in ns, everything else in s.
+	if ts > 1e12 {
+		return time.Unix(0, ts).Format("2006-01-02 15:04")
+	}
+	return time.Unix(ts, 0).Format("2006-01-02 15:04")
+}
+
+func arg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+func (c *CLI) Run(args []string) error {
+	switch arg(args, 0) {
 	case "add":
-		println("add url to download queue", flag.Arg(1))
-		os.Exit(0)
+		return c.queue(append([]string{"add"}, args[1:]...))
 	case "test":
-		println("test string", flag.Arg(1))
-		os.Exit(0)
+		if len(args) < 2 {
+			usage()
+		}
+		return c.test(strings.Join(args[1:], " "))
 	case "status":
-		println("status")
-		os.Exit(0)
+		b, err := c.Client.Do("GET", "/status", nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.Out, string(b))
+		return nil
 	case "p", "pat", "patterns":
-		println("pattern show")
-		os.Exit(0)
+		return c.patterns()
 	case "config":
-		println("config show")
-		os.Exit(0)
+		return c.config(args[1:])
+	case "shows":
+		return c.shows(args[1:])
+	case "episodes":
+		return c.episodes("episodes", args[1:])
+	case "missing":
+		return c.episodes("missing", args[1:])
+	case "backlog":
+		_, err := c.Client.Do("POST", "/api/v1/backlog", nil)
+		if err == nil {
+			fmt.Fprintln(c.Out, "Backlog search started.")
+		}
+		return err
+	case "postprocess":
+		return c.postProcess(arg(args, 1))
+	case "queue":
+		return c.queue(args[1:])
+	case "secrets":
+		return c.secrets(args[1:])
+	case "cookies":
+		return c.cookies(args[1:])
+	case "tokens":
+		return c.tokens(args[1:])
+	case "password":
+		return c.password()
+	case "watch":
+		return c.watch(arg(args, 1))
 	}
 	usage()
+	return nil
+}
+
+func (c *CLI) test(s string) error {
+	b, err := c.Client.Do("POST", "/api/v1/test", map[string]string{"input": s})
+	if err != nil {
+		return err
+	}
+	if c.JSON {
+		return c.printJSON(b)
+	}
+	t := ReleaseTrace{}
+	if err = json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	rows := [][]string{
+		{"release", t.Release},
+		{"watcher", t.Watcher},
+		{"announce regex", t.AnnounceRegex},
+		{"link", t.Link},
+		{"episode regex", t.EpisodeRegex},
+	}
+	keys := []string{}
+	for k := range t.Groups {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rows = append(rows, []string{"group " + k, t.Groups[k]})
+	}
+	if r := t.Parsed; r != nil {
+		rows = append(rows,
+			[]string{"parsed", fmt.Sprintf("%s season %d episodes %v %s", r.Show, r.Season, r.Episodes, r.AirDate)},
+			[]string{"quality", strings.TrimSpace(strings.Join([]string{r.Resolution, r.Source, r.Codec}, " "))},
+			[]string{"group", r.Group},
+		)
+	}
+	if t.Show != nil {
+		rows = append(rows, []string{"show", fmt.Sprintf("%s (%d)", t.Show.Title, t.Show.ID)})
+	} else {
+		rows = append(rows, []string{"show", t.ShowTitle + " (not tracked)"})
+	}
+	rows = append(rows,
+		[]string{"quality ok", strconv.FormatBool(t.QualityOK)},
+		[]string{"new episode", strconv.FormatBool(t.IsNew)},
+		[]string{"already queued", strconv.FormatBool(t.Queued)},
+		[]string{"would fetch", strconv.FormatBool(t.WouldFetch)},
+		[]string{"save location", t.SaveLocation},
+		[]string{"reason", t.Reason},
+	)
+	c.table("STEP\tRESULT", rows)
+	return nil
+}
+
+func (c *CLI) patterns() error {
+	channels := []IRCChannel{}
+	b, err := c.Client.Get("/api/v1/config/irc_channel", &channels)
+	if err != nil {
+		return err
+	}
+	if c.JSON {
+		return c.printJSON(b)
+	}
+	rows := [][]string{}
+	for _, ch := range channels {
+		ar, _ := url.QueryUnescape(ch.AnnounceRegexp)
+		er, _ := url.QueryUnescape(ch.EpisodeRegexp)
+		rows = append(rows, []string{ch.Name, "announce", ar}, []string{ch.Name, "episode", er})
+	}
+	c.table("WATCHER\tPATTERN\tREGEX", rows)
+	return nil
+}
+
+func (c *CLI) config(args []string) error {
+	switch arg(args, 0) {
+	case "", "show":
+		b, err := c.Client.Get("/settings", nil)
+		if err != nil {
+			return err
+		}
+		return c.printJSON(b)
+	case "get":
+		if len(args) < 2 {
+			usage()
+		}
+		b, err := c.Client.Get("/api/v1/config/"+url.PathEscape(args[1]), nil)
+		if err != nil {
+			return err
+		}
+		return c.printJSON(b)
+	case "set":
+		if len(args) < 3 {
+			usage()
+		}
+		raw := []byte(args[2])
+		if strings.HasPrefix(args[2], "@") {
+			var err error
+			if raw, err = ioutil.ReadFile(args[2][1:]); err != nil {
+				return err
+			}
+		}
+		if !json.Valid(raw) {
+			return errors.New("config value is not valid JSON")
+		}
+		b, err := c.Client.Do("PUT", "/api/v1/config/"+url.PathEscape(args[1]), json.RawMessage(raw))
+		if err != nil {
+			return err
+		}
+		return c.printJSON(b)
+	}
+	usage()
+	return nil
+}
+
+func (c *CLI) secrets(args []string) error {
+	switch arg(args, 0) {
+	case "", "list":
+		names := []string{}
+		b, err := c.Client.Get("/api/v1/secrets", &names)
+		if err != nil {
+			return err
+		}
+		if c.JSON {
+			return c.printJSON(b)
+		}
+		for _, n := range names {
+			fmt.Fprintln(c.Out, n)
+		}
+		return nil
+	case "set":
+		if len(args) < 3 {
+			usage()
+		}
+		b, err := c.Client.Do("POST", "/api/v1/secrets", map[string]string{"name": args[1], "value": args[2]})
+		if err != nil {
+			return err
+		}
+		if c.JSON {
+			return c.printJSON(b)
+		}
+		fmt.Fprintf(c.Out, "Stored %s, refer to it as \"secret:%s\"\n", args[1], args[1])
+		return nil
+	case "rm":
+		if len(args) < 2 {
+			usage()
+		}
+		if _, err := c.Client.Do("DELETE", "/api/v1/secrets/"+url.PathEscape(args[1]), nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.Out, "Deleted %s\n", args[1])
+		return nil
+	}
+	usage()
+	return nil
+}
+
+func (c *CLI) cookies(args []string) error {
+	if arg(args, 0) != "import" || len(args) < 2 {
+		usage()
+	}
+	b, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	jar, err := parseCookieExport(b)
+	if err != nil {
+		return fmt.Errorf("%s: %s", args[1], err)
+	}
+	if _, err = c.Client.Do("POST", "/api/v1/cookies", jar); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.Out, "Imported %d cookies\n", len(jar.Cookies))
+	return nil
+}
+
+func (c *CLI) tokens(args []string) error {
+	switch arg(args, 0) {
+	case "", "list":
+		tokens := []APIToken{}
+		b, err := c.Client.List("/api/v1/tokens", &tokens)
+		if err != nil {
+			return err
+		}
+		if c.JSON {
+			return c.printJSON(b)
+		}
+		rows := [][]string{}
+		for _, t := range tokens {
+			rows = append(rows, []string{strconv.FormatInt(t.ID, 10), t.Name, t.Prefix + "...",
+				formatTime(t.Created), formatTime(t.LastUsed)})
+		}
+		c.table("ID\tNAME\tTOKEN\tCREATED\tLAST USED", rows)
+		return nil
+	case "create":
+		if len(args) < 2 {
+			usage()
+		}
+		t := APIToken{}
+		b, err := c.Client.Do("POST", "/api/v1/tokens", map[string]string{"name": strings.Join(args[1:], " ")})
+		if err != nil {
+			return err
+		}
+		if c.JSON {
+			return c.printJSON(b)
+		}
+		if err = json.Unmarshal(b, &t); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.Out, "Token %d created. Keep it safe, it won't be shown again:\n%s\n", t.ID, t.Token)
+		return nil
+	case "revoke", "rm":
+		if len(args) < 2 {
+			usage()
+		}
+		if _, err := c.Client.Do("DELETE", "/api/v1/tokens/"+url.PathEscape(args[1]), nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.Out, "Token %s revoked.\n", args[1])
+		return nil
+	}
+	usage()
+	return nil
+}
+
+// password sets the web password to the first line of In.
+func (c *CLI) password() error {
+	fmt.Fprint(c.Out, "New web password: ")
+	p, err := bufio.NewReader(c.In).ReadString('\n')
+	if err != nil && (err != io.EOF || p == "") {
+		return errors.New("No password given.")
+	}
+	fmt.Fprintln(c.Out)
+	if _, err = c.Client.Do("PUT", "/api/v1/password", map[string]string{"password": strings.TrimRight(p, "\r\n")}); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.Out, "Web password set.")
+	return nil
+}
+
+// watch prints events as they happen, only those of the listed types if
+// there are any.
+func (c *CLI) watch(types string) error {
+	path := "/api/v1/events"
+	if types != "" {
+		path += "?types=" + url.QueryEscape(types)
+	}
+	return c.Client.Watch(path, func(raw []byte, e Event) error {
+		if c.JSON {
+			_, err := fmt.Fprintf(c.Out, "%s\n", raw)
+			return err
+		}
+		line := []string{time.Unix(e.Time, 0).Format("2006-01-02 15:04:05"), e.Type}
+		for _, s := range []string{e.Watcher, e.Release, e.Message} {
+			if s != "" {
+				line = append(line, s)
+			}
+		}
+		_, err := fmt.Fprintln(c.Out, strings.Join(line, "  "))
+		return err
+	})
+}
+
+// postProcess asks the server to sort the downloads at path, or all of them,
+// into the library. The torrent client can run it when a download finishes.
+func (c *CLI) postProcess(path string) error {
+	req := map[string]string{}
+	if path != "" {
+		// The server resolves it, not from this directory.
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		req["path"] = abs
+	}
+	b, err := c.Client.Do("POST", "/api/v1/postprocess", req)
+	if err != nil {
+		return err
+	}
+	if c.JSON {
+		return c.printJSON(b)
+	}
+	results := []PostResult{}
+	if err = json.Unmarshal(b, &results); err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(c.Out, "Nothing to post-process.")
+		return nil
+	}
+	rows := [][]string{}
+	for _, r := range results {
+		to := r.Path
+		if r.Error != "" {
+			to = r.Error
+		}
+		rows = append(rows, []string{r.State, strings.Join(r.Episodes, ","), r.File, to})
+	}
+	c.table("STATE\tEPISODES\tFILE\tTO", rows)
+	return nil
+}
+
+// showFromArgs builds a show from <title> [quality] [daily].
+func showFromArgs(args []string) Show {
+	return Show{
+		Title:    arg(args, 0),
+		Quality:  arg(args, 1),
+		Episodal: arg(args, 2) != "daily",
+	}
+}
+
+func (c *CLI) shows(args []string) error {
+	switch arg(args, 0) {
+	case "", "list":
+		shows := []Show{}
+		b, err := c.Client.List("/api/v1/shows", &shows)
+		if err != nil {
+			return err
+		}
+		if c.JSON {
+			return c.printJSON(b)
+		}
+		rows := [][]string{}
+		for _, s := range shows {
+			rows = append(rows, []string{strconv.FormatInt(s.ID, 10), s.Title, s.Quality,
+				strconv.FormatBool(!s.Episodal), formatTime(s.LastUpdate)})
+		}
+		c.table("ID\tTITLE\tQUALITY\tDAILY\tLAST UPDATE", rows)
+		return nil
+	case "add":
+		if len(args) < 2 {
+			usage()
+		}
+		b, err := c.Client.Do("POST", "/api/v1/shows", showFromArgs(args[1:]))
+		if err != nil {
+			return err
+		}
+		return c.printJSON(b)
+	case "update":
+		if len(args) < 3 {
+			usage()
+		}
+		_, err := c.Client.Do("PUT", "/api/v1/shows/"+url.PathEscape(args[1]), showFromArgs(args[2:]))
+		if err == nil {
+			fmt.Fprintf(c.Out, "Show %s updated.\n", args[1])
+		}
+		return err
+	case "delete", "rm":
+		if len(args) < 2 {
+			usage()
+		}
+		_, err := c.Client.Do("DELETE", "/api/v1/shows/"+url.PathEscape(args[1]), nil)
+		if err == nil {
+			fmt.Fprintf(c.Out, "Show %s deleted.\n", args[1])
+		}
+		return err
+	}
+	usage()
+	return nil
+}
+
+// showID resolves a show id or title to the show's id.
+func (c *CLI) showID(s string) (int64, error) {
+	if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return id, nil
+	}
+	shows := []Show{}
+	if _, err := c.Client.List("/api/v1/shows", &shows); err != nil {
+		return 0, err
+	}
+	for _, show := range shows {
+		if strings.EqualFold(show.Title, s) {
+			return show.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("No show named %s is tracked.", s)
+}
+
+// episodes prints one of the episode lists of a show, "episodes" or
+// "missing".
+func (c *CLI) episodes(list string, args []string) error {
+	if len(args) < 1 {
+		usage()
+	}
+	id, err := c.showID(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	eps := []Episode{}
+	b, err := c.Client.List(fmt.Sprintf("/api/v1/shows/%d/%s", id, list), &eps)
+	if err != nil {
+		return err
+	}
+	if c.JSON {
+		return c.printJSON(b)
+	}
+	rows := [][]string{}
+	for _, e := range eps {
+		rows = append(rows, []string{strconv.FormatInt(e.ID, 10), strconv.Itoa(e.Season), strconv.Itoa(e.Episode),
+			e.AirDate, e.State, formatTime(e.Added)})
+	}
+	c.table("ID\tSEASON\tEPISODE\tAIRDATE\tSTATE\tADDED", rows)
+	return nil
+}
+
+func (c *CLI) queue(args []string) error {
+	switch arg(args, 0) {
+	case "", "list":
+		path := "/api/v1/queue"
+		if s := arg(args, 1); s != "" {
+			path += "?state=" + url.QueryEscape(s)
+		}
+		items := []QueueItem{}
+		b, err := c.Client.List(path, &items)
+		if err != nil {
+			return err
+		}
+		if c.JSON {
+			return c.printJSON(b)
+		}
+		rows := [][]string{}
+		for _, q := range items {
+			name := q.Title
+			if name == "" {
+				name = q.URL
+			}
+			rows = append(rows, []string{strconv.FormatInt(q.ID, 10), q.State, strconv.Itoa(q.Retries),
+				formatTime(q.Added), name, q.LastError})
+		}
+		c.table("ID\tSTATE\tRETRIES\tADDED\tRELEASE\tERROR", rows)
+		return nil
+	case "add":
+		if len(args) < 2 {
+			usage()
+		}
+		b, err := c.Client.Do("POST", "/api/v1/queue", QueueItem{URL: args[1], Title: arg(args, 2)})
+		if err != nil {
+			return err
+		}
+		return c.printJSON(b)
+	case "rm", "delete", "cancel":
+		if len(args) < 2 {
+			usage()
+		}
+		_, err := c.Client.Do("DELETE", "/api/v1/queue/"+url.PathEscape(args[1]), nil)
+		if err == nil {
+			fmt.Fprintf(c.Out, "Queue item %s cancelled.\n", args[1])
+		}
+		return err
+	}
+	usage()
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	addr, err := serverAddress(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	client := NewClient(addr)
+	// Without a token only the status can be read, let the server say so.
+	if client.Token, err = apiToken(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+	if pool, err := serverCerts(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	} else if pool != nil {
+		client.HttpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	c := &CLI{Client: client, In: os.Stdin, Out: os.Stdout, JSON: *jsonOutput}
+	if err = c.Run(flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/shows":
+			fmt.Fprint(w, `[{"ID": 1, "title": "Walking Bread", "quality": "720p", "episodal": true}]`)
+		case "GET /api/v1/shows/1/episodes":
+			// Two pages, one episode each.
+			if r.URL.Query().Get("offset") == "" {
+				w.Header().Set("Link", `</api/v1/shows/1/episodes?offset=1&limit=1>; rel="next"`)
+				fmt.Fprint(w, `[{"id": 4, "show_id": 1, "season": 1, "episode": 6}]`)
+			} else {
+				fmt.Fprint(w, `[{"id": 8, "show_id": 1, "season": 1, "episode": 9}]`)
+			}
+		case "GET /api/v1/shows/1/missing":
+			fmt.Fprint(w, `[{"id": 5, "show_id": 1, "season": 1, "episode": 7, "state": "wanted"}]`)
+		case "POST /api/v1/postprocess":
+			req := map[string]string{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			fmt.Fprintf(w, `[{"file": %q, "path": "/tv/Walking Bread/Season 01/Walking Bread - S01E06.mkv", "state": "linked", "episodes": ["S01E06"]},`+
+				`{"file": "/dl/other.mkv", "state": "failed", "error": "Show Other is not being tracked."}]`, req["path"])
+		case "POST /api/v1/backlog":
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `null`)
+		case "POST /api/v1/queue":
+			q := QueueItem{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&q))
+			q.ID = 7
+			q.State = "pending"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(q)
+		case "POST /api/v1/test":
+			fmt.Fprint(w, `{"release": "walking.bread.s01e06.720p", "groups": {"show": "walking.bread", "season": "01"}, "show_title": "Walking Bread", "reason": "Show Walking Bread is not being tracked."}`)
+		case "POST /api/v1/cookies":
+			jar := cookieJar{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&jar))
+			fmt.Fprintf(w, `{"imported": %d}`, len(jar.Cookies))
+		case "DELETE /api/v1/queue/7":
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE /api/v1/queue/8":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"status": 404, "message": "Queue item 8 doesn't exist."}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestServerAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-cli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(cfg, []byte(`{"operations": {"http_port": "20123"}}`), 0600))
+	addr, err := serverAddress(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:20123", addr)
+
+	assert.NoError(t, ioutil.WriteFile(cfg, []byte(`{"operations": {"http_port": "20123", "bind_address": "::1"}}`), 0600))
+	addr, err = serverAddress(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://[::1]:20123", addr)
+
+	assert.NoError(t, ioutil.WriteFile(cfg, []byte(`{"operations": {"http_port": "20123", "tls_self_signed": true}}`), 0600))
+	addr, err = serverAddress(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://localhost:20123", addr)
+
+	_, err = serverAddress(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestAPIToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-cli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(cfg, []byte(`{"dir_options": {"user_dir": "`+dir+`", "data_dir": "data"}}`), 0600))
+	_, err = apiToken(cfg)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "data"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data", cliTokenFile), []byte("gs_file\n"), 0600))
+	tok, err := apiToken(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "gs_file", tok)
+
+	os.Setenv("GUMSHOE_TOKEN", "gs_env")
+	defer os.Unsetenv("GUMSHOE_TOKEN")
+	tok, _ = apiToken(cfg)
+	assert.Equal(t, "gs_env", tok)
+}
+
+func TestTokenCommands(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gs_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"status": 401, "message": "Log in or send an API token."}}`)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/tokens":
+			fmt.Fprint(w, `[{"id": 1, "name": "gumshoe-cli", "prefix": "gs_abcdef"}]`)
+		case "POST /api/v1/tokens":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": 2, "name": "script", "prefix": "gs_123456", "token": "gs_123456789"}`)
+		case "DELETE /api/v1/tokens/2":
+			w.WriteHeader(http.StatusNoContent)
+		case "PUT /api/v1/password":
+			p := map[string]string{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+			assert.Equal(t, "correct horse", p["password"])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	out := &bytes.Buffer{}
+	c := &CLI{Client: NewClient(ts.URL), Out: out}
+	err := c.Run([]string{"tokens", "list"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "401 Unauthorized: Log in or send an API token.")
+	}
+
+	c.Client.Token = "gs_test"
+	assert.NoError(t, c.Run([]string{"tokens", "list"}))
+	assert.Contains(t, out.String(), "gs_abcdef...")
+
+	out.Reset()
+	assert.NoError(t, c.Run([]string{"tokens", "create", "script"}))
+	assert.Contains(t, out.String(), "gs_123456789")
+
+	out.Reset()
+	assert.NoError(t, c.Run([]string{"tokens", "revoke", "2"}))
+	assert.Contains(t, out.String(), "revoked")
+
+	out.Reset()
+	c.In = strings.NewReader("correct horse\n")
+	assert.NoError(t, c.Run([]string{"password"}))
+	assert.Contains(t, out.String(), "Web password set.")
+}
+
+func TestShowsAndEpisodes(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	out := &bytes.Buffer{}
+	c := &CLI{Client: NewClient(ts.URL), Out: out}
+	assert.NoError(t, c.Run([]string{"shows", "list"}))
+	assert.Contains(t, out.String(), "Walking Bread")
+	assert.True(t, strings.HasPrefix(out.String(), "ID"))
+
+	out.Reset()
+	assert.NoError(t, c.Run([]string{"episodes", "walking", "bread"}))
+	assert.Contains(t, out.String(), "SEASON")
+
+	out.Reset()
+	c.JSON = true
+	assert.NoError(t, c.Run([]string{"episodes", "1"}))
+	assert.Contains(t, out.String(), `"season": 1`)
+	assert.Contains(t, out.String(), `"episode": 9`)
+
+	assert.Error(t, c.Run([]string{"episodes", "not tracked"}))
+
+	out.Reset()
+	c.JSON = false
+	assert.NoError(t, c.Run([]string{"missing", "1"}))
+	assert.Contains(t, out.String(), "wanted")
+
+	out.Reset()
+	assert.NoError(t, c.Run([]string{"backlog"}))
+	assert.Contains(t, out.String(), "started")
+
+	out.Reset()
+	assert.NoError(t, c.Run([]string{"postprocess", "/dl/walking.bread.s01e06.mkv"}))
+	assert.Contains(t, out.String(), "linked")
+	assert.Contains(t, out.String(), "/dl/walking.bread.s01e06.mkv")
+	assert.Contains(t, out.String(), "/tv/Walking Bread/Season 01/Walking Bread - S01E06.mkv")
+	assert.Contains(t, out.String(), "Show Other is not being tracked.")
+}
+
+func TestQueueCommands(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	out := &bytes.Buffer{}
+	c := &CLI{Client: NewClient(ts.URL), Out: out}
+	assert.NoError(t, c.Run([]string{"add", "http://localhost/1.torrent", "walking.bread.s01e06"}))
+	assert.Contains(t, out.String(), `"state": "pending"`)
+
+	out.Reset()
+	assert.NoError(t, c.Run([]string{"queue", "rm", "7"}))
+	assert.Contains(t, out.String(), "cancelled")
+
+	err := c.Run([]string{"queue", "rm", "8"})
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasSuffix(err.Error(), "404 Not Found: Queue item 8 doesn't exist."), err.Error())
+	}
+}
+
+func TestTestCommand(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	out := &bytes.Buffer{}
+	c := &CLI{Client: NewClient(ts.URL), Out: out}
+	assert.NoError(t, c.Run([]string{"test", "walking.bread.s01e06.720p"}))
+	assert.Contains(t, out.String(), "group season")
+	assert.Contains(t, out.String(), "Walking Bread (not tracked)")
+	assert.Contains(t, out.String(), "is not being tracked")
+}
+
+func TestParseCookieExport(t *testing.T) {
+	txt := "# Netscape HTTP Cookie File\n" +
+		"tracker.test\tFALSE\t/\tFALSE\t1900000000\tuid\t1\n" +
+		"#HttpOnly_tracker.test\tFALSE\t/\tTRUE\t0\tpass\tsecret\n"
+	jar, err := parseCookieExport([]byte(txt))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"Name": "uid", "Value": "1", "Path": "/", "Domain": "tracker.test", "Expires": "1900000000"},
+		{"Name": "pass", "Value": "secret", "Path": "/", "Domain": "tracker.test"},
+	}, jar.Cookies)
+
+	jar, err = parseCookieExport([]byte(`[{"domain": ".tracker.test", "name": "uid", "value": "1", "path": "/", "expirationDate": 1900000000.5}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, "1900000000", jar.Cookies[0]["Expires"])
+	assert.Equal(t, ".tracker.test", jar.Cookies[0]["Domain"])
+
+	jar, err = parseCookieExport([]byte(`{"cookies": [{"Name": "uid", "Value": "1"}]}`))
+	assert.NoError(t, err)
+	assert.Len(t, jar.Cookies, 1)
+
+	for _, bad := range []string{"", "not\ta cookie", "[]"} {
+		_, err = parseCookieExport([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestCookiesImport(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "gumshoe-cli")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "cookies.txt")
+	assert.NoError(t, ioutil.WriteFile(f, []byte("tracker.test\tFALSE\t/\tFALSE\t0\tuid\t1\n"), 0600))
+	out := &bytes.Buffer{}
+	c := &CLI{Client: NewClient(ts.URL), Out: out}
+	assert.NoError(t, c.Run([]string{"cookies", "import", f}))
+	assert.Contains(t, out.String(), "Imported 1 cookies")
+}
+
+func TestWatch(t *testing.T) {
+	reconnectDelay = 0
+	conns := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/events", r.URL.Path)
+		assert.Equal(t, "rejected,matched", r.URL.Query().Get("types"))
+		conns++
+		w.Header().Set("Content-Type", "text/event-stream")
+		if conns == 1 {
+			assert.Empty(t, r.Header.Get("Last-Event-ID"))
+			fmt.Fprint(w, "id: 1\nevent: rejected\ndata: {\"id\": 1, \"type\": \"rejected\", \"watcher\": \"rss\", \"message\": \"Not wanted.\"}\n\n")
+			fmt.Fprint(w, ": keep-alive\n\n")
+			fmt.Fprint(w, "id: 2\nevent: matched\ndata: {\"id\": 2, \"type\": \"matched\", \"release\": \"Walking.Bread.S01E01\"}\n\n")
+			return
+		}
+		// The stream dropped, and picks up after the last event.
+		assert.Equal(t, "2", r.Header.Get("Last-Event-ID"))
+		fmt.Fprint(w, "id: 3\nevent: matched\ndata: {\"id\": 3, \"type\": \"matched\", \"release\": \"last\"}\n\n")
+	}))
+	defer ts.Close()
+
+	out := &bytes.Buffer{}
+	c := &CLI{Client: NewClient(ts.URL), Out: out}
+	stop := errors.New("stop")
+	seen := []int64{}
+	err := c.Client.Watch("/api/v1/events?types=rejected,matched", func(raw []byte, e Event) error {
+		seen = append(seen, e.ID)
+		if e.Release == "last" {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []int64{1, 2, 3}, seen)
+
+	conns = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"status": 401, "message": "Log in or send an API token."}}`)
+	})
+	err = c.Run([]string{"watch", "matched"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "401 Unauthorized")
+	}
+}
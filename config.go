@@ -6,9 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +21,7 @@ import (
 // Options can be changed from the web app or directly in the file. A file watcher will update
 // the configuration automatically when the prferrence file is modified.
 type IRCChannel struct {
+	Name           string `json:"name"`
 	ChannelOwner   string `json:"owner"`
 	Nick           string `json:"nick"`
 	Registered     bool   `json:"registered"`
@@ -32,9 +38,56 @@ type IRCChannel struct {
 	EpisodeRegexp  string `json:"episode_regex"`
 }
 
+// IRCChannels is the list of announce channels to watch. A single channel
+// object, as written by older versions of gumshoe, is accepted as well.
+type IRCChannels []IRCChannel
+
+func (ic *IRCChannels) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '{' {
+		c := IRCChannel{}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return err
+		}
+		*ic = IRCChannels{c}
+	} else {
+		l := []IRCChannel{}
+		if err := json.Unmarshal(b, &l); err != nil {
+			return err
+		}
+		*ic = IRCChannels(l)
+	}
+	for i := range *ic {
+		if (*ic)[i].Name == "" {
+			(*ic)[i].Name = (*ic)[i].defaultName()
+		}
+	}
+	return nil
+}
+
+// Get returns the channel config with the given name.
+func (ic IRCChannels) Get(name string) (IRCChannel, bool) {
+	for _, c := range ic {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return IRCChannel{}, false
+}
+
+func (c IRCChannel) defaultName() string {
+	if c.Server == "" {
+		return c.WatchChannel
+	}
+	return c.Server + c.WatchChannel
+}
+
+// RSSFeed is an RSS or Atom feed, or with Type "torznab" a Torznab indexer.
+// Categories are the indexer's categories to search, e.g. "5030,5040".
 type RSSFeed struct {
 	URL           string `json:"url"`
-	HttpMethod    string `json:http_method"`
+	Type          string `json:"type"`
+	Categories    string `json:"categories"`
+	HttpMethod    string `json:"http_method"`
 	Passkey       string `json:"passkey"`
 	Uid           string `json:"uid"`
 	RssTtl        int    `json:"ttl"`
@@ -42,18 +95,41 @@ type RSSFeed struct {
 	EpisodeRegexp string `json:"episode_regex"`
 }
 
+// Operations.BindAddress is the address the webserver listens on, e.g.
+// 127.0.0.1 to only answer on this machine. Empty is every interface.
+// CORSOrigins are the sites, like https://example.com, whose pages may call
+// the API. PasswordHash is the bcrypt hash of the web password, set with
+// gumshoe-cli password.
+//
+// With TLSCert and TLSKey, or TLSSelfSigned, the webserver uses HTTPS. Relative
+// paths are in the data_dir. RedirectPort is a port that sends plain HTTP on
+// to HTTPS.
 type Operations struct {
-	Email        string          `json:"email"`
-	EnableLog    bool            `json:"enable_logging"`
-	Debug        bool            `json:"log_debug"`
-	EnableWeb    bool            `json:"enable_web"`
-	HttpPort     string          `json:"http_port"`
-	WatchMethods map[string]bool `json:"watch_methods"`
+	Email         string          `json:"email"`
+	EnableLog     bool            `json:"enable_logging"`
+	Debug         bool            `json:"log_debug"`
+	EnableWeb     bool            `json:"enable_web"`
+	HttpPort      string          `json:"http_port"`
+	BindAddress   string          `json:"bind_address"`
+	CORSOrigins   []string        `json:"cors_origins"`
+	PasswordHash  string          `json:"password_hash"`
+	TLSCert       string          `json:"tls_cert"`
+	TLSKey        string          `json:"tls_key"`
+	TLSSelfSigned bool            `json:"tls_self_signed"`
+	RedirectPort  string          `json:"http_redirect_port"`
+	WatchMethods  map[string]bool `json:"watch_methods"`
 }
 
+// Download.Rate is how many torrents a minute may be fetched from one host, 0
+// for no limit, with up to Burst of them at once. Gap is the least seconds
+// between two requests to a host, and each fetch waits a random part of
+// Jitter seconds before it starts.
 type Download struct {
 	Tracker     string `json:"tracker"`
 	Rate        int    `json:"download_rate"`
+	Burst       int    `json:"download_burst"`
+	Gap         int    `json:"request_gap"`
+	Jitter      int    `json:"start_jitter"`
 	MaxRetries  int    `json:"max_retries"`
 	QueueSize   int    `json:"queue_size"`
 	Secure      bool   `json:"is_secure"`
@@ -63,13 +139,35 @@ type Download struct {
 	TorrentPass string `json:"torrent_pass"`
 }
 
+// Metadata picks the TV database shows are looked up in. The only provider so
+// far is "tvmaze". URL is only needed to use a mirror.
+type Metadata struct {
+	Provider string `json:"provider"`
+	URL      string `json:"url"`
+}
+
+// Backlog searches for missing episodes every Interval minutes, 0 turns it
+// off. SearchURL is a feed URL with %query% where the search terms go, e.g.
+// https://tracker/rss?search=%query%. Without it a Torznab feed is searched,
+// or an RSS feed if its URL has %query% in it.
+type Backlog struct {
+	Interval  int    `json:"interval"`
+	SearchURL string `json:"search_url"`
+}
+
 type TrackerConfig struct {
-	Directories  map[string]string `json:"dir_options"`
-	Download     Download          `json:"download_params"`
-	IRC          IRCChannel        `json:"irc_channel"`
-	LastModified int64             `json:"last_modified"`
-	Operations   Operations        `json:"operations"`
-	// RSS          RSSChannel        `json:"rss_channel"`
+	Backlog       Backlog           `json:"backlog"`
+	Directories   map[string]string `json:"dir_options"`
+	Download      Download          `json:"download_params"`
+	IRC           IRCChannels       `json:"irc_channel"`
+	LastModified  int64             `json:"last_modified"`
+	Metadata      Metadata          `json:"metadata"`
+	Notifications []Notifier        `json:"notifications"`
+	Operations    Operations        `json:"operations"`
+	PostProcess   PostProcess       `json:"post_process"`
+	RSS           RSSFeed           `json:"rss_feed"`
+	// Named quality profiles that a show's quality can refer to.
+	QualityProfiles map[string]QualityProfile `json:"quality_profiles"`
 }
 
 type ConfigError struct {
@@ -92,8 +190,17 @@ func NewTrackerConfig() *TrackerConfig {
 	return &TrackerConfig{}
 }
 
+// runningConfig is the config gumshoe is running with. A reload swaps in a
+// whole new one, so code that reads it takes a snapshot with currentConfig
+// and works from that. A config is never changed once it's running.
+var runningConfig atomic.Pointer[TrackerConfig]
+
+func currentConfig() *TrackerConfig {
+	return runningConfig.Load()
+}
+
 func (tcfg *TrackerConfig) SetGlobalTrackerConfig() {
-	tc = tcfg
+	runningConfig.Store(tcfg)
 }
 
 func (tc *TrackerConfig) String() string {
@@ -112,6 +219,8 @@ func (tc *TrackerConfig) CreateDefaultConfig() {
 		EnableLog: false,
 		EnableWeb: true,
 		HttpPort:  "8080",
+		// Only this machine until there's a web password.
+		BindAddress: "127.0.0.1",
 		WatchMethods: map[string]bool{
 			"irc": false,
 			"rss": false,
@@ -164,21 +273,227 @@ func (tc *TrackerConfig) UpdateGumshoeConfig(u []byte) *ConfigError {
 	if err != nil {
 		return NewConfigError(err, "Update is not a valid TrackerConfig JSON")
 	}
-  tc_updated<- true
+	notifyConfigUpdated()
+	return nil
+}
+
+// FieldError is a problem with one setting, named by its path in the config
+// JSON, e.g. irc_channel[0].announce_regex.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+// ValidationErrors collects every FieldError found in a config.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	s := make([]string, len(v))
+	for i, e := range v {
+		s[i] = fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return strings.Join(s, " ")
+}
+
+func (v *ValidationErrors) add(field, format string, a ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+// validPort reports whether p is a port number. Zero lets the system pick.
+func validPort(p int) bool {
+	return p >= 0 && p <= 65535
+}
+
+// Validate catches the mistakes that would otherwise only show up once a
+// watcher or the webserver tries to use the config. The error is always a
+// ValidationErrors.
+func (tc *TrackerConfig) Validate() error {
+	v := ValidationErrors{}
+
+	if p := tc.Operations.HttpPort; p != "" {
+		if n, err := strconv.Atoi(p); err != nil || !validPort(n) {
+			v.add("operations.http_port", "%s is not a valid port.", p)
+		}
+	}
+	tc.validateTLS(&v)
+	if a := tc.Operations.BindAddress; a != "" && !validBindAddress(a) {
+		v.add("operations.bind_address", "%s is not an IP address or host name.", a)
+	}
+	for i, o := range tc.Operations.CORSOrigins {
+		if !validOrigin(o) {
+			v.add(fmt.Sprintf("operations.cors_origins[%d]", i), "%s is not an origin like https://example.com.", o)
+		}
+	}
+
+	// Relative directories are inside the user_dir.
+	dirs := []string{}
+	for k := range tc.Directories {
+		dirs = append(dirs, k)
+	}
+	sort.Strings(dirs)
+	for _, k := range dirs {
+		d := tc.Directories[k]
+		if d == "" {
+			continue
+		}
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(tc.Directories["user_dir"], d)
+		}
+		if fi, err := os.Stat(d); err != nil {
+			v.add("dir_options."+k, "%s does not exist.", d)
+		} else if !fi.IsDir() {
+			v.add("dir_options."+k, "%s is not a directory.", d)
+		}
+	}
+
+	if tc.Download.Rate < 0 {
+		v.add("download_params.download_rate", "Can't be negative.")
+	}
+	if tc.Download.Burst < 0 {
+		v.add("download_params.download_burst", "Can't be negative.")
+	}
+	if tc.Download.Gap < 0 {
+		v.add("download_params.request_gap", "Can't be negative.")
+	}
+	if tc.Download.Jitter < 0 {
+		v.add("download_params.start_jitter", "Can't be negative.")
+	}
+	if tc.Download.MaxRetries < 0 {
+		v.add("download_params.max_retries", "Can't be negative.")
+	}
+	if tc.Download.QueueSize < 0 {
+		v.add("download_params.queue_size", "Can't be negative.")
+	}
+	if tc.Download.TorrentURL != "" {
+		if _, err := url.Parse(tc.Download.TorrentURL); err != nil {
+			v.add("download_params.torrent_url", "%s", err)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, c := range tc.IRC {
+		f := fmt.Sprintf("irc_channel[%d].", i)
+		if names[c.Name] {
+			v.add(f+"name", "There is more than one IRC channel named %s.", c.Name)
+		}
+		names[c.Name] = true
+		if !validPort(c.Port) {
+			v.add(f+"port", "%d is not a valid port.", c.Port)
+		}
+		if _, err := compileEpisodeRegex(c.AnnounceRegexp); err != nil {
+			v.add(f+"announce_regex", "%s", err)
+		}
+		if err := validEpisodeRegex(c.EpisodeRegexp); err != nil {
+			v.add(f+"episode_regex", "%s", err)
+		}
+	}
+
+	switch strings.ToLower(tc.RSS.Type) {
+	case "", feedTypeRSS, feedTypeTorznab:
+	default:
+		v.add("rss_feed.type", "Unknown feed type %s.", tc.RSS.Type)
+	}
+	if tc.Backlog.Interval < 0 {
+		v.add("backlog.interval", "Can't be negative.")
+	}
+	if s := tc.Backlog.SearchURL; s != "" && !strings.Contains(s, searchQueryVar) {
+		v.add("backlog.search_url", "The URL needs %s where the search goes.", searchQueryVar)
+	}
+
+	if err := validEpisodeRegex(tc.RSS.EpisodeRegexp); err != nil {
+		v.add("rss_feed.episode_regex", "%s", err)
+	}
+	if p := strings.ToLower(tc.Metadata.Provider); p != "" && p != "tvmaze" {
+		v.add("metadata.provider", "Unknown provider %s.", tc.Metadata.Provider)
+	}
+	tc.PostProcess.validate(&v)
+	for i, n := range tc.Notifications {
+		n.validate(fmt.Sprintf("notifications[%d].", i), &v)
+	}
+	for n, p := range tc.QualityProfiles {
+		if err := p.Validate(); err != nil {
+			v.add("quality_profiles."+n, "%s", err)
+		}
+	}
+
+	if len(v) > 0 {
+		return v
+	}
 	return nil
 }
 
+// ApplyConfigUpdate returns a copy of the config with the sections in u
+// replaced. u can be a whole config or just the sections being changed, e.g.
+// {"operations": {...}}. The copy is validated before it is returned.
+func (tc *TrackerConfig) ApplyConfigUpdate(u []byte) (*TrackerConfig, ValidationErrors) {
+	sections := map[string]json.RawMessage{}
+	if err := json.Unmarshal(u, &sections); err != nil {
+		return nil, ValidationErrors{{Field: "", Message: fmt.Sprintf("Invalid JSON: %s", err)}}
+	}
+
+	b, err := json.Marshal(tc)
+	if err != nil {
+		return nil, ValidationErrors{{Field: "", Message: err.Error()}}
+	}
+	n := NewTrackerConfig()
+	json.Unmarshal(b, n)
+
+	names := []string{}
+	for s := range sections {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	v := ValidationErrors{}
+	for _, s := range names {
+		if err := n.SetConfigOption(s, sections[s]); err != nil {
+			v.add(s, "%s", err)
+		}
+	}
+	if len(v) > 0 {
+		return nil, v
+	}
+	n.restoreRedacted(tc)
+	if err := n.Validate(); err != nil {
+		return nil, err.(ValidationErrors)
+	}
+	return n, nil
+}
+
+// WriteGumshoeConfig saves the config as f. A relative f is put in the user's
+// data directory. The file is replaced in one step, so the config watcher
+// never sees it half written.
 func (tc *TrackerConfig) WriteGumshoeConfig(f string) *ConfigError {
 	// This is for tests. The normal config file name is as follows.
 	cFile := "config.json"
 	if f != "" {
 		cFile = f
 	}
-	b, err := json.Marshal(tc)
+	if !filepath.IsAbs(cFile) {
+		cFile = CreateLocalPath(tc, cFile)
+	}
+	b, err := json.MarshalIndent(tc, "", "    ")
 	if err != nil {
 		return NewConfigError(err, "Encoding TrackerConfig to JSON")
 	}
-	ioutil.WriteFile(CreateLocalPath(tc, cFile), b, 0655)
+	tmp, err := ioutil.TempFile(filepath.Dir(cFile), "."+filepath.Base(cFile))
+	if err != nil {
+		return NewConfigError(err, "Creating config file")
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// The config can hold tracker and torrent client passwords.
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return NewConfigError(err, "Writing config file")
+	}
 	return nil
 }
 
@@ -192,35 +507,122 @@ func (tc *TrackerConfig) GetConfigOption(o string) ([]byte, error) {
 		return json.Marshal(tc.Download)
 	case o == "irc_channel":
 		return json.Marshal(tc.IRC)
-	//case o == "rss_feed":
-	//  return json.Marshal(tc.RSSFeed)
+	case o == "rss_feed":
+		return json.Marshal(tc.RSS)
+	case o == "quality_profiles":
+		return json.Marshal(tc.QualityProfiles)
+	case o == "metadata":
+		return json.Marshal(tc.Metadata)
+	case o == "backlog":
+		return json.Marshal(tc.Backlog)
+	case o == "notifications":
+		return json.Marshal(tc.Notifications)
+	case o == "post_process":
+		return json.Marshal(tc.PostProcess)
 	default:
 		return nil, errors.New("Unknown Option")
 	}
 }
 
+// SetConfigOption replaces the config section o with the JSON in b.
+func (tc *TrackerConfig) SetConfigOption(o string, b []byte) error {
+	var err error
+	switch o {
+	case "dir_options":
+		d := map[string]string{}
+		if err = json.Unmarshal(b, &d); err == nil {
+			tc.Directories = d
+		}
+	case "operations":
+		ops := Operations{}
+		if err = json.Unmarshal(b, &ops); err == nil {
+			tc.Operations = ops
+		}
+	case "download_params":
+		d := Download{}
+		if err = json.Unmarshal(b, &d); err == nil {
+			tc.Download = d
+		}
+	case "irc_channel":
+		ic := IRCChannels{}
+		if err = json.Unmarshal(b, &ic); err == nil {
+			tc.IRC = ic
+		}
+	case "rss_feed":
+		r := RSSFeed{}
+		if err = json.Unmarshal(b, &r); err == nil {
+			tc.RSS = r
+		}
+	case "quality_profiles":
+		qp := map[string]QualityProfile{}
+		if err = json.Unmarshal(b, &qp); err == nil {
+			tc.QualityProfiles = qp
+		}
+	case "metadata":
+		m := Metadata{}
+		if err = json.Unmarshal(b, &m); err == nil {
+			tc.Metadata = m
+		}
+	case "backlog":
+		bl := Backlog{}
+		if err = json.Unmarshal(b, &bl); err == nil {
+			tc.Backlog = bl
+		}
+	case "notifications":
+		ns := []Notifier{}
+		if err = json.Unmarshal(b, &ns); err == nil {
+			tc.Notifications = ns
+		}
+	case "post_process":
+		pp := PostProcess{}
+		if err = json.Unmarshal(b, &pp); err == nil {
+			tc.PostProcess = pp
+		}
+	case "last_modified":
+		// Set when the config is saved.
+	default:
+		return errors.New("Unknown Option")
+	}
+	return err
+}
+
 type tempCookies struct {
 	Cookies []map[string]string `json:"cookies"`
 }
 
-// TODO(ryan): Learn a bit more about encryption, these files shouldn't just
-// be lying around.
+// The tracker cookies sent with every fetch. A reload builds a new jar and
+// swaps it in whole, so a fetch never sees it empty or half filled.
+var trackerCookies = struct {
+	sync.RWMutex
+	jar []*http.Cookie
+}{}
+
+// SetTrackerCookies loads the cookie jar from the secrets store. Installs
+// without a store keep the cookies in tracker.cj in plain text. Without
+// download.secure there are no cookies.
 func (tc *TrackerConfig) SetTrackerCookies() *ConfigError {
 	if !tc.Download.Secure {
+		useTrackerCookies(nil)
 		return nil
 	}
-	// decrypt file here
-	cjBuf, err := ioutil.ReadFile(CreateLocalPath(tc, "tracker.cj"))
-	if err != nil {
-		return NewConfigError(err, "Cookie File Not Exist")
+	var cjBuf []byte
+	if s, ok := secrets.Get(cookieJarSecret); ok {
+		cjBuf = []byte(s)
+	} else {
+		var err error
+		cjBuf, err = ioutil.ReadFile(CreateLocalPath(tc, "tracker.cj"))
+		if err != nil {
+			return NewConfigError(err, "Cookie File Not Exist")
+		}
 	}
 
 	cookies := &tempCookies{}
-	err = json.Unmarshal(cjBuf, &cookies)
+	err := json.Unmarshal(cjBuf, &cookies)
 	if err != nil {
 		return NewConfigError(err, "Unmarshal cookie JSON")
 	}
 
+	jar := []*http.Cookie{}
 	for _, cookie := range cookies.Cookies {
 		c := &http.Cookie{
 			Name:   cookie["Name"],
@@ -234,13 +636,23 @@ func (tc *TrackerConfig) SetTrackerCookies() *ConfigError {
 		} else {
 			c.Expires = time.Now().AddDate(10, 0, 0)
 		}
-		cj = append(cj, c)
+		jar = append(jar, c)
 	}
+	useTrackerCookies(jar)
 	return nil
 }
 
+// useTrackerCookies replaces the tracker cookies with jar.
+func useTrackerCookies(jar []*http.Cookie) {
+	trackerCookies.Lock()
+	trackerCookies.jar = jar
+	trackerCookies.Unlock()
+}
+
 func GetTrackerCookies() []*http.Cookie {
-	return cj
+	trackerCookies.RLock()
+	defer trackerCookies.RUnlock()
+	return trackerCookies.jar
 }
 
 // An easy utility to generate the fully qualified path name of a given filename
@@ -27,7 +27,8 @@ var tc_test = &TrackerConfig{
 		"user_dir":    pwd,
 		"torrent_dir": filepath.Join(pwd, "test_data"),
 	},
-	IRC: IRCChannel{
+	IRC: IRCChannels{{
+		Name:           "localhost#announce",
 		ChannelOwner:   "BitMeTV",
 		Nick:           "test",
 		Key:            "testkey",
@@ -38,7 +39,7 @@ var tc_test = &TrackerConfig{
 		WatchChannel:   "#announce",
 		AnnounceRegexp: "BitMeTV-IRC2RSS%3A%20(%3FP%3Ctitle%3E.*%3F)%20%3A%20(%3FP%3Curl%3E.*)",
 		EpisodeRegexp:  "%28%5C%5CS%2B%29%5C%5C.%28%3Fi%3As%28%5C%5Cd%7B2%7D%29e%28%5C%5Cd%7B2%7D%29%7C%28%5C%5Cd%7B4%7D.%5C%5Cd%7B2%7D.%5C%5Cd%7B2%7D%29%7C%28%5C%5Cd%29x%3F%28%5C%5Cd%7B2%7D%29%29%5C%5C.%28.%2B%29%3F%5C%5C.%3F%28%3Fi%3A720p%7C1080p%29%3F%5C%5C.%3F%28%3Fi%3Ahdtv%7Cweb.%2B%29%5C%5C..%2B%5C%5C.torrent",
-	},
+	}},
 	Download: Download{
 		Tracker:    "localhost",
 		Rate:       20,
@@ -138,8 +139,25 @@ func TestUpdateGumshoeConfig(t *testing.T) {
 	if !assert.Nil(t, err) {
 		t.Error(err.Error())
 	}
-	assert.Equal(t, tc_test.IRC.ChannelOwner, "test_owner")
-	assert.Equal(t, tc_test.IRC.Key, "testkey")
+	assert.Equal(t, tc_test.IRC[0].ChannelOwner, "test_owner")
+	assert.Equal(t, tc_test.IRC[0].Key, "testkey")
+}
+
+func TestIRCChannelsUnmarshal(t *testing.T) {
+	ic := IRCChannels{}
+	err := json.Unmarshal([]byte(`{"server": "irc.test.com", "watch_channel": "#announce"}`), &ic)
+	assert.Nil(t, err)
+	assert.Len(t, ic, 1)
+	assert.Equal(t, "irc.test.com#announce", ic[0].Name)
+
+	err = json.Unmarshal([]byte(`[{"name": "one", "server": "irc.one.com"}, {"name": "two", "server": "irc.two.com"}]`), &ic)
+	assert.Nil(t, err)
+	assert.Len(t, ic, 2)
+	c, ok := ic.Get("two")
+	assert.True(t, ok)
+	assert.Equal(t, "irc.two.com", c.Server)
+	_, ok = ic.Get("three")
+	assert.False(t, ok)
 }
 
 func TestWriteGumshoeConfig(t *testing.T) {
@@ -147,7 +165,76 @@ func TestWriteGumshoeConfig(t *testing.T) {
 	if !assert.Nil(t, err) {
 		t.Error(err.Error())
 	}
-	os.Remove(filepath.Join(pwd, "test_data", ".config_write_test"))
+	f := filepath.Join(pwd, "test_data", ".config_write_test")
+	fi, serr := os.Stat(f)
+	if assert.NoError(t, serr) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+	os.Remove(f)
+}
+
+func validTestConfig() *TrackerConfig {
+	c := NewTrackerConfig()
+	json.Unmarshal([]byte(tc_test.String()), c)
+	c.Directories = map[string]string{"user_dir": pwd, "data_dir": "test_data"}
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	c := validTestConfig()
+	assert.NoError(t, c.Validate())
+
+	c.Operations.HttpPort = "eighty"
+	c.Directories["log_dir"] = "missing"
+	c.IRC = IRCChannels{{Name: "dup"}, {Name: "dup", Port: 70000, AnnounceRegexp: "(unclosed"}}
+	c.RSS.EpisodeRegexp = `(\S+)\.s(\d{2})`
+	c.QualityProfiles = map[string]QualityProfile{"empty": {}}
+	err := c.Validate()
+	if assert.IsType(t, ValidationErrors{}, err) {
+		fields := []string{}
+		for _, e := range err.(ValidationErrors) {
+			fields = append(fields, e.Field)
+		}
+		assert.Equal(t, []string{
+			"operations.http_port",
+			"dir_options.log_dir",
+			"irc_channel[1].name",
+			"irc_channel[1].port",
+			"irc_channel[1].announce_regex",
+			"rss_feed.episode_regex",
+			"quality_profiles.empty",
+		}, fields)
+	}
+}
+
+func TestApplyConfigUpdate(t *testing.T) {
+	c := validTestConfig()
+
+	n, errs := c.ApplyConfigUpdate([]byte(`{"operations": {"http_port": "9000", "watch_methods": {"rss": true}}}`))
+	assert.Nil(t, errs)
+	assert.Equal(t, "9000", n.Operations.HttpPort)
+	assert.True(t, n.Operations.WatchMethods["rss"])
+	assert.Equal(t, c.IRC, n.IRC)
+	// The original is left alone.
+	assert.Equal(t, "8080", c.Operations.HttpPort)
+
+	whole, _ := json.Marshal(n)
+	n, errs = c.ApplyConfigUpdate(whole)
+	assert.Nil(t, errs)
+	assert.Equal(t, "9000", n.Operations.HttpPort)
+
+	_, errs = c.ApplyConfigUpdate([]byte(`{"irc_channel": [{"name": "x", "episode_regex": "(bad"}], "nope": {}}`))
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "nope", errs[0].Field)
+	}
+
+	_, errs = c.ApplyConfigUpdate([]byte(`{"irc_channel": [{"name": "x", "episode_regex": "(bad"}]}`))
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "irc_channel[0].episode_regex", errs[0].Field)
+	}
+
+	_, errs = c.ApplyConfigUpdate([]byte(`{"operations": `))
+	assert.Len(t, errs, 1)
 }
 
 func TestSetTrackerCookies(t *testing.T) {
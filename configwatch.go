@@ -0,0 +1,284 @@
+/* Config File Watcher
+ *
+ * Polls the config file and the tracker cookie file for changes. An edited
+ * config is validated and compared to the one it replaces, and only the parts
+ * of gumshoe it touches are restarted. An invalid edit is rejected, the old
+ * config stays in use and the error is shown on the status page.
+ *
+ * Tracker cookies that run out, or that the tracker stops taking, are
+ * reported once each as a cookie_expired event.
+ */
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	configPollInterval = 5 * time.Second
+
+	configStatus          = expvar.NewString("config_status")
+	configReloadTimestamp = expvar.NewInt("config_reload_timestamp")
+
+	// The config as it was last read from disk. Changes are found by comparing
+	// against this rather than the running config, so command line overrides
+	// survive a reload until the file changes that same setting.
+	loadedConfig *TrackerConfig
+	// Held while switching to a new config, and by a save through the API
+	// from reading loadedConfig until it's switched, so the two take turns.
+	configLock sync.Mutex
+
+	// How often the tracker cookies are checked for expiry.
+	cookieCheckInterval = time.Hour
+	// Cookie problems already reported since the cookies were last loaded.
+	cookieWarnings = struct {
+		sync.Mutex
+		told map[string]bool
+	}{told: map[string]bool{}}
+)
+
+// configDiff lists what a new config changes.
+type configDiff struct {
+	IRC         []string // names of IRC watchers added, removed or edited
+	IRCEnabled  bool
+	RSS         bool
+	HttpPort    bool
+	BindAddress bool
+	TLS         bool
+	GumshoeDir  bool
+	Cookies     bool
+}
+
+func (d configDiff) Empty() bool {
+	return reflect.DeepEqual(d, configDiff{})
+}
+
+func diffConfig(o, n *TrackerConfig) configDiff {
+	d := configDiff{}
+	for _, c := range n.IRC {
+		if oc, ok := o.IRC.Get(c.Name); !ok || !reflect.DeepEqual(oc, c) {
+			d.IRC = append(d.IRC, c.Name)
+		}
+	}
+	for _, c := range o.IRC {
+		if _, ok := n.IRC.Get(c.Name); !ok {
+			d.IRC = append(d.IRC, c.Name)
+		}
+	}
+	d.IRCEnabled = o.Operations.WatchMethods["irc"] != n.Operations.WatchMethods["irc"]
+	d.RSS = o.Operations.WatchMethods["rss"] != n.Operations.WatchMethods["rss"] ||
+		!reflect.DeepEqual(o.RSS, n.RSS)
+	d.HttpPort = o.Operations.HttpPort != n.Operations.HttpPort
+	d.BindAddress = o.Operations.BindAddress != n.Operations.BindAddress
+	d.TLS = o.Operations.TLSCert != n.Operations.TLSCert || o.Operations.TLSKey != n.Operations.TLSKey ||
+		o.Operations.TLSSelfSigned != n.Operations.TLSSelfSigned || o.Operations.RedirectPort != n.Operations.RedirectPort
+	d.GumshoeDir = o.Directories["gumshoe_dir"] != n.Directories["gumshoe_dir"]
+	d.Cookies = o.Download.Secure != n.Download.Secure ||
+		CreateLocalPath(o, "tracker.cj") != CreateLocalPath(n, "tracker.cj")
+	return d
+}
+
+// readConfigFile parses and validates a config file without touching any of
+// gumshoe's running state.
+func readConfigFile(c string) (*TrackerConfig, error) {
+	b, err := ioutil.ReadFile(c)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file: %s", err)
+	}
+	n := NewTrackerConfig()
+	if err = json.Unmarshal(b, n); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling configs: %s", err)
+	}
+	if err = n.Validate(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ReloadConfig reads the config file c again and applies whatever changed.
+// If the file isn't a valid config the running config is kept.
+func ReloadConfig(c string) error {
+	n, err := readConfigFile(c)
+	if err != nil {
+		configStatus.Set(fmt.Sprintf("Rejected changes to %s: %s", c, err))
+		publishEvent(EventConfigRejected, "", "", "Rejected changes to %s: %s", c, err)
+		return err
+	}
+	configLock.Lock()
+	useConfig(n)
+	configLock.Unlock()
+	configStatus.Set("OK")
+	configReloadTimestamp.Set(time.Now().Unix())
+	publishEvent(EventConfigReloaded, "", "", "Reloaded %s.", c)
+	return nil
+}
+
+// SaveConfig makes change to the config as it was last read from the file,
+// writes the result to the file and makes it the running config. Command
+// line overrides of the running config aren't written out. change gets a
+// config it mustn't modify and returns the new one.
+func SaveConfig(change func(c *TrackerConfig) (*TrackerConfig, error)) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+	if loadedConfig == nil {
+		loadedConfig = currentConfig()
+	}
+	n, err := change(loadedConfig)
+	if err != nil {
+		return err
+	}
+	n.LastModified = time.Now().Unix()
+	if err := n.WriteGumshoeConfig(cfgFile); err != nil {
+		return err
+	}
+	useConfig(n)
+	configStatus.Set("OK")
+	publishEvent(EventConfigReloaded, "", "", "Saved %s.", cfgFile)
+	return nil
+}
+
+// useConfig switches to the config n as read from or written to disk. The
+// caller holds configLock.
+func useConfig(n *TrackerConfig) {
+	tc := currentConfig()
+	if loadedConfig == nil {
+		loadedConfig = tc
+	}
+	d := diffConfig(loadedConfig, n)
+	loadedConfig = n
+
+	// Keep the running values of anything the edit didn't change.
+	running := *n
+	running.Directories = map[string]string{}
+	for k, v := range n.Directories {
+		running.Directories[k] = v
+	}
+	if !d.HttpPort {
+		running.Operations.HttpPort = tc.Operations.HttpPort
+	}
+	if !d.GumshoeDir {
+		running.Directories["gumshoe_dir"] = tc.Directories["gumshoe_dir"]
+	}
+	applyConfig(&running, d)
+}
+
+// applyConfig makes n the running config and restarts the parts of gumshoe
+// that d says have changed.
+func applyConfig(n *TrackerConfig, d configDiff) {
+	oldListen := httpListenConfig(currentConfig())
+	n.SetGlobalTrackerConfig()
+	notifyConfigUpdated()
+
+	if d.Cookies {
+		if err := reloadCookies(); err != nil {
+			log.Printf("[ERROR] Reloading tracker cookies: %s\n", err)
+		}
+	}
+	// Watchers that aren't started yet read the new config when they are.
+	if ircRunning.Load() {
+		if d.IRCEnabled {
+			IRCEnabled <- IRCControl{Enabled: n.Operations.WatchMethods["irc"]}
+		} else {
+			for _, name := range d.IRC {
+				IRCConfigChanged <- name
+			}
+		}
+	}
+	if d.RSS && rssRunning.Load() {
+		RSSEnabled <- false
+		RSSEnabled <- n.Operations.WatchMethods["rss"]
+	}
+	if l := httpListenConfig(n); (d.HttpPort || d.BindAddress || d.TLS) && l != oldListen {
+		httpRebind <- l
+	}
+}
+
+// reloadCookies replaces the tracker cookies, keeping the old ones if the
+// cookie file can't be read.
+func reloadCookies() error {
+	if err := currentConfig().SetTrackerCookies(); err != nil {
+		return err
+	}
+	cookieWarnings.Lock()
+	cookieWarnings.told = map[string]bool{}
+	cookieWarnings.Unlock()
+	return nil
+}
+
+// warnCookies publishes a cookie_expired event, unless one for key was already
+// published since the cookies were loaded.
+func warnCookies(key, format string, a ...interface{}) {
+	cookieWarnings.Lock()
+	told := cookieWarnings.told[key]
+	cookieWarnings.told[key] = true
+	cookieWarnings.Unlock()
+	if !told {
+		log.Printf("[WARNING] "+format+"\n", a...)
+		publishEvent(EventCookieExpired, "", "", format, a...)
+	}
+}
+
+// checkCookieExpiry warns about every tracker cookie that expired before now.
+func checkCookieExpiry(now time.Time) {
+	if !currentConfig().Download.Secure {
+		return
+	}
+	for _, c := range GetTrackerCookies() {
+		if !c.Expires.IsZero() && c.Expires.Before(now) {
+			warnCookies("expired:"+c.Name, "The tracker cookie %s expired on %s.", c.Name, c.Expires.Format("2006-01-02 15:04"))
+		}
+	}
+}
+
+// WatchCookieExpiry checks the tracker cookies every cookieCheckInterval.
+func WatchCookieExpiry() {
+	for {
+		checkCookieExpiry(time.Now())
+		time.Sleep(cookieCheckInterval)
+	}
+}
+
+func modTime(f string) time.Time {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// WatchConfigFile polls the config file c and the tracker cookie file, and
+// reloads whichever one has been modified.
+func WatchConfigFile(c string) {
+	configStatus.Set("OK")
+	cfgMod := modTime(c)
+	cjFile := CreateLocalPath(currentConfig(), "tracker.cj")
+	cjMod := modTime(cjFile)
+	for range time.Tick(configPollInterval) {
+		if m := modTime(c); !m.Equal(cfgMod) {
+			cfgMod = m
+			log.Printf("Config file %s changed, reloading.\n", c)
+			if err := ReloadConfig(c); err != nil {
+				log.Printf("[ERROR] Keeping the current config: %s\n", err)
+			}
+		}
+		if f := CreateLocalPath(currentConfig(), "tracker.cj"); f != cjFile {
+			// The new config already reloaded the cookies from here.
+			cjFile = f
+			cjMod = modTime(f)
+		} else if m := modTime(f); !m.Equal(cjMod) {
+			cjMod = m
+			PrintDebugln("Tracker cookie file changed, reloading.")
+			if err := reloadCookies(); err != nil {
+				log.Printf("[ERROR] Reloading tracker cookies: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func copyConfig(t *testing.T, c *TrackerConfig) *TrackerConfig {
+	b, err := json.Marshal(c)
+	assert.NoError(t, err)
+	n := NewTrackerConfig()
+	assert.NoError(t, json.Unmarshal(b, n))
+	return n
+}
+
+// useTestConfig runs the rest of the test with a copy of the running config
+// that edit has changed, and puts the old one back at the end.
+func useTestConfig(t *testing.T, edit func(c *TrackerConfig)) *TrackerConfig {
+	old := currentConfig()
+	n := copyConfig(t, old)
+	edit(n)
+	n.SetGlobalTrackerConfig()
+	t.Cleanup(old.SetGlobalTrackerConfig)
+	return n
+}
+
+func TestDiffConfig(t *testing.T) {
+	o := &TrackerConfig{
+		Directories: map[string]string{"user_dir": pwd, "data_dir": "test_data"},
+		IRC:         IRCChannels{{Name: "one", Server: "localhost"}, {Name: "two", Server: "localhost"}},
+		Operations:  Operations{HttpPort: "8080", WatchMethods: map[string]bool{"irc": true}},
+	}
+	assert.True(t, diffConfig(o, copyConfig(t, o)).Empty())
+
+	n := copyConfig(t, o)
+	n.IRC = IRCChannels{{Name: "one", Server: "example.com"}, {Name: "three"}}
+	n.Operations.HttpPort = "8081"
+	n.Operations.WatchMethods["rss"] = true
+	d := diffConfig(o, n)
+	sort.Strings(d.IRC)
+	assert.Equal(t, []string{"one", "three", "two"}, d.IRC)
+	assert.False(t, d.IRCEnabled)
+	assert.True(t, d.RSS)
+	assert.True(t, d.HttpPort)
+	assert.False(t, d.Cookies)
+
+	n = copyConfig(t, o)
+	n.Download.Secure = true
+	n.Operations.WatchMethods["irc"] = false
+	d = diffConfig(o, n)
+	assert.True(t, d.Cookies)
+	assert.True(t, d.IRCEnabled)
+	assert.Empty(t, d.IRC)
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pattern, client, provider := episodePattern, torrentClient, metadataProvider
+	defer func() {
+		loadedConfig = nil
+		episodePattern, torrentClient, metadataProvider = pattern, client, provider
+	}()
+	loadedConfig = nil
+	tc := useTestConfig(t, func(c *TrackerConfig) {
+		c.Directories = map[string]string{"user_dir": pwd, "data_dir": "test_data"}
+		c.Operations.HttpPort = "9999" // as if set with -p
+	})
+
+	f := filepath.Join(dir, "gumshoe.cfg")
+	n := copyConfig(t, tc)
+	n.Download.Tracker = "example.com"
+	// The watchers aren't running, so there's nobody to tell about these.
+	n.RSS.URL = "http://example.com/rss"
+	n.IRC = append(n.IRC, IRCChannel{Name: "reload"})
+	b, _ := json.Marshal(n)
+	assert.NoError(t, ioutil.WriteFile(f, b, 0600))
+
+	// The port is the same as the running config, so nothing is restarted.
+	assert.NoError(t, ReloadConfig(f))
+	assert.Equal(t, "example.com", currentConfig().Download.Tracker)
+	assert.Equal(t, "9999", currentConfig().Operations.HttpPort)
+	assert.Equal(t, "OK", configStatus.Value())
+	// What UpdateAllComponents does with it, here rather than in the background.
+	updateComponents()
+
+	running := currentConfig()
+	assert.NoError(t, ioutil.WriteFile(f, []byte(`{"operations": {"http_port": "99999"}}`), 0600))
+	assert.Error(t, ReloadConfig(f))
+	assert.True(t, running == currentConfig())
+	assert.Contains(t, configStatus.Value(), "not a valid port")
+
+	assert.NoError(t, ioutil.WriteFile(f, []byte(`{"operations": `), 0600))
+	assert.Error(t, ReloadConfig(f))
+	assert.True(t, running == currentConfig())
+}
+
+func TestSaveConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldFile := cfgFile
+	defer func() {
+		cfgFile = oldFile
+		loadedConfig = nil
+	}()
+	cfgFile = filepath.Join(dir, "gumshoe.cfg")
+	loadedConfig = copyConfig(t, currentConfig())
+	loadedConfig.Directories = map[string]string{"user_dir": pwd, "data_dir": "test_data"}
+	loadedConfig.Operations.HttpPort = "8080"
+	useTestConfig(t, func(c *TrackerConfig) {
+		c.Directories = loadedConfig.Directories
+		c.Operations.HttpPort = "9999" // as if set with -p
+	})
+
+	assert.NoError(t, SaveConfig(func(c *TrackerConfig) (*TrackerConfig, error) {
+		n, verr := c.ApplyConfigUpdate([]byte(`{"download_params": {"tracker": "example.com"}}`))
+		if verr != nil {
+			return nil, verr
+		}
+		return n, nil
+	}))
+	assert.Equal(t, "example.com", currentConfig().Download.Tracker)
+	assert.Equal(t, "9999", currentConfig().Operations.HttpPort)
+
+	// The override stays out of the file.
+	saved, err := readConfigFile(cfgFile)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "example.com", saved.Download.Tracker)
+		assert.Equal(t, "8080", saved.Operations.HttpPort)
+	}
+}
+
+func TestCookieExpiry(t *testing.T) {
+	oldCookies := GetTrackerCookies()
+	defer useTrackerCookies(oldCookies)
+	now := time.Now()
+	useTestConfig(t, func(c *TrackerConfig) { c.Download.Secure = true })
+	cookieWarnings.told = map[string]bool{}
+	useTrackerCookies([]*http.Cookie{
+		{Name: "uid", Value: "1", Expires: now.AddDate(1, 0, 0)},
+		{Name: "pass", Value: "2", Expires: now.Add(-time.Hour)},
+	})
+
+	_, ch, cancel := events.Subscribe(events.LastID())
+	defer cancel()
+	checkCookieExpiry(now)
+	checkCookieExpiry(now)
+	e := <-ch
+	assert.Equal(t, EventCookieExpired, e.Type)
+	assert.Contains(t, e.Message, "pass expired")
+	assert.Len(t, ch, 0)
+
+	// A year on both have run out, but pass was already reported.
+	checkCookieExpiry(now.AddDate(1, 0, 1))
+	e = <-ch
+	assert.Contains(t, e.Message, "uid expired")
+	assert.Len(t, ch, 0)
+}
@@ -3,13 +3,16 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/coopernurse/gorp"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func InitDb() error {
+	tc := currentConfig()
 	dbPath := filepath.Join(tc.Directories["user_dir"], tc.Directories["data_dir"], "gumshoe.db")
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
@@ -28,9 +31,104 @@ func InitDb() error {
 		PrintDebugf("Table episode failed to init: %s\n", err)
 	}
 
+	err = initTable(gDb, QueueItem{}, "queue")
+	if err != nil {
+		PrintDebugf("Table queue failed to init: %s\n", err)
+	}
+
+	err = initTable(gDb, ShowAlias{}, "show_alias")
+	if err != nil {
+		PrintDebugf("Table show_alias failed to init: %s\n", err)
+	}
+
+	err = initTable(gDb, MatchReview{}, "match_review")
+	if err != nil {
+		PrintDebugf("Table match_review failed to init: %s\n", err)
+	}
+
+	err = initTable(gDb, ReleaseRecord{}, "release")
+	if err != nil {
+		PrintDebugf("Table release failed to init: %s\n", err)
+	}
+
+	err = initTable(gDb, APIToken{}, "api_token")
+	if err != nil {
+		PrintDebugf("Table api_token failed to init: %s\n", err)
+	}
+
+	err = migrateTables(gDb)
+	if err != nil {
+		PrintDebugf("Table migration failed: %s\n", err)
+	}
+
 	return err
 }
 
+// Columns added to tables after they were first created. CreateTablesIfNotExists
+// leaves existing tables alone, so databases from older versions get them here.
+var tableMigrations = []struct {
+	table, column, def string
+}{
+	{"episode", "Quality", "varchar(255) not null default ''"},
+	{"queue", "Quality", "varchar(255) not null default ''"},
+	{"show", "MetadataID", "integer not null default 0"},
+	{"show", "CanonicalTitle", "varchar(255) not null default ''"},
+	// Everything in the episode table used to be a downloaded episode.
+	{"episode", "State", "varchar(255) not null default 'downloaded'"},
+	{"show", "StartSeason", "integer not null default 0"},
+	{"show", "StartEpisode", "integer not null default 0"},
+	{"show", "SkipWeekends", "integer not null default 0"},
+	{"show", "SkipReruns", "integer not null default 0"},
+	{"show", "MaxAge", "integer not null default 0"},
+	{"episode", "Title", "varchar(255) not null default ''"},
+	{"episode", "ReleaseID", "integer not null default 0"},
+	{"queue", "Episodes", "varchar(255) not null default ''"},
+	{"queue", "SeasonPack", "integer not null default 0"},
+	{"show", "SeasonPacks", "integer not null default 0"},
+	{"show", "PackThreshold", "integer not null default 0"},
+	{"queue", "Watcher", "varchar(255) not null default ''"},
+	{"episode", "File", "varchar(1024) not null default ''"},
+	{"episode", "Path", "varchar(1024) not null default ''"},
+	{"episode", "PostState", "varchar(255) not null default ''"},
+	{"episode", "PostError", "varchar(1024) not null default ''"},
+	{"episode", "Searched", "integer not null default 0"},
+}
+
+func migrateTables(dbmap *gorp.DbMap) error {
+	for _, m := range tableMigrations {
+		_, err := dbmap.Exec(fmt.Sprintf("alter table %s add column %s %s", m.table, m.column, m.def))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return err
+		}
+	}
+	return migrateAirDates(dbmap)
+}
+
+// migrateAirDates rewrites air dates stored the way release names wrote them,
+// before AirDate, as 2006.01.02 so they compare in SQL. Dates in that form
+// already are skipped, so there is nothing to do after the first run. Ones
+// that don't parse are left as they are.
+func migrateAirDates(dbmap *gorp.DbMap) error {
+	for _, table := range []string{"episode", "queue"} {
+		dates := []string{}
+		_, err := dbmap.Select(&dates, fmt.Sprintf("select distinct AirDate from %s where AirDate!='' and "+
+			"AirDate not glob '[0-9][0-9][0-9][0-9].[0-9][0-9].[0-9][0-9]'", table))
+		if err != nil {
+			return err
+		}
+		for _, s := range dates {
+			d, err := ParseAirDate(s)
+			if err != nil || d.IsZero() {
+				continue
+			}
+			if _, err = dbmap.Exec(fmt.Sprintf("update %s set AirDate=? where AirDate=?", table), d.String(), s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func initTable(dbmap *gorp.DbMap, i interface{}, tableName string) error {
 	dbmap.AddTableWithName(i, tableName).SetKeys(true, "ID")
 	return dbmap.CreateTablesIfNotExists()
@@ -0,0 +1,137 @@
+/* Release Dry Run
+ *
+ * Walks an announce line or release name through the same steps as the
+ * watchers and reports what happened at each one. Nothing is fetched and
+ * nothing is written to the database.
+ */
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// ReleaseTrace is the result of a dry run. Reason explains the first step
+// that rejected the release, and is empty when it would be fetched. Groups is
+// only set when an episode regex overrides the built-in parser.
+type ReleaseTrace struct {
+	Input         string            `json:"input"`
+	Watcher       string            `json:"watcher,omitempty"`
+	AnnounceRegex string            `json:"announce_regex,omitempty"`
+	Release       string            `json:"release"`
+	Link          string            `json:"link,omitempty"`
+	EpisodeRegex  string            `json:"episode_regex"`
+	Groups        map[string]string `json:"groups,omitempty"`
+	Parsed        *Release          `json:"parsed,omitempty"`
+	ShowTitle     string            `json:"show_title,omitempty"`
+	Show          *Show             `json:"show,omitempty"`
+	Episode       *Episode          `json:"episode,omitempty"`
+	Episodes      []*Episode        `json:"episodes,omitempty"`
+	QualityOK     bool              `json:"quality_ok"`
+	Upgrade       bool              `json:"upgrade"`
+	IsNew         bool              `json:"is_new"`
+	Queued        bool              `json:"already_queued"`
+	WouldFetch    bool              `json:"would_fetch"`
+	SaveLocation  string            `json:"save_location,omitempty"`
+	Reason        string            `json:"reason,omitempty"`
+}
+
+type releaseTest struct {
+	Input string `json:"input" binding:"required"`
+}
+
+// matchAnnounceLine finds the first IRC watcher whose announce regex matches
+// the input. It returns the watcher config and the regex match.
+func matchAnnounceLine(s string) (IRCChannel, []string) {
+	for _, c := range currentConfig().IRC {
+		ar, err := url.QueryUnescape(c.AnnounceRegexp)
+		if err != nil || ar == "" {
+			continue
+		}
+		re, err := regexp.Compile(ar)
+		if err != nil {
+			continue
+		}
+		if m := re.FindStringSubmatch(s); len(m) > 2 {
+			return c, m
+		}
+	}
+	return IRCChannel{}, nil
+}
+
+// TraceRelease runs s through the matching pipeline without side effects.
+// s can be a full announce line or a bare release name. A bare name is read
+// with the built-in parser, like backlog results are.
+func TraceRelease(s string) *ReleaseTrace {
+	t := &ReleaseTrace{Input: s, Release: s}
+	var p *regexp.Regexp
+
+	if c, m := matchAnnounceLine(s); m != nil {
+		t.Watcher = c.Name
+		t.AnnounceRegex, _ = url.QueryUnescape(c.AnnounceRegexp)
+		t.Release = m[1]
+		t.Link = m[2]
+		if c.EpisodeRegexp != "" {
+			if wp, err := compileEpisodeRegex(c.EpisodeRegexp); err == nil {
+				p = wp
+			}
+		}
+	}
+	if p != nil {
+		t.EpisodeRegex = p.String()
+	}
+
+	rel, groups, err := parseReleaseWith(p, t.Release)
+	if err != nil {
+		t.Reason = fmt.Sprintf("Release parser: %s", err)
+		return t
+	}
+	t.Groups = groups
+	t.Parsed = rel
+
+	t.ShowTitle = episodeRewriter(rel.Show)
+	show, err := GetShowByTitle(t.ShowTitle)
+	if am, ok := err.(*AmbiguousMatchError); ok {
+		t.Reason = fmt.Sprintf("Not sure which show this is, it would be added to the review list. %s", am)
+		return t
+	} else if err != nil {
+		t.Reason = fmt.Sprintf("Show %s is not being tracked.", t.ShowTitle)
+		return t
+	}
+	t.Show = &show
+	eps, err := episodesFromRelease(show, rel)
+	if err != nil {
+		t.Reason = err.Error()
+		return t
+	}
+	t.Episodes = eps
+	if len(eps) > 0 {
+		t.Episode = eps[0]
+	}
+
+	t.QualityOK = show.AllowsQuality(t.Release)
+	for _, e := range eps {
+		t.IsNew = t.IsNew || e.IsNewEpisode()
+		t.Queued = t.Queued || e.IsEpisodeQueued()
+	}
+	want, reason := wantedEpisodes(show, rel, eps)
+	for _, e := range want {
+		t.Upgrade = t.Upgrade || e.IsUpgrade()
+	}
+	switch {
+	case reason != "":
+		t.Reason = reason
+	case !t.QualityOK:
+		t.Reason = fmt.Sprintf("Episode isn't the right quality, want %s.", show.Quality)
+	default:
+		t.WouldFetch = true
+	}
+
+	if t.Link != "" {
+		if ff, err := NewFileFetch(t.Link, t.Release); err == nil {
+			t.SaveLocation = ff.SaveLocation
+		}
+	}
+	return t
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceRelease(t *testing.T) {
+	useTestConfig(t, func(c *TrackerConfig) {
+		c.IRC = IRCChannels{{
+			Name:           "test",
+			AnnounceRegexp: "BitMeTV-IRC2RSS%3A%20(%3FP%3Ctitle%3E.*%3F)%20%3A%20(%3FP%3Curl%3E.*)",
+			EpisodeRegexp:  url.QueryEscape(`(?P<show>.+?)\.Series\.(?P<season>\d+)\.Episode\.(?P<episode>\d+)`),
+		}}
+	})
+
+	tr := TraceRelease("BitMeTV-IRC2RSS: not.a.real.episode : http://localhost/download.php/1/not.a.real.episode.torrent")
+	assert.Equal(t, "test", tr.Watcher)
+	assert.Equal(t, "not.a.real.episode", tr.Release)
+	assert.Equal(t, "http://localhost/download.php/1/not.a.real.episode.torrent", tr.Link)
+	assert.False(t, tr.WouldFetch)
+	assert.Contains(t, tr.Reason, "episode regex didn't match")
+
+	// The watcher's episode regex goes first.
+	tr = TraceRelease("BitMeTV-IRC2RSS: untracked.show.Series.1.Episode.2.720p.HDTV.x264 : http://localhost/1.torrent")
+	assert.Equal(t, "test", tr.Watcher)
+	assert.NotEmpty(t, tr.EpisodeRegex)
+	assert.Equal(t, "1", tr.Groups["season"])
+	assert.Equal(t, "2", tr.Groups["episode"])
+	assert.Equal(t, "Untracked Show", tr.ShowTitle)
+	assert.Nil(t, tr.Show)
+	assert.False(t, tr.WouldFetch)
+	assert.Contains(t, tr.Reason, "not being tracked")
+
+	// The built-in parser reads what it doesn't match.
+	tr = TraceRelease("BitMeTV-IRC2RSS: untracked.show.S01E02.720p.HDTV.x264-GRP : http://localhost/2.torrent")
+	assert.Nil(t, tr.Groups)
+	assert.Equal(t, "Untracked Show", tr.ShowTitle)
+
+	// A bare release name has no watcher, so the built-in parser is used.
+	tr = TraceRelease("untracked.show.S01E02.720p.HDTV.x264-GRP")
+	assert.Empty(t, tr.Watcher)
+	assert.Empty(t, tr.EpisodeRegex)
+	assert.Nil(t, tr.Groups)
+	assert.Equal(t, "720p", tr.Parsed.Resolution)
+	assert.Equal(t, "Untracked Show", tr.ShowTitle)
+	assert.Contains(t, tr.Reason, "not being tracked")
+}
@@ -15,38 +15,94 @@ import (
 	"time"
 )
 
+// Episode states. Wanted episodes come from the metadata provider or the
+// show's start point and haven't been fetched yet. Snatched episodes have been
+// handed to the torrent client. Skipped episodes are never fetched.
+const (
+	EpisodeWanted     = "wanted"
+	EpisodeSnatched   = "snatched"
+	EpisodeDownloaded = "downloaded"
+	EpisodeSkipped    = "skipped"
+)
+
+func validEpisodeState(s string) bool {
+	switch s {
+	case EpisodeWanted, EpisodeSnatched, EpisodeDownloaded, EpisodeSkipped:
+		return true
+	}
+	return false
+}
+
 type Episode struct {
-	ID      int64  `json:"id"`
-	ShowID  int64  `json:"show_id" binding:"required"`
-	Season  int    `json:"season"`
-	Episode int    `json:"episode"`
-	AirDate string `json:"airdate"`
-	Added   int64  `json:"added"`
+	ID      int64   `json:"id"`
+	ShowID  int64   `json:"show_id" binding:"required"`
+	Season  int     `json:"season"`
+	Episode int     `json:"episode"`
+	AirDate AirDate `json:"airdate"`
+	Title   string  `json:"title"`
+	Quality string  `json:"quality"`
+	State   string  `json:"state"`
+	Added   int64   `json:"added"`
+	// The release the episode was last fetched in, 0 when it wasn't.
+	ReleaseID int64 `json:"release_id"`
+	// Post-processing: the downloaded file, where it was put in the library,
+	// how far that got and what went wrong.
+	File      string `json:"file,omitempty"`
+	Path      string `json:"path,omitempty"`
+	PostState string `json:"post_state,omitempty"`
+	PostError string `json:"post_error,omitempty"`
+	// When the backlog last searched for the episode, in ns.
+	Searched int64 `json:"searched,omitempty"`
+	// The release was tagged as a rerun. Not stored.
+	Rerun bool `json:"rerun,omitempty" db:"-"`
 }
 
-func newEpisode(sid int64, s, e int) *Episode {
+func newEpisode(sid int64, t string, s, e int) *Episode {
 	return &Episode{
 		ShowID:  sid,
 		Season:  s,
 		Episode: e,
+		Title:   t,
 		Added:   time.Now().UnixNano(),
 	}
 }
 
+// newDaily makes the episode of a daily show that aired on d. A d that isn't
+// a date leaves the air date empty.
 func newDaily(sid int64, t, d string) *Episode {
+	ad, _ := ParseAirDate(d)
 	return &Episode{
 		ShowID:  sid,
-		AirDate: d,
+		AirDate: ad,
+		Title:   t,
 		Added:   time.Now().UnixNano(),
 	}
 }
 
+// IsDaily reports whether the episode is known by its air date alone.
+func (e *Episode) IsDaily() bool {
+	return e.Season == 0 && e.Episode == 0 && !e.AirDate.IsZero()
+}
+
+func (e *Episode) String() string {
+	if e.IsDaily() {
+		return e.AirDate.String()
+	}
+	return fmt.Sprintf("S%02dE%02d", e.Season, e.Episode)
+}
+
 // Start User Functions
 func (e *Episode) AddEpisode() (err error) {
 	e.Added = time.Now().UnixNano()
+	if e.State == "" {
+		e.State = EpisodeDownloaded
+	}
   checkDBLock<- 1
   err = gDb.Insert(e)
   <-checkDBLock
+  if err != nil {
+    return err
+  }
   show, err := GetShow(e.ShowID)
   if err == nil {
     show.LastUpdate = e.Added
@@ -55,60 +111,242 @@ func (e *Episode) AddEpisode() (err error) {
 	return err
 }
 
-func (e *Episode) IsNewEpisode() bool {
+// findExisting returns the episode row we already have for e. Daily episodes
+// are found by air date, everything else by season and episode.
+func (e *Episode) findExisting() (*Episode, error) {
+	have := &Episode{}
+	var err error
   checkDBLock<- 1
-	err := gDb.SelectOne(&Episode{}, "select ID from episode where ShowID=? and Season=? and Episode=? and AirDate=?",
-		e.ShowID, e.Season, e.Episode, e.AirDate)
+	if e.IsDaily() {
+		err = gDb.SelectOne(have, "select * from episode where ShowID=? and AirDate=? order by Season, Episode limit 1",
+			e.ShowID, e.AirDate)
+	} else {
+		err = gDb.SelectOne(have, "select * from episode where ShowID=? and Season=? and Episode=?",
+			e.ShowID, e.Season, e.Episode)
+	}
   <-checkDBLock
-	if err == nil {
+	if err != nil {
+		return nil, err
+	}
+	return have, nil
+}
+
+// IsNewEpisode reports whether e is worth fetching: either we don't have the
+// episode yet, or e.Quality is an upgrade under the show's quality profile.
+// Skipped episodes and episodes the show's settings skip never are.
+func (e *Episode) IsNewEpisode() bool {
+	if show, err := GetShow(e.ShowID); err == nil && show.Skips(e) != "" {
+		return false
+	}
+	have, err := e.findExisting()
+	if err != nil || have.State == EpisodeWanted {
+		return true
+	}
+	if have.State == EpisodeSkipped {
+		return false
+	}
+	return e.isUpgradeOf(have)
+}
+
+// IsUpgrade reports whether e replaces an episode we already have.
+func (e *Episode) IsUpgrade() bool {
+	have, err := e.findExisting()
+	return err == nil && have.State != EpisodeWanted && have.State != EpisodeSkipped && e.isUpgradeOf(have)
+}
+
+func (e *Episode) isUpgradeOf(have *Episode) bool {
+	// Episodes fetched before qualities were recorded are never upgraded.
+	if e.Quality == "" || have.Quality == "" {
+		return false
+	}
+	show, err := GetShow(e.ShowID)
+	if err != nil {
 		return false
 	}
-	return true
+	return QualityProfileFor(show.Quality).IsUpgrade(ParseQuality(have.Quality), ParseQuality(e.Quality))
 }
 
+// RecordEpisode stores a fetched episode in e.State, downloaded when it isn't
+// set. An upgrade replaces the quality of the row we already have instead of
+// adding a second one.
+func (e *Episode) RecordEpisode() error {
+	have, err := e.findExisting()
+	if err != nil {
+		return e.AddEpisode()
+	}
+	have.Quality = e.Quality
+	if have.Title == "" {
+		have.Title = e.Title
+	}
+	have.State = e.State
+	if have.State == "" {
+		have.State = EpisodeDownloaded
+	}
+	if e.ReleaseID != 0 {
+		have.ReleaseID = e.ReleaseID
+	}
+	have.Added = time.Now().UnixNano()
+  checkDBLock<- 1
+	_, err = gDb.Update(have)
+  <-checkDBLock
+	*e = *have
+	return err
+}
+
+// ValidEpisodeQuality checks the quality of the release name s against the
+// show's quality profile.
 func (e *Episode) ValidEpisodeQuality(s string) bool {
-	isHDTV := episodeQualityRegexp.MatchString(s)
 	show, _ := GetShow(e.ShowID)
-	if show.Quality == "420" || show.Quality == "" {
-		return !isHDTV
-	} else {
-		return show.Quality == episodeQualityRegexp.FindString(s)
-	}
+	return show.AllowsQuality(s)
 }
 
 func GetEpisodesByShowID(id int64) (allE *[]Episode, err error) {
+  allE = &[]Episode{}
   checkDBLock<- 1
 	_, err = gDb.Select(allE, "select * from episode where ShowID=?", id)
   <-checkDBLock
 	return
 }
 
+// GetLastEpisode is the latest episode of the show that has been fetched.
 func GetLastEpisode(sid int64) (le *Episode, err error) {
+  le = &Episode{}
   checkDBLock<- 1
-  err = gDb.SelectOne(le, "select * from episode where ShowID=? sort by AirDate, Season, Episode desc limit 1", sid)
+  err = gDb.SelectOne(le, "select * from episode where ShowID=? and State in (?, ?) order by Season desc, Episode desc, AirDate desc limit 1",
+    sid, EpisodeSnatched, EpisodeDownloaded)
   <-checkDBLock
   return
 }
 
-func ParseTorrentString(e string) (episode *Episode, err error) {
-	eMatch, err := matchEpisodeToPattern(e)
+// GetSeasonEpisodes lists the episodes of a season we know about, fetched
+// or not.
+func GetSeasonEpisodes(sid int64, season int) ([]Episode, error) {
+	eps := []Episode{}
+	checkDBLock <- 1
+	_, err := gDb.Select(&eps, "select * from episode where ShowID=? and Season=? and Episode>0 order by Episode", sid, season)
+	<-checkDBLock
+	return eps, err
+}
+
+// MissingEpisodes lists the wanted episodes of a show that have aired.
+// Episodes without an air date are assumed to have aired.
+func MissingEpisodes(sid int64) ([]Episode, error) {
+	eps := []Episode{}
+	checkDBLock <- 1
+	_, err := gDb.Select(&eps, "select * from episode where ShowID=? and State=? and AirDate<=? order by Season, Episode, AirDate",
+		sid, EpisodeWanted, Today())
+	<-checkDBLock
+	return eps, err
+}
+
+// SetEpisodeSearched records when the backlog last searched for an episode.
+func SetEpisodeSearched(id, when int64) error {
+	checkDBLock <- 1
+	_, err := gDb.Exec("update episode set Searched=? where ID=?", when, id)
+	<-checkDBLock
+	return err
+}
+
+// SetEpisodeState changes the state of an episode, e.g. to skip one that
+// isn't worth fetching.
+func SetEpisodeState(id int64, state string) error {
+	if !validEpisodeState(state) {
+		return fmt.Errorf("%s is not an episode state.", state)
+	}
+	checkDBLock <- 1
+	defer func() { <-checkDBLock }()
+	res, err := gDb.Exec("update episode set State=? where ID=?", state, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Episode doesn't exist.")
+	}
+	return nil
+}
+
+// ParseTorrentString returns every episode a release covers.
+func ParseTorrentString(e string) ([]*Episode, error) {
+	return ParseTorrentStringWith(episodePattern, e)
+}
+
+// ParseTorrentStringWith parses a release name with a watcher's own episode
+// regex. A nil pattern uses the built-in release parser.
+func ParseTorrentStringWith(p *regexp.Regexp, e string) ([]*Episode, error) {
+	rel, show, err := matchRelease(p, e)
 	if err != nil {
-		return
+		return nil, err
 	}
-	sid, err := GetShowByTitle(episodeRewriter(eMatch["show"]))
+	return episodesFromRelease(show, rel)
+}
+
+// matchRelease parses a release name with the episode regex p, or the
+// built-in release parser when p is nil, and finds the show it belongs to.
+func matchRelease(p *regexp.Regexp, e string) (*Release, Show, error) {
+	rel, _, err := parseReleaseWith(p, e)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Show %s is not being tracked.", episodeRewriter(eMatch["show"])))
+		return nil, Show{}, err
+	}
+	show, err := GetShowByTitle(episodeRewriter(rel.Show))
+	if _, ok := err.(*AmbiguousMatchError); ok {
+		return nil, Show{}, err
+	} else if err != nil {
+		return nil, Show{}, errors.New(fmt.Sprintf("Show %s is not being tracked.", episodeRewriter(rel.Show)))
 	}
-	episode.ShowID = sid.ID
+	return rel, show, nil
+}
 
-	episode.Season = GetInt(eMatch["season"])
-	episode.Episode = GetInt(eMatch["episode"])
-  episode.AirDate = eMatch["airdate"]
-  if eMatch["enum"] != "" {
-    episode.Season = GetInt(string(eMatch["enum"][0]))
-    episode.Episode = GetInt(string(eMatch["enum"][1:]))
-  }
-	return
+// episodeFromRelease builds the episode row for the first episode a release
+// covers. Daily shows are kept by air date alone, whatever numbering the
+// release has.
+func episodeFromRelease(s Show, rel *Release) *Episode {
+	e := &Episode{
+		ShowID:  s.ID,
+		Season:  rel.Season,
+		Episode: rel.Episode(),
+		AirDate: rel.AirDate,
+		Title:   rel.EpisodeTitle,
+		Quality: qualityOfRelease(rel).String(),
+		Rerun:   rel.Rerun,
+	}
+	if !s.Episodal && !e.AirDate.IsZero() {
+		e.Season, e.Episode = 0, 0
+	}
+	return e
+}
+
+// episodesFromRelease builds an episode row for every episode a release
+// covers. A season pack covers the episodes of the season we know about,
+// leaving out the skipped ones, and covers none when we know of none.
+func episodesFromRelease(s Show, rel *Release) ([]*Episode, error) {
+	first := episodeFromRelease(s, rel)
+	if rel.SeasonPack {
+		known, err := GetSeasonEpisodes(s.ID, rel.Season)
+		if err != nil {
+			return nil, err
+		}
+		eps := []*Episode{}
+		for _, k := range known {
+			if k.State == EpisodeSkipped {
+				continue
+			}
+			e := *first
+			e.Episode, e.AirDate, e.Title = k.Episode, k.AirDate, k.Title
+			eps = append(eps, &e)
+		}
+		return eps, nil
+	}
+	eps := []*Episode{first}
+	if first.IsDaily() || len(rel.Episodes) < 2 {
+		return eps, nil
+	}
+	// The episode title only belongs to the first episode.
+	for _, n := range rel.Episodes[1:] {
+		e := *first
+		e.Episode, e.Title = n, ""
+		eps = append(eps, &e)
+	}
+	return eps, nil
 }
 
 // End User Functions
@@ -118,23 +356,68 @@ func episodeRewriter(ep string) string {
 	return strings.Title(e)
 }
 
+// updateEpisodeRegex sets the default episode regex from the first watcher
+// that has one configured. Without one the built-in release parser is used.
 func updateEpisodeRegex() (err error) {
-	er, err := url.QueryUnescape(tc.IRC.EpisodeRegexp)
+	tc := currentConfig()
+	er := tc.RSS.EpisodeRegexp
+	for _, c := range tc.IRC {
+		if c.EpisodeRegexp != "" {
+			er = c.EpisodeRegexp
+			break
+		}
+	}
+	if er == "" {
+		episodePattern = nil
+		return nil
+	}
+	episodePattern, err = compileEpisodeRegex(er)
+	return err
+}
+
+// compileEpisodeRegex compiles a URL-escaped episode regex from the config.
+func compileEpisodeRegex(s string) (*regexp.Regexp, error) {
+	er, err := url.QueryUnescape(s)
 	if err != nil {
-    return err
-  }
-	episodePattern, err = regexp.Compile(er)
-  return err
+		return nil, err
+	}
+	return regexp.Compile(er)
 }
 
-func matchEpisodeToPattern(e string) (named map[string]string, err error) {
-  match := episodePattern.FindAllStringSubmatch(e, -1)
+// validEpisodeRegex checks an episode regex from the config, which may be
+// empty.
+func validEpisodeRegex(s string) error {
+	if s == "" {
+		return nil
+	}
+	p, err := compileEpisodeRegex(s)
+	if err != nil {
+		return err
+	}
+	return checkEpisodeGroups(p)
+}
+
+func matchEpisodeToPattern(p *regexp.Regexp, e string) (named map[string]string, err error) {
+  if p == nil {
+    return nil, errors.New("no episode regexp configured")
+  }
+  match := p.FindAllStringSubmatch(e, -1)
   if match == nil {
     return nil, errors.New("string not matched regexp")
   }
 
+  named = map[string]string{}
+  if !hasNamedGroups(p) {
+    // An old style regex with positional groups.
+    for i, n := range match[0][1:] {
+      if i < len(legacyEpisodeGroups) && n != "" {
+        named[legacyEpisodeGroups[i]] = n
+      }
+    }
+    return
+  }
   for i, n := range match[0] {
-    named[episodePattern.SubexpNames()[i]] = n
+    named[p.SubexpNames()[i]] = n
   }
   return
 }
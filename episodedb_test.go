@@ -19,7 +19,8 @@ func TestGetDailyEpisodesByShowID(t *testing.T) {
 	assert.Len(t, *e, 1, "Length of results does not match 1.")
 	actual := *e
 	assert.Equal(t, "Daily Test", actual[0].Title, "Title does not match.")
-	assert.Equal(t, "2015.01.01", actual[0].AirDate, "Airdate doesn't match.")
+	ad, _ := ParseAirDate("2015.01.01")
+	assert.Equal(t, ad, actual[0].AirDate, "Airdate doesn't match.")
 }
 
 func TestIsNewEpisode(t *testing.T) {
@@ -49,15 +50,20 @@ func TestValidEpisodeQuality(t *testing.T) {
 }
 
 func TestParseTorrentString(t *testing.T) {
+	oldPattern := episodePattern
+	defer func() { episodePattern = oldPattern }()
+	episodePattern = nil
+
 	eTest, err := ParseTorrentString("daily.shown.2015.03.26.will.ferrell.1080p.hdtv.x264-daview.mp4.torrent")
 	assert.NoError(t, err)
-	expected := newDaily(int64(3), "Will Ferrell", "2015.03.26")
-	assert.Equal(t, expected, eTest, "Objects don't match")
+	ad, _ := ParseAirDate("2015.03.26")
+	expected := &Episode{ShowID: int64(3), AirDate: ad, Title: "will ferrell", Quality: "1080p HDTV"}
+	assert.Equal(t, []*Episode{expected}, eTest, "Objects don't match")
 
 	eTest, err = ParseTorrentString("Walking.bread.S01E06.In.Enemy.Hands.1080p.WEB-DL.DD5.1.H.264-NTb.torrent")
 	assert.NoError(t, err)
-	expected = newEpisode(int64(1), "In Enemy Hands", 1, 6)
-	assert.Equal(t, expected, eTest, "Episode objects don't match")
+	expected = &Episode{ShowID: int64(1), Season: 1, Episode: 6, Title: "In Enemy Hands", Quality: "1080p WEB-DL"}
+	assert.Equal(t, []*Episode{expected}, eTest, "Episode objects don't match")
 
 	_, err = ParseTorrentString("blah.blahblah.not.a.real.episode.torrent")
 	assert.Error(t, err)
@@ -0,0 +1,237 @@
+/* Events
+ *
+ * What gumshoe does is published on an event bus: announces seen, matched and
+ * rejected, fetches, IRC watchers changing state, expired tracker cookies and
+ * config reloads. The last eventBufferSize events are kept, and /api/v1/events
+ * streams them with Server-Sent Events, starting with the kept ones, or the
+ * ones after the Last-Event-ID a reconnecting client sends.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventAnnounce       = "announce"
+	EventMatched        = "matched"
+	EventRejected       = "rejected"
+	EventFetchStarted   = "fetch_started"
+	EventFetchCompleted = "fetch_completed"
+	EventFetchRetry     = "fetch_retry"
+	EventFetchFailed    = "fetch_failed" // no retries left
+	EventIRCState       = "irc_state"
+	EventIRCDisconnect  = "irc_disconnected"
+	EventCookieExpired  = "cookie_expired"
+	EventConfigReloaded = "config_reloaded"
+	EventConfigRejected = "config_rejected"
+)
+
+// Every event type.
+var eventTypes = []string{
+	EventAnnounce, EventMatched, EventRejected,
+	EventFetchStarted, EventFetchCompleted, EventFetchRetry, EventFetchFailed,
+	EventIRCState, EventIRCDisconnect, EventCookieExpired,
+	EventConfigReloaded, EventConfigRejected,
+}
+
+var (
+	// How many events are kept for clients that connect later.
+	eventBufferSize = 500
+	// Events a subscriber can fall behind by before it's dropped. It picks up
+	// from the buffer when it reconnects.
+	eventSubscriberBuffer = 64
+	// A comment is sent this often so proxies don't close a quiet stream.
+	eventKeepAlive = 30 * time.Second
+
+	events = NewEventBus(eventBufferSize)
+)
+
+// Event is something that happened. Watcher is the IRC watcher, "rss",
+// "backlog" or "review" an announce came from.
+type Event struct {
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	Time    int64  `json:"time"`
+	Watcher string `json:"watcher,omitempty"`
+	Release string `json:"release,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// EventBus hands every event to its subscribers and keeps the latest ones in
+// a ring buffer.
+type EventBus struct {
+	lock   sync.Mutex
+	ring   []Event
+	next   int // where the next event goes in ring
+	lastID int64
+	subs   map[chan Event]bool
+}
+
+func NewEventBus(size int) *EventBus {
+	return &EventBus{ring: make([]Event, 0, size), subs: map[chan Event]bool{}}
+}
+
+// Publish stamps e with an id and the time, and sends it out.
+func (b *EventBus) Publish(e Event) Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lastID++
+	e.ID = b.lastID
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	if len(b.ring) < cap(b.ring) {
+		b.ring = append(b.ring, e)
+	} else if cap(b.ring) > 0 {
+		b.ring[b.next] = e
+		b.next = (b.next + 1) % cap(b.ring)
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// Too slow, let it reconnect and catch up from the buffer.
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return e
+}
+
+// LastID is the id of the latest event.
+func (b *EventBus) LastID() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lastID
+}
+
+// Since returns the kept events with an id after id, oldest first.
+func (b *EventBus) Since(id int64) []Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.since(id)
+}
+
+func (b *EventBus) since(id int64) []Event {
+	out := []Event{}
+	for i := range b.ring {
+		e := b.ring[(b.next+i)%len(b.ring)]
+		if e.ID > id {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Subscribe returns the kept events after id and a channel with every event
+// published from then on. The channel is closed if the subscriber falls too
+// far behind. cancel has to be called once done.
+func (b *EventBus) Subscribe(id int64) (replay []Event, ch chan Event, cancel func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ch = make(chan Event, eventSubscriberBuffer)
+	b.subs[ch] = true
+	return b.since(id), ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.subs[ch] {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func knownEventType(typ string) bool {
+	for _, t := range eventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func publishEvent(typ, watcher, release, format string, a ...interface{}) {
+	events.Publish(Event{Type: typ, Watcher: watcher, Release: release, Message: fmt.Sprintf(format, a...)})
+}
+
+// eventFilter is the set of event types asked for with ?types=, or nil for
+// all of them.
+func eventFilter(r *http.Request) map[string]bool {
+	s := r.URL.Query().Get("types")
+	if s == "" {
+		return nil
+	}
+	f := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		f[strings.TrimSpace(t)] = true
+	}
+	return f
+}
+
+func writeEvent(w http.ResponseWriter, e Event) {
+	b, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+}
+
+// streamEvents sends events as they happen, after the kept ones newer than
+// the Last-Event-ID header or ?since=.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, apiErrorf(http.StatusInternalServerError, "Streaming isn't supported."))
+		return
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("since")
+	}
+	var after int64
+	if last != "" {
+		var err error
+		if after, err = strconv.ParseInt(last, 10, 64); err != nil {
+			writeAPIError(w, apiErrorf(http.StatusBadRequest, "%s is not an event id.", last))
+			return
+		}
+	}
+	types := eventFilter(r)
+	replay, ch, cancel := events.Subscribe(after)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range replay {
+		if types == nil || types[e.Type] {
+			writeEvent(w, e)
+		}
+	}
+	f.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if types != nil && !types[e.Type] {
+				continue
+			}
+			writeEvent(w, e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		f.Flush()
+	}
+}
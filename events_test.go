@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func eventIDs(es []Event) []int64 {
+	ids := []int64{}
+	for _, e := range es {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus(3)
+	for i := 0; i < 5; i++ {
+		b.Publish(Event{Type: EventAnnounce})
+	}
+	assert.Equal(t, []int64{3, 4, 5}, eventIDs(b.Since(0)))
+	assert.Equal(t, []int64{5}, eventIDs(b.Since(4)))
+	assert.Empty(t, b.Since(5))
+
+	replay, ch, cancel := b.Subscribe(4)
+	assert.Equal(t, []int64{5}, eventIDs(replay))
+	e := b.Publish(Event{Type: EventMatched, Release: "Show.S01E01"})
+	assert.Equal(t, e, <-ch)
+	assert.NotZero(t, e.Time)
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+	cancel()
+
+	// A subscriber that doesn't keep up is dropped.
+	_, ch, cancel = b.Subscribe(b.lastID)
+	defer cancel()
+	for i := 0; i <= eventSubscriberBuffer; i++ {
+		b.Publish(Event{Type: EventAnnounce})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Equal(t, eventSubscriberBuffer, n)
+}
+
+func TestReleaseEvents(t *testing.T) {
+	last := events.Publish(Event{Type: "test"}).ID
+	assert.NoError(t, ProcessRelease("rss", "Not.Tracked.S01E01.720p.HDTV.x264-GRP", "http://localhost/1.torrent", nil))
+	es := events.Since(last)
+	if assert.Len(t, es, 2) {
+		assert.Equal(t, EventAnnounce, es[0].Type)
+		assert.Equal(t, "rss", es[0].Watcher)
+		assert.Equal(t, EventRejected, es[1].Type)
+		assert.Equal(t, "Not.Tracked.S01E01.720p.HDTV.x264-GRP", es[1].Release)
+		assert.NotEmpty(t, es[1].Message)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	if testToken == "" {
+		testToken, _, _ = CreateAPIToken("tests")
+	}
+	ts := httptest.NewServer(newHTTPHandler(pwd))
+	defer ts.Close()
+
+	before := events.Publish(Event{Type: EventConfigReloaded, Message: "before"})
+	req, _ := http.NewRequest("GET", ts.URL+"/api/v1/events?types=config_reloaded,irc_state", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(before.ID-1, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events.Publish(Event{Type: EventAnnounce, Message: "filtered out"})
+	setIRCStatus("test channel", "Connected")
+
+	r := bufio.NewReader(resp.Body)
+	read := func() Event {
+		e := Event{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				assert.NoError(t, json.Unmarshal([]byte(line[6:]), &e))
+			}
+			if line == "\n" && e.ID != 0 {
+				return e
+			}
+		}
+	}
+	assert.Equal(t, "before", read().Message)
+	e := read()
+	assert.Equal(t, EventIRCState, e.Type)
+	assert.Equal(t, "test channel", e.Watcher)
+	assert.Equal(t, "Connected", e.Message)
+
+	resp, err = http.Get(ts.URL + "/api/v1/events")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+}
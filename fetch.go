@@ -5,12 +5,16 @@ import (
 	"expvar"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,28 +22,55 @@ type FileFetch struct {
 	HttpClient   *http.Client
 	Url          *url.URL
 	SaveLocation string
+	// The HTTP status of the last fetch, 0 if there was no response.
+	Status int
 }
 
-func NewFileFetch(link string) (ff *FileFetch, err error) {
+// NewFileFetch sets up the download of link. title is the release name, the
+// torrent is saved under it when the link has no file name of its own.
+func NewFileFetch(link, title string) (ff *FileFetch, err error) {
 	u, err := url.Parse(link)
 	if err != nil {
 		return nil, err
 	}
+	ff = &FileFetch{}
 	ff.Url = u
 	ff.HttpClient = &http.Client{}
 	err = ff.setClientCookie()
   if err != nil {
 		return nil, err
 	}
-	_, dlFile := filepath.Split(u.RequestURI())
-	ff.SaveLocation = filepath.Join(tc.Directories["user_dir"], tc.Directories["torrent_dir"], string(dlFile[len(dlFile)-1]))
+	tc := currentConfig()
+	ff.SaveLocation = filepath.Join(tc.Directories["user_dir"], tc.Directories["torrent_dir"], torrentFileName(u, title))
   return ff, nil
 }
 
+var unsafeFileChars = regexp.MustCompile(`[^\w.\-]+`)
+
+// torrentFileName names the file a torrent is saved in after the last part
+// of the link's path, leaving out the query, which often has a passkey in it.
+// Links like download.php?id=1 are named after the release title instead.
+func torrentFileName(u *url.URL, title string) string {
+	clean := func(s string) string {
+		return strings.TrimLeft(unsafeFileChars.ReplaceAllString(s, "_"), "._")
+	}
+	name := clean(path.Base(u.Path))
+	if strings.HasSuffix(strings.ToLower(name), ".torrent") {
+		return name
+	}
+	if t := clean(title); t != "" {
+		return t + ".torrent"
+	}
+	if name == "" {
+		name = "download"
+	}
+	return name + ".torrent"
+}
+
 func (ff *FileFetch) setClientCookie() error {
 	if ff.Url != nil {
 		jar, _ := cookiejar.New(nil)
-		jar.SetCookies(ff.Url, cj)
+		jar.SetCookies(ff.Url, GetTrackerCookies())
 		ff.HttpClient.Jar = jar
 		return nil
 	}
@@ -47,11 +78,24 @@ func (ff *FileFetch) setClientCookie() error {
 }
 
 func (ff *FileFetch) RetrieveEpisode() error {
+	ff.Status = 0
+	trackerLimits.wait(ff.Url.Host)
 	resp, err := ff.HttpClient.Get(ff.Url.String())
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	ff.Status = resp.StatusCode
+	UpdateResultMap(strconv.Itoa(resp.StatusCode))
+	if currentConfig().Download.Secure && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		warnCookies("refused", "%s refused the tracker cookies: %s", ff.Url.Host, resp.Status)
+	}
+	if err = ff.checkThrottled(resp); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Fetch of %s returned %s", ff.Url, resp.Status)
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -62,7 +106,7 @@ func (ff *FileFetch) RetrieveEpisode() error {
 		return err
 	}
 	lastFetch.Set(time.Now().Unix())
-	UpdateResultMap(strconv.Itoa(resp.StatusCode))
+	lastFetchTime.Set(float64(time.Now().Unix()))
 	return nil
 }
 
@@ -71,9 +115,105 @@ func (ff *FileFetch) Print() string {
 		ff.Url.String(), ff.SaveLocation, time.Now().String())
 }
 
+// ProcessRelease runs a release name and the link to its torrent through the
+// episode pipeline shared by all of the watchers. The torrent is only queued
+// for download when the release is a tracked show, has a new episode in it
+// and is the wanted quality. watcher names where the release came from, p is
+// its episode regex, nil uses the built-in release parser.
+func ProcessRelease(watcher, title, link string, p *regexp.Regexp) error {
+	publishEvent(EventAnnounce, watcher, title, "%s", link)
+	announcesSeen.Inc(watcher)
+	rel, show, err := matchRelease(p, title)
+	if am, ok := err.(*AmbiguousMatchError); ok {
+		log.Printf("Release %s needs review: %s\n", title, am)
+		announcesRejected.Inc(watcher, rejectReview)
+		publishEvent(EventRejected, watcher, title, "Needs review: %s", am)
+		if _, err = AddMatchReview(title, link, am); err != nil {
+			return fmt.Errorf("Unable to add %s to the review list: %s", title, err)
+		}
+		return nil
+	} else if err != nil {
+		PrintDebugf("Error parsing string: %s\n", err)
+		announcesRejected.Inc(watcher, rejectUnmatched)
+		publishEvent(EventRejected, watcher, title, "%s", err)
+		return nil
+	}
+	eps, err := episodesFromRelease(show, rel)
+	if err != nil {
+		return err
+	}
+	want, reason := wantedEpisodes(show, rel, eps)
+	if reason != "" {
+		PrintDebugf("Skipping %s: %s\n", title, reason)
+		announcesRejected.Inc(watcher, rejectNotWanted)
+		publishEvent(EventRejected, watcher, title, "%s", reason)
+		return nil
+	}
+	if !show.AllowsQuality(title) {
+		PrintDebugf("Episode %s isn't the right quality.\n", title)
+		announcesRejected.Inc(watcher, rejectQuality)
+		publishEvent(EventRejected, watcher, title, "Not the quality wanted for %s.", show.Title)
+		return nil
+	}
+
+	for _, ep := range want {
+		if ep.IsUpgrade() {
+			log.Printf("Upgrading episode %s to %s: %s\n", ep, ep.Quality, title)
+		}
+	}
+	if _, err = EnqueueEpisodes(watcher, link, title, want, rel.SeasonPack); err != nil {
+		return fmt.Errorf("Unable to queue %s: %s", title, err)
+	}
+	announcesMatched.Inc(watcher)
+	publishEvent(EventMatched, watcher, title, "Queued for %s.", show.Title)
+	return nil
+}
+
+// wantedEpisodes picks the episodes of a release worth fetching, the new ones
+// that aren't queued already. When there are none, or the release is a
+// season pack the show doesn't take, reason says why.
+func wantedEpisodes(show Show, rel *Release, eps []*Episode) (want []*Episode, reason string) {
+	skipped, queued := 0, 0
+	for _, e := range eps {
+		if r := show.Skips(e); r != "" {
+			skipped++
+			reason = r
+			continue
+		}
+		if !e.IsNewEpisode() {
+			continue
+		}
+		if e.IsEpisodeQueued() {
+			queued++
+			continue
+		}
+		want = append(want, e)
+	}
+	if rel.SeasonPack {
+		switch {
+		case !show.SeasonPacks:
+			return nil, "Season packs aren't taken for this show."
+		case len(eps) == 0:
+			return nil, fmt.Sprintf("No episodes of season %d are known, so the pack can't be checked.", rel.Season)
+		case len(want) > 0 && len(want)*100 < show.PackThreshold*(len(eps)-skipped):
+			return nil, fmt.Sprintf("Only %d of the %d episodes in the pack are wanted, %d%% need to be.",
+				len(want), len(eps)-skipped, show.PackThreshold)
+		}
+	}
+	switch {
+	case len(want) > 0:
+		return want, ""
+	case len(eps) == 1 && skipped == 1:
+		return nil, reason
+	case queued > 0:
+		return nil, "This episode is already in the download queue."
+	}
+	return nil, "We already have this episode, and this release isn't an upgrade."
+}
+
 func UpdateResultMap(r string) {
 	if fetchResultMap.Get(r) == nil {
-		fr := expvar.NewInt(r)
+		fr := new(expvar.Int)
 		fr.Set(int64(1))
 		fetchResultMap.Set(r, fr)
 		return
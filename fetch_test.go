@@ -51,7 +51,7 @@ func (mt *MockTime) Sleep(t time.Duration) {
 }
 
 func setUp() {
-	tc.LoadGumshoeConfig(configFile)
+	currentConfig().LoadGumshoeConfig(configFile)
 	testDataDir = filepath.Join(pwd, "test_data")
 	testUrls, err := ioutil.ReadFile(filepath.Join(testDataDir, "test_urls"))
 	if err != nil {
@@ -73,7 +73,7 @@ func setUp() {
 }
 
 func tearDown() {
-	tc = NewTrackerConfig()
+	NewTrackerConfig().SetGlobalTrackerConfig()
 	testDataDir = ""
 	urls = [][]byte{}
 	mhc = &MockHttpClient{}
@@ -86,7 +86,7 @@ func TestSetClientCookie(t *testing.T) {
 		HttpClient: &http.Client{},
 		Url:        tUrl}
 	tj, _ := cookiejar.New(nil)
-	tj.SetCookies(ff.Url, cj)
+	tj.SetCookies(ff.Url, GetTrackerCookies())
 	err := ff.SetClientCookie()
 	assert.Nil(t, err)
 	assert.Equal(t, ff.HttpClient.Jar, tj)
@@ -5,16 +5,13 @@ import (
   "expvar"
   "flag"
   "log"
-  "net/http"
   "os"
   "path/filepath"
   "regexp"
   "strconv"
 
   "github.com/ev1lm0nkey/gumshoe/db/db"
-  "github.com/ev1lm0nkey/gumshoe/watchers/irc"
 	"github.com/coopernurse/gorp"
-  "github.com/thoj/go-ircevent"
 )
 
 
@@ -24,13 +21,11 @@ var (
   DEFAULT_CFG = "/usr/local/gumshoe/default.cfg"
   DEFAULT_PORT = "20123"
 
-	concurrentFetches = make(chan int, 10)
+	concurrentFetches = make(chan int64) // IDs of queue items handed to the download workers
 	fetchResultMap = expvar.NewMap("fetch_results").Init() // map of fetch return code counters
 	lastFetch      = expvar.NewInt("last_fetch_timestamp") // timestamp of last successful fetch
 
-	tc  *TrackerConfig
-  tc_updated = make(chan bool)  // Those systems that can be dynamically updated, should watch this channel.
-	cj  []*http.Cookie
+  tc_updated = make(chan bool, 1)  // Those systems that can be dynamically updated, should watch this channel.
 	gDb *gorp.DbMap
   cfgFile string
   httpPort string
@@ -38,58 +33,55 @@ var (
   // HTTP Server Flags
   port = flag.String("p", DEFAULT_PORT, "Which port do we serve requests from. 0 allows the system to decide.")
   baseDir = flag.String("d", "/usr/local/gumshoe", "Base path for gumshoe.")
+  keyFile = flag.String("k", "", "File holding the passphrase for the secrets store. Defaults to $GUMSHOE_PASSPHRASE.")
 
   // Base Config Stuff
   configFile = flag.String("c", filepath.Join(os.Getenv("HOME"), ".gumshoe", "data", "gumshoe.cfg"),	"Config file to load")
 
-	// Regexp to determine if the announce regexp matches a known episode structure
+	// Optional user regexp that overrides the built-in release parser
 	episodePattern *regexp.Regexp
-	// Quickly determine the quality of the show with this regex
-	episodeQualityRegexp = regexp.MustCompile("720p|1080p")
-	// Regexp for messages from IRC channel announcing something to do something about
-	announceLine *regexp.Regexp
-	// Time, in ms, when the connection to the IRC server was established
-	ircConnectTimestamp = expvar.NewInt("irc_connect_timestamp")
-	// Time, in ms, when the channel was last updated
-	ircUpdateTimestamp = expvar.NewInt("irc_last_update_timestamp")
-	// String relating to the current state of the IRC watcher
-	ircStatus = expvar.NewString("irc_status")
-	// IRC client object
-	ircClient *irc.Connection
-	// channel that gets timestamp updates for ircUpdateTimestamp in order to ensure we write only the most recent timestamp into that exported variable.
-	metricUpdate = make(chan int64)
 	// channel that locks the DB while we update it to prevent data corruption.
-	checkDBLock = make(chan int)
-	// Channel that is used to turn on and off the IRC watcher.
-	IRCEnabled = make(chan bool)
-	// Channel to signify if the IRC config has changed. Changes will restart the IRC watcher.
-	IRCConfigChanged = make(chan bool)
-	// Channel that collects all IRC errors and will disconnect the IRC watcher if it encounters one.
-	IRCConfigError = make(chan error)
+	checkDBLock = make(chan int, 1)
 )
 
 func init() {
   flag.Parse()
-  tc = NewTrackerConfig()
+  NewTrackerConfig().SetGlobalTrackerConfig()
   lastFetch.Set(int64(0))
 }
 
+// The running config is never changed in place, so these set a copy of it.
 func SetGumshoeBaseDirectory(d string) {
-  tc.Directories["gumshoe_dir"] = d
+  n := *currentConfig()
+  n.Directories = map[string]string{}
+  for k, v := range currentConfig().Directories {
+    n.Directories[k] = v
+  }
+  n.Directories["gumshoe_dir"] = d
+  n.SetGlobalTrackerConfig()
 }
 
 func SetGumshoePort(p int) {
-  tc.Operations.HttpPort = strconv.Itoa(p)
+  n := *currentConfig()
+  n.Operations.HttpPort = strconv.Itoa(p)
+  n.SetGlobalTrackerConfig()
 }
 
 func LoadUserOrDefaultConfig(c string) error {
-  err := tc.LoadGumshoeConfig(c)
+  n := NewTrackerConfig()
+  defer func() {
+    n.SetGlobalTrackerConfig()
+    // The -p and -d overrides go into a copy, so this stays what the API
+    // saves changes to.
+    loadedConfig = n
+  }()
+  err := n.LoadGumshoeConfig(c)
   if err == nil {
     return
   }
   log.Errorln(err)
   log.Errorf("Error loading config %s. Trying the default.", c)
-  err = tc.LoadGumshoeConfig(DEFAULT_CFG)
+  err = n.LoadGumshoeConfig(DEFAULT_CFG)
   if err != nil {
     log.Errorf("Default config is invalid.")
   }
@@ -97,6 +89,7 @@ func LoadUserOrDefaultConfig(c string) error {
 }
 
 func setupLogging() (logger *log.Logger, err error) {
+  tc := currentConfig()
   l, err := os.Create(filepath.Join(tc.Directories["user_dir"], tc.Directories["log_dir"], "gumshoe.log"))
   if err != nil {
     PrintDebugln("Unable to open log file. Will just use stdout")
@@ -114,18 +107,41 @@ func UpdateAllComponents() {
   for {
     tcu := <-tc_updated
     if tcu {
-      PrintDebugln("Updating gumshoe configuration.")
-      // Put update function calls below here
-      updateEpisodeRegex()
-      // Put update function calls above here
-      tc_updated<- false
+      updateComponents()
     }
   }
 }
 
+// updateComponents sets up everything that is built from the config again.
+func updateComponents() {
+  PrintDebugln("Updating gumshoe configuration.")
+  // Put update function calls below here
+  updateEpisodeRegex()
+  SetTorrentClient()
+  SetMetadataProvider()
+  // Put update function calls above here
+}
+
+// notifyConfigUpdated tells UpdateAllComponents that the config has changed. It never
+// blocks, an update that is already waiting will pick up the new config.
+func notifyConfigUpdated() {
+  select {
+  case tc_updated<- true:
+  default:
+  }
+}
+
 func Start() (err error) {
+  if err = OpenSecrets(*keyFile); err != nil {
+    log.Fatalf("[FAIL] Secrets store: %s\n", err)
+  }
+  // The cookies were read before the secrets store was open.
+  if err = reloadCookies(); err != nil {
+    log.Printf("[ERROR] Loading tracker cookies: %s\n", err)
+  }
+
   go UpdateAllComponents()
-  tc_updated<- true
+  notifyConfigUpdated()
 
   // Unified logging is nice, but not necessary right now.
   //if tc.Operations.EnableLog {
@@ -140,20 +156,36 @@ func Start() (err error) {
     log.Fatalf("[FAIL] Database init failed: %s\n", err)
   }
 
+  StartNotifier()
+  err = StartQueue()
+  if err != nil {
+    log.Fatalf("[FAIL] Download queue failed to start: %s\n", err)
+  }
+
+  // Both watchers are started so that either one can be switched on later
+  // by editing the config file.
+  log.Println("Starting IRC Watcher.")
+  StartIRC()  // Add the logger here
+  log.Println("Starting RSS Watcher.")
+  StartRSS()
+  log.Println("Starting Backlog Search.")
+  StartBacklog()
+  log.Println("Starting Post-processing.")
+  StartPostProcess()
+  go WatchCookieExpiry()
+  tc := currentConfig()
   for k, v := range tc.Operations.WatchMethods {
-    if v {
-      switch k {
-      case "irc":
-        log.Println("Starting IRC Watcher.")
-        irc.Start()  // Add the logger here
-      default:
-        PrintDebugf("%s is coming soon.\n", k)
-      }
+    if v && k != "irc" && k != "rss" {
+      PrintDebugf("%s is coming soon.\n", k)
     }
   }
 
-  log.Printf("Gumshoe http starting on port %s", tc.Operations.HttpPort)
-  StartHTTPServer(tc.Directories["gumshoe_dir"], tc.Operations.HttpPort)  // Add the logger here too
+  if cfgFile != "" {
+    go WatchConfigFile(cfgFile)
+  }
+
+  log.Printf("Gumshoe http starting on %s", httpListenConfig(tc))
+  StartHTTPServer(tc.Directories["gumshoe_dir"], httpListenConfig(tc))  // Add the logger here too
   log.Println("Exiting Gumshoe.")
   return err
 }
@@ -163,6 +195,7 @@ func main() {
   if err != nil {
     log.Fatalln(err)
   }
+  tc := currentConfig()
 
   if *port != tc.Operations.HttpPort {
     tp, _ := strconv.Atoi(*port)
@@ -1,195 +1,751 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
-
-	"github.com/go-martini/martini"
-	"github.com/martini-contrib/binding"
+	"time"
 )
 
-func getShows(res http.ResponseWriter) string {
-	data, err := ListShows()
+func listShows(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	shows, err := ListShows()
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := paginate(w, r, len(shows))
 	if err != nil {
-    res.WriteHeader(http.StatusInternalServerError)
-		return err.Error()
+		return nil, err
 	}
-	return render(res, data)
+	return shows[start:end], nil
 }
 
-func getShow(res http.ResponseWriter, params martini.Params) string {
-	id, err := strconv.ParseInt(params["id"], 10, 64)
-	if err == nil {
-		data, err := GetShow(id)
-		if err == nil {
-			return render(res, data)
-		}
+// showFromPath loads the show named by the {id} of the path.
+func showFromPath(r *http.Request) (Show, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return Show{}, err
+	}
+	show, err := GetShow(id)
+	if err != nil {
+		return show, showNotFound(id, err)
+	}
+	return show, nil
+}
+
+func showNotFound(id int64, err error) error {
+	if err == sql.ErrNoRows {
+		return apiErrorf(http.StatusNotFound, "Show %d doesn't exist.", id)
 	}
-	return render(res, err)
+	return err
+}
+
+func getShow(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return showFromPath(r)
 }
 
-func createShow(res http.ResponseWriter, params martini.Params, show Show) string {
+func createShow(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show := Show{}
+	if err := decodeBody(r, &show); err != nil {
+		return nil, err
+	}
 	ns := newShow(show.Title, show.Quality, show.Episodal)
-	err := ns.AddShow()
-  if err != nil {
-    res.WriteHeader(http.StatusInternalServerError)
-    return err.Error()
-  }
-	return render(res, ns)
+	ns.SetOptions(show)
+	if err := ns.AddShow(); err != nil {
+		return nil, err
+	}
+	return created(ns), nil
+}
+
+// updateShow changes the settings of a show. What the metadata provider
+// filled in is kept.
+func updateShow(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	old, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	show := Show{}
+	if err = decodeBody(r, &show); err != nil {
+		return nil, err
+	}
+	temp := newShow(show.Title, show.Quality, show.Episodal)
+	temp.ID = old.ID
+	temp.TvDbId, temp.MetadataID, temp.CanonicalTitle = old.TvDbId, old.MetadataID, old.CanonicalTitle
+	temp.SetOptions(show)
+	if err = temp.UpdateShow(); err != nil {
+		return nil, err
+	}
+	if err = temp.ApplyStart(); err != nil {
+		return nil, err
+	}
+	return temp, nil
+}
+
+func deleteShow(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = show.DeleteShow(); err != nil {
+		return nil, err
+	}
+	return noContent, nil
+}
+
+func getEpisodes(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	e, err := GetEpisodesByShowID(show.ID)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := paginate(w, r, len(*e))
+	if err != nil {
+		return nil, err
+	}
+	return (*e)[start:end], nil
 }
 
-func updateShow(res http.ResponseWriter, params martini.Params, show Show) string {
-	id, err := strconv.ParseInt(params["id"], 10, 64)
-	if err == nil {
-		temp := newShow(show.Title, show.Quality, show.Episodal)
-		temp.ID = id
-		err = temp.UpdateShow()
+// getMissing lists the wanted episodes of a show that have aired.
+func getMissing(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	e, err := MissingEpisodes(show.ID)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := paginate(w, r, len(e))
+	if err != nil {
+		return nil, err
 	}
-	return render(res, err)
+	return e[start:end], nil
 }
 
-func deleteShow(res http.ResponseWriter, params martini.Params) string {
-	id, err := strconv.ParseInt(params["id"], 10, 64)
-	if err == nil {
-		show := &Show{ID: id}
-		err = show.DeleteShow()
+func getReleases(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := GetReleasesByShowID(show.ID)
+	if err != nil {
+		return nil, err
 	}
+	start, end, err := paginate(w, r, len(rs))
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		return nil, err
 	}
-	return render(res, err)
+	return rs[start:end], nil
 }
 
-func getEpisodes(res http.ResponseWriter, params martini.Params) string {
-	sid, err := strconv.ParseInt(params["id"], 10, 64)
+// getRelease returns a fetched release along with the episodes it covers.
+func getRelease(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id, err := pathID(r, "id")
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		return err.Error()
+		return nil, err
 	}
-	e, err := GetEpisodesByShowID(sid)
+	rel, err := GetRelease(id)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		return err.Error()
+		return nil, err
 	}
-	return render(res, e)
+	eps, err := rel.Episodes()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		ReleaseRecord
+		Episodes []Episode `json:"episodes"`
+	}{rel, eps}, nil
 }
 
-func getConfig(res http.ResponseWriter, params martini.Params) string {
-	if s, ok := params["section"]; ok {
-		o, err := tc.GetConfigOption(s)
-		if err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			return err.Error()
+type episodeState struct {
+	State string `json:"state" binding:"required"`
+}
+
+func updateEpisodeState(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	es := episodeState{}
+	if err = decodeBody(r, &es); err != nil {
+		return nil, err
+	}
+	if err = SetEpisodeState(id, es.State); err != nil {
+		return nil, badRequest(err)
+	}
+	return noContent, nil
+}
+
+// searchBacklog starts a backlog search without waiting for the interval.
+func searchBacklog(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if NewBacklogSearcher(currentConfig()) == nil {
+		return nil, apiErrorf(http.StatusBadRequest, "No backlog search is configured.")
+	}
+	TriggerBacklog()
+	return accepted(nil), nil
+}
+
+// postProcess sorts a finished download into the library right away. It's
+// for the torrent client to call when a download is done. Without a path the
+// whole download_dir is looked through.
+func postProcess(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	req := struct {
+		Path string `json:"path"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &req); err != nil {
+			return nil, err
 		}
-		return asJson(res, o)
 	}
-	o, err := json.Marshal(tc)
+	results, err := PostProcessPath(req.Path, time.Now())
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		return err.Error()
+		return nil, badRequest(err)
 	}
-	return asJson(res, o)
+	return results, nil
+}
+
+func getConfig(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return currentConfig().Redacted(), nil
 }
 
-func updateConfig() string {
-	return "updateConfig"
+func getConfigSection(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	o, err := currentConfig().Redacted().GetConfigOption(r.PathValue("section"))
+	if err != nil {
+		return nil, apiErrorf(http.StatusNotFound, "%s is not a config section.", r.PathValue("section"))
+	}
+	return json.RawMessage(o), nil
 }
 
-func getQueueItems() string {
-	return "getQueueItems"
+// updateConfig takes a whole config, or just the sections being changed, and
+// saves it. Problems are returned as a list of field errors.
+func updateConfig(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	u, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	return saveConfigUpdate(u)
 }
 
-func createQueueItem() string {
-	return "createQueueItem"
+// updateConfigSection replaces one section of the config.
+func updateConfigSection(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	s := r.PathValue("section")
+	if _, err := currentConfig().GetConfigOption(s); err != nil {
+		return nil, apiErrorf(http.StatusNotFound, "%s is not a config section.", s)
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	u, err := json.Marshal(map[string]json.RawMessage{s: b})
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "Invalid JSON: %s", err)
+	}
+	return saveConfigUpdate(u)
 }
 
-func deleteQueueItem() string {
-	return "deleteQueueItem"
+func saveConfigUpdate(u []byte) (interface{}, error) {
+	err := SaveConfig(func(c *TrackerConfig) (*TrackerConfig, error) {
+		n, verr := c.ApplyConfigUpdate(u)
+		if verr != nil {
+			return nil, verr
+		}
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return currentConfig().Redacted(), nil
 }
 
-func getStatus(res http.ResponseWriter) string {
-	//_, err := torrentClient.GetTorrents()
-	//if err != nil {
-	//  res.WriteHeader(http.StatusInternalServerError)
-	//  return err.Error()
-	//}
-	return "OK"
+type secretUpdate struct {
+	Name  string `json:"name" binding:"required"`
+	Value string `json:"value"`
 }
 
-func getSettings(res http.ResponseWriter, params martini.Params) string {
-	return render(res, tc)
+// getSecrets lists the names in the secrets store, never the values.
+func getSecrets(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return secrets.Names(), nil
 }
 
-func render(res http.ResponseWriter, data interface{}) string {
-	thing, err := json.Marshal(data)
+func secretError(err error) error {
+	if err == ErrNoSecrets {
+		return apiErrorf(http.StatusServiceUnavailable, "%s", err)
+	}
+	return badRequest(err)
+}
+
+func createSecret(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	s := secretUpdate{}
+	if err := decodeBody(r, &s); err != nil {
+		return nil, err
+	}
+	if err := secrets.Set(s.Name, s.Value); err != nil {
+		return nil, secretError(err)
+	}
+	return created(map[string]string{"name": s.Name, "ref": secretRefPrefix + s.Name}), nil
+}
+
+func deleteSecret(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if err := secrets.Delete(r.PathValue("name")); err != nil {
+		return nil, secretError(err)
+	}
+	return noContent, nil
+}
+
+// importCookies replaces the encrypted tracker cookie jar.
+func importCookies(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	c := tempCookies{}
+	if err := decodeBody(r, &c); err != nil {
+		return nil, err
+	}
+	if err := ImportCookies(&c); err != nil {
+		return nil, secretError(err)
+	}
+	return map[string]int{"imported": len(c.Cookies)}, nil
+}
+
+func getQueueItems(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	items, err := ListQueue(r.URL.Query().Get("state"))
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := paginate(w, r, len(items))
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		return err.Error()
+		return nil, err
 	}
-	return asJson(res, thing)
+	return items[start:end], nil
 }
 
-func getVarz(res http.ResponseWriter) string {
-  output := []string{}
-	res.Header().Set("Content-Type", "application/json; charset=utf-8")
-	output = append(output, fmt.Sprintf("{", "\n"))
+func getQueueItem(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	q, err := GetQueueItem(id)
+	if err == sql.ErrNoRows {
+		return nil, apiErrorf(http.StatusNotFound, "Queue item %d doesn't exist.", id)
+	}
+	return q, err
+}
+
+func createQueueItem(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	item := QueueItem{}
+	if err := decodeBody(r, &item); err != nil {
+		return nil, err
+	}
+	// Tie the download to its episodes when the title is one we track.
+	var eps []*Episode
+	pack := false
+	if item.Title != "" {
+		if rel, show, err := matchRelease(nil, item.Title); err == nil {
+			eps, _ = episodesFromRelease(show, rel)
+			pack = rel.SeasonPack
+		}
+	}
+	q, err := EnqueueEpisodes("api", item.URL, item.Title, eps, pack)
+	if err != nil {
+		return nil, err
+	}
+	return created(q), nil
+}
+
+func deleteQueueItem(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if _, err := getQueueItem(w, r); err != nil {
+		return nil, err
+	}
+	id, _ := pathID(r, "id")
+	if err := CancelQueueItem(id); err != nil {
+		return nil, apiErrorf(http.StatusConflict, "%s", err)
+	}
+	return noContent, nil
+}
+
+func getAliases(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	return GetAliases(show.ID)
+}
+
+func createAlias(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	a := ShowAlias{}
+	if err = decodeBody(r, &a); err != nil {
+		return nil, err
+	}
+	if err = show.AddAlias(a.Alias, "user"); err != nil {
+		return nil, badRequest(err)
+	}
+	aliases, err := GetAliases(show.ID)
+	if err != nil {
+		return nil, err
+	}
+	return created(aliases), nil
+}
+
+func deleteAlias(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	show, err := showFromPath(r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := pathID(r, "alias_id")
+	if err != nil {
+		return nil, err
+	}
+	if err = DeleteAlias(show.ID, id); err != nil {
+		return nil, err
+	}
+	return noContent, nil
+}
+
+func getMatchReviews(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	reviews, err := ListMatchReviews()
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := paginate(w, r, len(reviews))
+	if err != nil {
+		return nil, err
+	}
+	return reviews[start:end], nil
+}
+
+type reviewResolution struct {
+	ShowID int64 `json:"show_id" binding:"required"`
+}
+
+// resolveMatchReview picks the show a release on the review list belongs to.
+func resolveMatchReview(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	rr := reviewResolution{}
+	if err = decodeBody(r, &rr); err != nil {
+		return nil, err
+	}
+	if err = ResolveMatchReview(id, rr.ShowID); err != nil {
+		return nil, badRequest(err)
+	}
+	return noContent, nil
+}
+
+func deleteMatchReview(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	if err = DeleteMatchReview(id); err != nil {
+		return nil, err
+	}
+	return noContent, nil
+}
+
+func testRelease(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	rt := releaseTest{}
+	if err := decodeBody(r, &rt); err != nil {
+		return nil, err
+	}
+	return TraceRelease(rt.Input), nil
+}
+
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	if s := configStatus.Value(); s != "" && s != "OK" {
+		fmt.Fprint(w, s)
+		return
+	}
+	if torrentClient != nil {
+		_, err := torrentClient.GetTorrents()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	fmt.Fprint(w, "OK")
+}
+
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentConfig().Redacted())
+}
+
+func getVarz(w http.ResponseWriter, r *http.Request) {
+	output := []string{}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	output = append(output, "{\n")
 	first := true
 	expvar.Do(func(kv expvar.KeyValue) {
 		if !first {
-			output = append(output, fmt.Sprintf(",\n"))
-			first = false
+			output = append(output, ",\n")
 		}
-		output = append(output, fmt.Sprintf("%q: %s\n", kv.Key, kv.Value))
+		first = false
+		output = append(output, fmt.Sprintf("%q: %s", kv.Key, kv.Value))
 	})
 	output = append(output, "\n}\n")
-	return strings.Join(output, "")
+	fmt.Fprint(w, strings.Join(output, ""))
 }
 
-func asJson(res http.ResponseWriter, data []byte) string {
-	res.Header().Set("Content-Type", "application/json")
-	res.Header().Set("Access-Control-Allow-Origin", "*")
-	return string(data[:])
+// staticHandler serves the web interface from dir. Paths that aren't a file
+// get index.html, the interface routes those itself.
+func staticHandler(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		if _, err := os.Stat(p); err != nil {
+			http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
 }
 
-// StartHTTPServer start a HTTP server for configuration and monitoring
-func StartHTTPServer(baseDir, port string) {
-  hostString := fmt.Sprintf(":%s", port)
-  m := martini.Classic()
+// apiRoutes sets up /api/v1, and the paths from before it.
+func apiRoutes() *apiRouter {
+	a := newAPIRouter()
 
-	static := martini.Static(filepath.Join(baseDir, "www"), martini.StaticOptions{Fallback: "/index.html", Exclude: "/api"})
-	m.NotFound(static, http.NotFound)
+	a.Handle("GET", "/shows", listShows)
+	a.Handle("POST", "/shows", createShow)
+	a.Handle("GET", "/shows/{id}", getShow)
+	a.Handle("PUT", "/shows/{id}", updateShow)
+	a.Handle("DELETE", "/shows/{id}", deleteShow)
+	a.Handle("GET", "/shows/{id}/episodes", getEpisodes)
+	a.Handle("GET", "/shows/{id}/missing", getMissing)
+	a.Handle("GET", "/shows/{id}/releases", getReleases)
+	a.Handle("GET", "/shows/{id}/aliases", getAliases)
+	a.Handle("POST", "/shows/{id}/aliases", createAlias)
+	a.Handle("DELETE", "/shows/{id}/aliases/{alias_id}", deleteAlias)
 
-	m.Get("/status", getStatus)
-	m.Get("/settings", getSettings)
-	m.Get("/vars", getVarz)
+	a.Handle("PUT", "/episodes/{id}/state", updateEpisodeState)
+	a.Handle("GET", "/releases/{id}", getRelease)
 
-	m.Get("/api/shows", getShows)
-	m.Get("/api/configs", getSettings)
+	a.Handle("GET", "/queue", getQueueItems)
+	a.Handle("POST", "/queue", createQueueItem)
+	a.Handle("GET", "/queue/{id}", getQueueItem)
+	a.Handle("DELETE", "/queue/{id}", deleteQueueItem)
 
-	m.Group("/api/show", func(r martini.Router) {
-		r.Get("/:id", getShow)
-		r.Post("/new", binding.Bind(Show{}), createShow)
-		r.Post("/update/:id", binding.Bind(Show{}), updateShow)
-		r.Delete("/delete/:id", deleteShow)
-	})
+	a.Handle("GET", "/config", getConfig)
+	a.Handle("PUT", "/config", updateConfig)
+	a.Handle("GET", "/config/{section}", getConfigSection)
+	a.Handle("PUT", "/config/{section}", updateConfigSection)
 
-	m.Group("/api/config", func(r martini.Router) {
-		r.Get("/:id", getConfig)
-		r.Post("/update", updateConfig)
-	})
+	a.Handle("GET", "/secrets", getSecrets)
+	a.Handle("POST", "/secrets", createSecret)
+	a.Handle("DELETE", "/secrets/{name}", deleteSecret)
+	a.Handle("POST", "/cookies", importCookies)
+
+	a.Handle("GET", "/reviews", getMatchReviews)
+	a.Handle("POST", "/reviews/{id}/resolve", resolveMatchReview)
+	a.Handle("DELETE", "/reviews/{id}", deleteMatchReview)
 
-	m.Group("/api/queue", func(r martini.Router) {
-		r.Get("/:id", getQueueItems)
-		r.Post("/new", createQueueItem)
-		r.Delete("/delete/:id", deleteQueueItem)
+	a.Handle("POST", "/test", testRelease)
+	a.Handle("POST", "/backlog", searchBacklog)
+	a.Handle("POST", "/postprocess", postProcess)
+
+	a.Handle("GET", "/tokens", getTokens)
+	a.Handle("POST", "/tokens", createToken)
+	a.Handle("DELETE", "/tokens/{id}", revokeToken)
+	a.Handle("PUT", "/password", updatePassword)
+	a.HandleFunc("GET", "/events", streamEvents)
+
+	a.Legacy([]legacyRoute{
+		{"GET", "/api/shows", "GET", "/shows"},
+		{"GET", "/api/show/{id}", "GET", "/shows/{id}"},
+		{"GET", "/api/show/{id}/episodes", "GET", "/shows/{id}/episodes"},
+		{"GET", "/api/show/{id}/missing", "GET", "/shows/{id}/missing"},
+		{"GET", "/api/show/{id}/releases", "GET", "/shows/{id}/releases"},
+		{"GET", "/api/show/{id}/aliases", "GET", "/shows/{id}/aliases"},
+		{"POST", "/api/show/{id}/aliases", "POST", "/shows/{id}/aliases"},
+		{"DELETE", "/api/show/{id}/aliases/{alias_id}", "DELETE", "/shows/{id}/aliases/{alias_id}"},
+		{"POST", "/api/show/new", "POST", "/shows"},
+		{"POST", "/api/show/update/{id}", "PUT", "/shows/{id}"},
+		{"DELETE", "/api/show/delete/{id}", "DELETE", "/shows/{id}"},
+		{"POST", "/api/episode/state/{id}", "PUT", "/episodes/{id}/state"},
+		{"GET", "/api/release/{id}", "GET", "/releases/{id}"},
+		{"GET", "/api/queue", "GET", "/queue"},
+		{"GET", "/api/queue/{id}", "GET", "/queue/{id}"},
+		{"POST", "/api/queue/new", "POST", "/queue"},
+		{"DELETE", "/api/queue/delete/{id}", "DELETE", "/queue/{id}"},
+		{"GET", "/api/configs", "GET", "/config"},
+		{"GET", "/api/config/{section}", "GET", "/config/{section}"},
+		{"POST", "/api/config/update", "PUT", "/config"},
+		{"GET", "/api/secrets", "GET", "/secrets"},
+		{"POST", "/api/secret/new", "POST", "/secrets"},
+		{"DELETE", "/api/secret/delete/{name}", "DELETE", "/secrets/{name}"},
+		{"POST", "/api/cookies", "POST", "/cookies"},
+		{"GET", "/api/reviews", "GET", "/reviews"},
+		{"POST", "/api/review/resolve/{id}", "POST", "/reviews/{id}/resolve"},
+		{"DELETE", "/api/review/delete/{id}", "DELETE", "/reviews/{id}"},
+		{"POST", "/api/test", "POST", "/test"},
+		{"POST", "/api/backlog", "POST", "/backlog"},
 	})
+	return a
+}
 
+// newHTTPHandler routes the API, the status pages and the web interface.
+// Only /status, logging in and the web interface's files can be had without
+// a token or session.
+func newHTTPHandler(baseDir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", getStatus)
+	mux.Handle("GET /settings", requireAuth(http.HandlerFunc(getSettings)))
+	mux.Handle("GET /vars", requireAuth(http.HandlerFunc(getVarz)))
+	mux.Handle("GET /metrics", requireAuth(http.HandlerFunc(getMetrics)))
+	mux.Handle("POST "+apiPrefix+"/login", apiHandler(login))
+	mux.Handle("POST "+apiPrefix+"/logout", apiHandler(logout))
+	mux.Handle("/api/", requireAuth(apiRoutes()))
+	mux.Handle("/", staticHandler(filepath.Join(baseDir, "www")))
+	return recoverPanics(cors(mux))
+}
+
+// StartHTTPServer start a HTTP server for configuration and monitoring, as
+// l says.
+func StartHTTPServer(baseDir string, l httpListen) {
 	log.Println("Starting up webserver...")
-	m.RunOnAddr(hostString)
+	if err := EnsureCLIToken(); err != nil {
+		log.Printf("[ERROR] Unable to write the gumshoe-cli token: %s\n", err)
+	}
+	notifyCertReload()
+	serveHTTP(newHTTPHandler(baseDir), l, httpRebind)
+}
+
+// Send new listen settings here to restart the webserver with them.
+var httpRebind = make(chan httpListen, 1)
+
+// serveHTTP listens as l says until the server fails or rebind is closed,
+// starting over whenever new settings are sent on rebind. If they can't be
+// used the server goes back to the old ones. A new certificate for the same
+// addresses is handed to the running server instead.
+func serveHTTP(h http.Handler, l httpListen, rebind chan httpListen) {
+	var prev *httpListen
+	for {
+		errs := make(chan error, 1)
+		stop, certs, err := listenHTTP(h, l, errs)
+		if err != nil {
+			errs <- err
+		}
+	wait:
+		for {
+			select {
+			case err := <-errs:
+				if prev == nil {
+					log.Println(err)
+					return
+				}
+				log.Printf("[ERROR] Unable to move the webserver to %s: %s\n", l, err)
+				configStatus.Set(fmt.Sprintf("Unable to listen on %s: %s", l, err))
+				l, prev = *prev, nil
+				break wait
+			case n, ok := <-rebind:
+				if ok && certs != nil && n.sameSockets(l) {
+					if err := useCert(certs, n); err != nil {
+						log.Printf("[ERROR] %s\n", err)
+						configStatus.Set(err.Error())
+						continue
+					}
+					log.Printf("Webserver on %s switched to the certificate %s.\n", n, n.CertFile)
+					l = n
+					continue
+				}
+				// The port is free again once stop returns, so the new server
+				// can listen on the same one.
+				stop()
+				if !ok {
+					return
+				}
+				log.Printf("Moving the webserver from %s to %s.\n", l, n)
+				old := l
+				l, prev = n, &old
+				break wait
+			}
+		}
+	}
+}
+
+// listenHTTP starts serving h as l says, sending the server's error to errs
+// when it stops. stop closes its listeners and shuts it down in the
+// background, letting requests in flight finish. certs is nil for plain HTTP.
+func listenHTTP(h http.Handler, l httpListen, errs chan error) (stop func(), certs *certReloader, err error) {
+	stop = func() {}
+	srv := &http.Server{Addr: l.Addr, Handler: h}
+	if !l.TLS() {
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			return stop, nil, err
+		}
+		go func() { errs <- srv.Serve(ln) }()
+		return shutdownFunc(nil, []net.Listener{ln}, srv), nil, nil
+	}
+
+	certs = &certReloader{}
+	if err = useCert(certs, l); err != nil {
+		return stop, nil, err
+	}
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return stop, nil, err
+	}
+	srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	watch := make(chan bool)
+	go certs.Watch(watch)
+	go func() { errs <- srv.ServeTLS(ln, "", "") }()
+	if l.RedirectAddr == "" {
+		return shutdownFunc(watch, []net.Listener{ln}, srv), certs, nil
+	}
+
+	_, port, _ := net.SplitHostPort(l.Addr)
+	rs := &http.Server{Addr: l.RedirectAddr, Handler: redirectToHTTPS(port)}
+	rln, err := net.Listen("tcp", l.RedirectAddr)
+	if err != nil {
+		log.Printf("[ERROR] Unable to redirect HTTP on %s to HTTPS: %s\n", l.RedirectAddr, err)
+		return shutdownFunc(watch, []net.Listener{ln}, srv), certs, nil
+	}
+	go func() {
+		if err := rs.Serve(rln); !errors.Is(err, net.ErrClosed) && err != http.ErrServerClosed {
+			log.Printf("[ERROR] Unable to redirect HTTP on %s to HTTPS: %s\n", l.RedirectAddr, err)
+		}
+	}()
+	return shutdownFunc(watch, []net.Listener{ln, rln}, srv, rs), certs, nil
+}
+
+// shutdownFunc closes the listeners straight away, so their ports can be
+// listened on again, then shuts the servers down in the background. watch is
+// closed to stop reloading their certificate.
+func shutdownFunc(watch chan bool, listeners []net.Listener, servers ...*http.Server) func() {
+	return func() {
+		if watch != nil {
+			close(watch)
+		}
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		// Let the request that moved the server finish.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for _, s := range servers {
+				// Event streams don't end on their own.
+				if s.Shutdown(ctx) != nil {
+					s.Close()
+				}
+			}
+		}()
+	}
 }
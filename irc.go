@@ -2,205 +2,369 @@ package main
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/thoj/go-ircevent"
 )
 
-func connectToTracker() {
-	log.Printf("Connection to %s:%d commencing.\n", tc.IRC.Server, tc.IRC.Port)
-	server := tc.IRC.Server + ":" + strconv.Itoa(tc.IRC.Port)
-	if err := ircClient.Connect(server); err != nil {
-		IRCConfigError <- err
+var (
+	// Time, in s, when the connection to each IRC server was established
+	ircConnectTimestamp = expvar.NewMap("irc_connect_timestamp")
+	// Time, in s, when each channel was last updated
+	ircUpdateTimestamp = expvar.NewMap("irc_last_update_timestamp")
+	// State of each IRC watcher, keyed by watcher name
+	ircStatus = expvar.NewMap("irc_status")
+	// Channel that is used to turn IRC watchers on and off.
+	IRCEnabled = make(chan IRCControl)
+	// Channel to signify that an IRC config has changed. The named watcher, or all
+	// of them when the name is empty, is restarted with the current config.
+	IRCConfigChanged = make(chan string)
+	// How long a watcher waits before connecting again after losing the server.
+	ircReconnectDelay = time.Minute
+	// Watchers that gave up on their own are sent here, so they can be
+	// started again.
+	ircFailed = make(chan *IRCWatcher)
+	// Set once StartIRC has started _TrackIRCStatus, which reads the channels
+	// above. Until then a config change has nobody to tell.
+	ircRunning atomic.Bool
+)
+
+// IRCControl turns the named IRC watcher on or off. An empty name applies to
+// every configured channel.
+type IRCControl struct {
+	Name    string
+	Enabled bool
+}
+
+// IRCWatcher holds the connection and state for a single announce channel.
+type IRCWatcher struct {
+	cfg            IRCChannel
+	client         *irc.Connection
+	announceLine   *regexp.Regexp
+	episodePattern *regexp.Regexp
+	errors         chan error
+	done           chan bool
+}
+
+func NewIRCWatcher(c IRCChannel) (*IRCWatcher, error) {
+	w := &IRCWatcher{
+		cfg:    c,
+		errors: make(chan error, 1),
+		done:   make(chan bool),
 	}
-	if ircClient.Connected() {
-		ircStatus.Set("Connected")
-		ircConnectTimestamp.Set(time.Now().Unix())
-		registerNick()
+	ar, err := url.QueryUnescape(c.AnnounceRegexp)
+	if err != nil {
+		return nil, err
+	}
+	if w.announceLine, err = regexp.Compile(ar); err != nil {
+		return nil, fmt.Errorf("%s: bad announce regex: %s", c.Name, err)
+	}
+	if c.EpisodeRegexp != "" {
+		if w.episodePattern, err = compileEpisodeRegex(c.EpisodeRegexp); err != nil {
+			return nil, fmt.Errorf("%s: bad episode regex: %s", c.Name, err)
+		}
+	}
+
+	w.client = irc.IRC(c.Nick, c.Nick)
+	w.cfg.Key = resolveSecret(c.Key)
+	w.client.Password = w.cfg.Key
+	w.client.PingFreq = time.Duration(c.PingFreq) * time.Minute
+
+	// Callbacks for various IRC events.
+	w.client.AddCallback("invite", w.handleInvite)
+	w.client.AddCallback("msg", w.msgToUser)
+	w.client.AddCallback("privmsg", w.msgToUser)
+
+	w.setStatus("Ready")
+	return w, nil
+}
+
+func (w *IRCWatcher) setStatus(s string) {
+	setIRCStatus(w.cfg.Name, s)
+}
+
+func setIRCStatus(name, s string) {
+	v := new(expvar.String)
+	v.Set(s)
+	ircStatus.Set(name, v)
+	connected := 0.0
+	if ircConnectedState(s) {
+		connected = 1
+	}
+	ircConnected.Set(connected, name)
+	publishEvent(EventIRCState, name, "", "%s", s)
+}
+
+func (w *IRCWatcher) setTimestamp(m *expvar.Map, ts int64) {
+	v := new(expvar.Int)
+	v.Set(ts)
+	m.Set(w.cfg.Name, v)
+}
+
+// Run connects to the tracker and keeps the watcher alive until Stop is
+// called or the connection reports a config error. A connection that fails
+// or drops is made again after ircReconnectDelay.
+func (w *IRCWatcher) Run() {
+	if err := w.connectToTracker(); err != nil {
+		w.disconnected(err)
+		if !w.reconnect() {
+			return
+		}
+	}
+	for {
+		select {
+		case err := <-w.errors:
+			w.fail(err)
+		case err := <-w.client.ErrorChan():
+			w.disconnected(err)
+			w.client.Disconnect()
+			if w.reconnect() {
+				continue
+			}
+		case <-w.done:
+			w.setStatus("Stopped")
+		}
+		if w.client.Connected() {
+			w.client.Quit()
+		}
+		return
+	}
+}
+
+func (w *IRCWatcher) disconnected(err error) {
+	log.Printf("IRC %s: disconnected: %s\n", w.cfg.Name, err)
+	w.setStatus(fmt.Sprintf("Disconnected: %s", err))
+	publishEvent(EventIRCDisconnect, w.cfg.Name, "", "%s", err)
+}
+
+// reconnect waits and connects again, until it works or the watcher is
+// stopped. It returns false once stopped.
+func (w *IRCWatcher) reconnect() bool {
+	for {
+		select {
+		case <-w.done:
+			w.setStatus("Stopped")
+			return false
+		case <-time.After(ircReconnectDelay):
+		}
+		err := w.connectToTracker()
+		if err == nil {
+			return true
+		}
+		log.Printf("IRC %s: reconnecting: %s\n", w.cfg.Name, err)
+	}
+}
+
+func (w *IRCWatcher) Stop() {
+	close(w.done)
+}
+
+// fail stops the watcher for good, and has _TrackIRCStatus forget it. It is
+// for errors reconnecting won't fix, like NickServ rejecting the key.
+func (w *IRCWatcher) fail(err error) {
+	log.Printf("IRC %s: %s\n", w.cfg.Name, err)
+	w.setStatus(fmt.Sprintf("Config Error: %s", err))
+	select {
+	case ircFailed <- w:
+	case <-w.done:
+	}
+}
+
+func (w *IRCWatcher) reportError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
+
+func (w *IRCWatcher) connectToTracker() error {
+	log.Printf("Connection to %s:%d commencing.\n", w.cfg.Server, w.cfg.Port)
+	server := w.cfg.Server + ":" + strconv.Itoa(w.cfg.Port)
+	if err := w.client.Connect(server); err != nil {
+		return err
+	}
+	if w.client.Connected() {
+		w.setStatus("Connected")
+		w.setTimestamp(ircConnectTimestamp, time.Now().Unix())
+		w.registerNick()
 		// give the server a chance to see the user before attempting to watch the IRC channel.
 		time.Sleep(5 * time.Second)
-		watchIRCChannel()
+		w.watchIRCChannel()
 	}
+	return nil
 }
 
-func watchIRCChannel() {
-	if tc.IRC.InviteCmd != "" {
-		invite := strings.Replace(tc.IRC.InviteCmd, "%n%", tc.IRC.Nick, -1)
-		invite = strings.Replace(invite, "%k%", tc.IRC.Key, -1)
-		PrintDebugf("Sending invite to %s: %s\n", tc.IRC.ChannelOwner, invite)
-		ircStatus.Set("Requesting Invite")
-		ircClient.Privmsgf(tc.IRC.ChannelOwner, invite)
+func (w *IRCWatcher) watchIRCChannel() {
+	if w.cfg.InviteCmd != "" {
+		invite := strings.Replace(w.cfg.InviteCmd, "%n%", w.cfg.Nick, -1)
+		invite = strings.Replace(invite, "%k%", w.cfg.Key, -1)
+		PrintDebugf("Sending invite to %s: %s\n", w.cfg.ChannelOwner, invite)
+		w.setStatus("Requesting Invite")
+		w.client.Privmsgf(w.cfg.ChannelOwner, invite)
 	} else {
-		if tc.IRC.WatchChannel != "" {
-			log.Printf("Joining channel %s", tc.IRC.WatchChannel)
-			ircClient.Join(tc.IRC.WatchChannel)
+		if w.cfg.WatchChannel != "" {
+			log.Printf("Joining channel %s", w.cfg.WatchChannel)
+			w.client.Join(w.cfg.WatchChannel)
+			w.setStatus("Watching Channel")
 		}
 	}
 }
 
-func registerNick() {
-	if tc.IRC.Nick == "" {
+func (w *IRCWatcher) registerNick() {
+	if w.cfg.Nick == "" {
 		PrintDebugln("No nickname set. IRC will not work properly.")
 		return
 	}
-	ircClient.Nick(tc.IRC.Nick)
-	if !tc.IRC.Registered {
-		ircClient.Privmsgf("nickserv", "register %s %s", tc.IRC.Key, tc.Operations.Email)
+	w.client.Nick(w.cfg.Nick)
+	if !w.cfg.Registered {
+		w.client.Privmsgf("nickserv", "register %s %s", w.cfg.Key, currentConfig().Operations.Email)
 	}
-	if ircClient.Connected() && tc.IRC.Registered {
+	if w.client.Connected() && w.cfg.Registered {
 		PrintDebugln("identifying to nickserv")
-		ircClient.Privmsgf("nickserv", "identify %s", tc.IRC.Key)
+		w.client.Privmsgf("nickserv", "identify %s", w.cfg.Key)
 	}
 }
 
-func msgToUser(e *irc.Event) {
+func (w *IRCWatcher) msgToUser(e *irc.Event) {
 	PrintDebugf("msgToUser: %s", e.Message())
 	msg := e.Message()
 	if e.User == "NickServ" {
 		if strings.Contains(msg, "isn't") || strings.Contains(msg, "incorrect") {
-			IRCConfigError <- errors.New(msg)
+			w.reportError(errors.New(msg))
 		} else if strings.Contains(msg, "registered") {
-			ircStatus.Set("Nick Ready")
+			w.setStatus("Nick Ready")
 		} else if strings.Contains(msg, "assword") {
-			ircStatus.Set("Nick Registered")
+			w.setStatus("Nick Registered")
 		}
 	} else {
 		PrintDebugf("msgToUser: checking message for show announcement.")
-		go matchAnnounce(e)
+		go w.matchAnnounce(e.Message())
 	}
 }
 
-func matchAnnounce(e *irc.Event) {
-	PrintDebugf("matchAnnounce: %s\n", e.Message())
-	metricUpdate <- time.Now().Unix()
-	aMatch := announceLine.FindStringSubmatch(e.Message())
-	if aMatch != nil {
+func (w *IRCWatcher) matchAnnounce(msg string) {
+	PrintDebugf("matchAnnounce: %s\n", msg)
+	w.setTimestamp(ircUpdateTimestamp, time.Now().Unix())
+	aMatch := w.announceLine.FindStringSubmatch(msg)
+	if aMatch != nil && len(aMatch) > 2 {
 		PrintDebugln("matchAnnounce: IRC message is a valid announce line.")
-		ep, err := ParseTorrentString(aMatch[1])
-		if err != nil {
-			PrintDebugf("Error parsing string: %s\n", err)
-			return
-		}
-    isNew := ep.IsNewEpisode()
-    if !isNew {
-      PrintDebugln("We already have this episode.")
-      return
-    }
-    if !ep.ValidEpisodeQuality(aMatch[1]) {
-      PrintDebugf("Episode %s isn't the right quality.\n", aMatch[1])
-      return
-    }
-
-    ff, err := NewFileFetch(aMatch[2])
-    if err != nil {
-      log.Println(err)
-    }
-    err = ff.RetrieveEpisode()
-    if err != nil {
-      log.Printf("FAIL: episode not retrieved: %s\n", err)
-    }
-
-	  err = ep.AddEpisode()
-		if err != nil {
-			log.Printf("Episode is downloading, but didn't update the db: %s\n", err)
+		if err := ProcessRelease(w.cfg.Name, aMatch[1], aMatch[2], w.episodePattern); err != nil {
+			log.Println(err)
 		}
 	}
 }
 
-func handleInvite(e *irc.Event) {
+func (w *IRCWatcher) handleInvite(e *irc.Event) {
 	PrintDebugf("handleInvite: %s\n", e.Message())
-	if tc.IRC.WatchChannel == "" {
+	if w.cfg.WatchChannel == "" {
 		log.Println("Ignoring invite event because no channels are tracked.")
 		return
 	}
 	PrintDebugf("Handling IRC invite event: %s", e.Message())
 	c := e.Connection
-	if strings.Index(e.Message(), tc.IRC.WatchChannel) != -1 {
+	if strings.Index(e.Message(), w.cfg.WatchChannel) != -1 {
 		PrintDebugln("IRC channel invitation successful. Joining Now.")
-		c.Join(tc.IRC.WatchChannel)
-		ircStatus.Set("Watching Channel")
+		c.Join(w.cfg.WatchChannel)
+		w.setStatus("Watching Channel")
 		if c.Log != nil {
-			c.Log.SetPrefix(tc.IRC.WatchChannel + ": ")
+			c.Log.SetPrefix(w.cfg.WatchChannel + ": ")
 		}
 	}
 }
 
-func _InitIRC() {
-	ircClient = irc.IRC(tc.IRC.Nick, tc.IRC.Nick)
+// ircWatchers owns every running IRC watcher. Only _TrackIRCStatus touches it.
+var ircWatchers = map[string]*IRCWatcher{}
+
+func startIRCWatcher(name string) {
+	if _, ok := ircWatchers[name]; ok {
+		return
+	}
+	c, ok := currentConfig().IRC.Get(name)
+	if !ok {
+		log.Printf("No IRC channel named %s is configured.\n", name)
+		return
+	}
+	w, err := NewIRCWatcher(c)
+	if err != nil {
+		log.Println(err)
+		setIRCStatus(name, fmt.Sprintf("Config Error: %s", err))
+		return
+	}
+	ircWatchers[name] = w
+	go w.Run()
+}
 
-	ircClient.Password = tc.IRC.Key
-	ircClient.PingFreq = time.Duration(tc.IRC.PingFreq) * time.Minute
+// forgetIRCWatcher drops w, which failed, unless it was already replaced.
+func forgetIRCWatcher(w *IRCWatcher) {
+	if ircWatchers[w.cfg.Name] == w {
+		delete(ircWatchers, w.cfg.Name)
+	}
+}
 
-	// Callbacks for various IRC events.
-	ircClient.AddCallback("invite", handleInvite)
-	ircClient.AddCallback("msg", matchAnnounce)
-	ircClient.AddCallback("privmsg", matchAnnounce)
+func stopIRCWatcher(name string) {
+	if w, ok := ircWatchers[name]; ok {
+		w.Stop()
+		delete(ircWatchers, name)
+	}
+}
 
-	ar, _ := url.QueryUnescape(tc.IRC.AnnounceRegexp)
-	announceLine = regexp.MustCompile(ar)
-	ircStatus.Set("Ready")
+// ircNames expands an empty name into every configured channel name.
+func ircNames(name string) []string {
+	if name != "" {
+		return []string{name}
+	}
+	tc := currentConfig()
+	names := []string{}
+	for _, c := range tc.IRC {
+		names = append(names, c.Name)
+	}
+	// Watchers that were removed from the config still need to be stopped.
+	for n := range ircWatchers {
+		if _, ok := tc.IRC.Get(n); !ok {
+			names = append(names, n)
+		}
+	}
+	return names
 }
 
 func _TrackIRCStatus() {
 	for {
 		select {
-		// Turn on and off the IRC service.
-		case e := <-IRCEnabled:
-			if e && ircClient == nil {
-				_InitIRC()
-				if ircClient == nil {
-					IRCConfigError <- errors.New("IRC Configuration Issues. Not Connected.")
+		// Turn on and off IRC watchers.
+		case ctl := <-IRCEnabled:
+			for _, n := range ircNames(ctl.Name) {
+				if ctl.Enabled {
+					startIRCWatcher(n)
+				} else {
+					stopIRCWatcher(n)
 				}
-			} else if e && ircClient != nil && !ircClient.Connected() {
-				connectToTracker()
-			} else if !e && ircClient.Connected() {
-				ircClient.Disconnect()
 			}
-		// Update the IRC configuration.
-		case cfg := <-IRCConfigChanged:
-			if cfg {
-				if ircClient != nil {
-					ircClient.Disconnect()
+		// Forget watchers that failed, so they can be started again.
+		case w := <-ircFailed:
+			forgetIRCWatcher(w)
+		// Restart IRC watchers with the updated configuration.
+		case name := <-IRCConfigChanged:
+			for _, n := range ircNames(name) {
+				stopIRCWatcher(n)
+				tc := currentConfig()
+				if _, ok := tc.IRC.Get(n); ok && tc.Operations.WatchMethods["irc"] {
+					startIRCWatcher(n)
 				}
-				if tc.Operations.WatchMethods["irc"] {
-					_InitIRC()
-					if ircClient == nil {
-						IRCConfigError <- errors.New("IRC Configuration Issues. Not Connected.")
-					}
-					connectToTracker()
-				}
-			}
-		// Updates the lastest timestamp metric.
-		case ts := <-metricUpdate:
-			last, _ := strconv.Atoi(ircUpdateTimestamp.String())
-			if ts > int64(last) {
-				ircUpdateTimestamp.Set(ts)
 			}
-		case err := <-IRCConfigError:
-			if err == nil {
-				continue
-			}
-			log.Println(err)
-			ircStatus.Set(fmt.Sprintf("Config Error: %s\n", err))
-			ircClient.Disconnect()
-			return
 		}
 	}
 }
 
 func StartIRC() {
-	_InitIRC()
-	connectToTracker()
-
 	go _TrackIRCStatus()
-	IRCEnabled <- tc.Operations.WatchMethods["irc"]
-	IRCConfigChanged <- false
-	IRCConfigError <- nil
-	metricUpdate <- 0
+	ircRunning.Store(true)
+	IRCEnabled <- IRCControl{Enabled: currentConfig().Operations.WatchMethods["irc"]}
 }
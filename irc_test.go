@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedIRCWatcherRestarts(t *testing.T) {
+	defer func(d time.Duration) { ircReconnectDelay = d }(ircReconnectDelay)
+	ircReconnectDelay = 10 * time.Millisecond
+	// Nothing listens on the port yet, so connecting fails and is tried again.
+	port := freePort(t)
+	useTestConfig(t, func(c *TrackerConfig) {
+		p, _ := strconv.Atoi(port)
+		c.IRC = IRCChannels{{Name: "failing", Server: "127.0.0.1", Port: p,
+			AnnounceRegexp: `(.*) - (.*)`}}
+	})
+
+	startIRCWatcher("failing")
+	w := ircWatchers["failing"]
+	require.NotNil(t, w)
+	select {
+	case <-ircFailed:
+		t.Fatal("The IRC watcher gave up on a failed connection.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer l.Close()
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	c, err := l.Accept()
+	require.NoError(t, err, "The IRC watcher didn't connect again.")
+	c.Close()
+
+	// Errors like NickServ rejecting the key stop it for good.
+	w.reportError(errors.New("Password incorrect."))
+	select {
+	case f := <-ircFailed:
+		assert.True(t, f == w)
+		forgetIRCWatcher(f)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The IRC watcher didn't fail.")
+	}
+	assert.NotContains(t, ircWatchers, "failing")
+
+	startIRCWatcher("failing")
+	require.Contains(t, ircWatchers, "failing")
+	assert.False(t, ircWatchers["failing"] == w)
+	stopIRCWatcher("failing")
+}
@@ -0,0 +1,151 @@
+/* Tracker Politeness
+ *
+ * Every request for a torrent goes through a limiter for its host, so a burst
+ * of announces doesn't turn into a burst of downloads that gets the account
+ * banned. Each host has a token bucket refilled at Download.Rate requests a
+ * minute, requests are at least Download.Gap seconds apart, and a 429 or 503
+ * from the host holds everything back until its Retry-After. A random start
+ * delay of up to Download.Jitter seconds keeps gumshoe from asking at the
+ * same instant as every other bot in the channel.
+ */
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// How long a host is left alone after a 429 or 503 without a Retry-After.
+	throttlePause = time.Minute
+	// Limits for every host torrents are fetched from.
+	trackerLimits = newHostLimiter()
+)
+
+// ThrottledError is a fetch the host turned away until Until.
+type ThrottledError struct {
+	Err   error
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return e.Err.Error()
+}
+
+type hostState struct {
+	tokens float64
+	filled time.Time // when tokens was last topped up
+	next   time.Time // the earliest the next request may start
+}
+
+type hostLimiter struct {
+	lock  sync.Mutex
+	hosts map[string]*hostState
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{hosts: map[string]*hostState{}}
+}
+
+// host is the state for host. A new one fills its bucket the first time
+// it's used.
+func (l *hostLimiter) host(host string) *hostState {
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostState{}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// reserve takes the next request slot for host and returns how long after
+// now it starts. rate is requests a minute, 0 for no limit, burst how many
+// may go at once after a quiet spell, and gap the least time between two.
+func (l *hostLimiter) reserve(host string, now time.Time, rate, burst int, gap time.Duration) time.Duration {
+	if burst < 1 {
+		burst = 1
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	h := l.host(host)
+	at := now
+	if rate > 0 {
+		perToken := time.Minute / time.Duration(rate)
+		h.tokens += float64(now.Sub(h.filled)) / float64(perToken)
+		if h.tokens > float64(burst) {
+			h.tokens = float64(burst)
+		}
+		h.filled = now
+		if h.tokens < 1 {
+			at = now.Add(time.Duration((1 - h.tokens) * float64(perToken)))
+		}
+		// Spent now, even though it's waited for, so the requests behind
+		// this one queue up after it.
+		h.tokens--
+	}
+	if at.Before(h.next) {
+		at = h.next
+	}
+	h.next = at.Add(gap)
+	return at.Sub(now)
+}
+
+// pause holds back requests to host until until.
+func (l *hostLimiter) pause(host string, until time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	h := l.host(host)
+	if h.next.Before(until) {
+		h.next = until
+	}
+}
+
+// wait sleeps through the start delay and until host may be asked again.
+func (l *hostLimiter) wait(host string) {
+	tc := currentConfig()
+	d := time.Duration(0)
+	if j := tc.Download.Jitter; j > 0 {
+		d = time.Duration(rand.Int63n(int64(time.Duration(j) * time.Second)))
+	}
+	d += l.reserve(host, time.Now().Add(d), tc.Download.Rate, tc.Download.Burst,
+		time.Duration(tc.Download.Gap)*time.Second)
+	if d > 0 {
+		PrintDebugf("Waiting %s to fetch from %s.\n", d.Round(time.Millisecond), host)
+		time.Sleep(d)
+	}
+}
+
+// throttled reports whether resp turns the request away for a while, and
+// until when. Retry-After is either seconds or an HTTP date.
+func throttled(resp *http.Response, now time.Time) (time.Time, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return time.Time{}, false
+	}
+	ra := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if s, err := strconv.Atoi(ra); err == nil && s >= 0 {
+		return now.Add(time.Duration(s) * time.Second), true
+	}
+	if t, err := http.ParseTime(ra); err == nil {
+		return t, true
+	}
+	return now.Add(throttlePause), true
+}
+
+// checkThrottled pauses ff's host when resp turns it away and returns the
+// error for it, nil when it doesn't.
+func (ff *FileFetch) checkThrottled(resp *http.Response) error {
+	until, ok := throttled(resp, time.Now())
+	if !ok {
+		return nil
+	}
+	trackerLimits.pause(ff.Url.Host, until)
+	return &ThrottledError{
+		Err:   fmt.Errorf("Fetch of %s returned %s", ff.Url, resp.Status),
+		Until: until,
+	}
+}
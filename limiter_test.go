@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostLimiter(t *testing.T) {
+	l := newHostLimiter()
+	now := time.Date(2015, 3, 26, 20, 0, 0, 0, time.UTC)
+
+	// 30 a minute, two at once: the third waits for a token.
+	assert.Equal(t, time.Duration(0), l.reserve("a", now, 30, 2, 0))
+	assert.Equal(t, time.Duration(0), l.reserve("a", now, 30, 2, 0))
+	assert.Equal(t, 2*time.Second, l.reserve("a", now, 30, 2, 0))
+	assert.Equal(t, 4*time.Second, l.reserve("a", now, 30, 2, 0))
+	// Other hosts have their own bucket.
+	assert.Equal(t, time.Duration(0), l.reserve("b", now, 30, 2, 0))
+	// After a quiet spell it's full again, but no more than burst.
+	later := now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), l.reserve("a", later, 30, 2, 0))
+	assert.Equal(t, time.Duration(0), l.reserve("a", later, 30, 2, 0))
+	assert.Equal(t, 2*time.Second, l.reserve("a", later, 30, 2, 0))
+
+	// The gap holds even without a rate.
+	assert.Equal(t, time.Duration(0), l.reserve("c", now, 0, 0, 5*time.Second))
+	assert.Equal(t, 4*time.Second, l.reserve("c", now.Add(time.Second), 0, 0, 5*time.Second))
+	assert.Equal(t, time.Duration(0), l.reserve("c", now.Add(time.Minute), 0, 0, 5*time.Second))
+
+	l.pause("c", now.Add(2*time.Minute))
+	assert.Equal(t, time.Minute, l.reserve("c", now.Add(time.Minute), 0, 0, 0))
+	l.pause("d", now.Add(time.Minute))
+	assert.Equal(t, time.Minute, l.reserve("d", now, 30, 1, 0))
+}
+
+func TestThrottled(t *testing.T) {
+	now := time.Date(2015, 3, 26, 20, 0, 0, 0, time.UTC)
+	resp := func(status int, retry string) *http.Response {
+		r := &http.Response{StatusCode: status, Header: http.Header{}}
+		if retry != "" {
+			r.Header.Set("Retry-After", retry)
+		}
+		return r
+	}
+	_, ok := throttled(resp(http.StatusNotFound, "120"), now)
+	assert.False(t, ok)
+	until, ok := throttled(resp(http.StatusTooManyRequests, "120"), now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(2*time.Minute), until)
+	until, _ = throttled(resp(http.StatusServiceUnavailable, "Thu, 26 Mar 2015 20:05:00 GMT"), now)
+	assert.Equal(t, now.Add(5*time.Minute), until.UTC())
+	until, _ = throttled(resp(http.StatusServiceUnavailable, "soon"), now)
+	assert.Equal(t, now.Add(throttlePause), until)
+}
+
+func TestFetchThrottled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	useTestConfig(t, func(c *TrackerConfig) {
+		c.Directories["user_dir"] = pwd
+		c.Directories["torrent_dir"] = "test_data"
+		c.Download.MaxRetries = 3
+	})
+	defer func() {
+		os.Remove(filepath.Join(pwd, "test_data", "throttled.test.torrent"))
+	}()
+
+	q, err := Enqueue(ts.URL+"/download.php/1/throttled.test.torrent", "", nil)
+	assert.NoError(t, err)
+	q.process()
+	assert.Equal(t, QueuePending, q.State)
+	assert.Contains(t, q.LastError, "429")
+	// The retry waits for the tracker, not the usual backoff.
+	assert.True(t, q.NextTry >= time.Now().Add(59*time.Minute).Unix())
+
+	// Everything else for that host waits too.
+	u := ts.Listener.Addr().String()
+	assert.True(t, trackerLimits.reserve(u, time.Now(), 0, 0, 0) > 59*time.Minute)
+}
+
+func TestDownloadValidation(t *testing.T) {
+	c := &TrackerConfig{Download: Download{Rate: -1, Burst: 2, Gap: -1, Jitter: -1}}
+	verr := c.Validate().(ValidationErrors)
+	fields := []string{}
+	for _, e := range verr {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{"download_params.download_rate", "download_params.request_gap", "download_params.start_jitter"}, fields)
+}
@@ -0,0 +1,240 @@
+/* Show Metadata
+ *
+ * Looks shows up with an online TV database when they are added. The show's
+ * canonical title and aliases are stored, and every episode the database
+ * knows about is added to the episode table as a wanted episode.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultTVmazeURL = "https://api.tvmaze.com"
+
+var metadataProvider MetadataProvider
+
+type ShowInfo struct {
+	ID      uint64   `json:"id"`
+	TvDbId  uint64   `json:"tvdbid"`
+	Title   string   `json:"title"`
+	Aliases []string `json:"aliases"`
+	// Talk and news shows are released by air date instead of episode number.
+	Daily bool `json:"daily"`
+}
+
+type EpisodeInfo struct {
+	Season  int     `json:"season"`
+	Episode int     `json:"episode"`
+	Title   string  `json:"title"`
+	AirDate AirDate `json:"airdate"`
+}
+
+// MetadataProvider is a TV database that gumshoe can look shows up in. IDs
+// are the provider's own.
+type MetadataProvider interface {
+	SearchShow(title string) (*ShowInfo, error)
+	Episodes(id uint64) ([]EpisodeInfo, error)
+}
+
+// NewMetadataProvider picks the provider from the config. It returns nil when
+// none is configured.
+func NewMetadataProvider(m Metadata) MetadataProvider {
+	switch strings.ToLower(m.Provider) {
+	case "tvmaze":
+		return NewTVmaze(m.URL)
+	case "":
+		return nil
+	}
+	log.Printf("[ERROR] Unknown metadata provider %s.\n", m.Provider)
+	return nil
+}
+
+func SetMetadataProvider() {
+	metadataProvider = NewMetadataProvider(currentConfig().Metadata)
+}
+
+// TVmaze is the TVmaze API, which needs no API key.
+type TVmaze struct {
+	URL        string
+	HttpClient *http.Client
+}
+
+func NewTVmaze(u string) *TVmaze {
+	if u == "" {
+		u = defaultTVmazeURL
+	}
+	return &TVmaze{
+		URL:        strings.TrimRight(u, "/"),
+		HttpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type tvmazeShow struct {
+	ID        uint64 `json:"id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Externals struct {
+		TheTVDB uint64 `json:"thetvdb"`
+	} `json:"externals"`
+	Embedded struct {
+		Akas []struct {
+			Name string `json:"name"`
+		} `json:"akas"`
+	} `json:"_embedded"`
+}
+
+type tvmazeEpisode struct {
+	Name    string `json:"name"`
+	Season  int    `json:"season"`
+	Number  *int   `json:"number"`
+	Airdate string `json:"airdate"`
+}
+
+func (t *TVmaze) get(path string, q url.Values, v interface{}) error {
+	u := t.URL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	resp, err := t.HttpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoMetadata
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("TVmaze returned %s for %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+var errNoMetadata = errors.New("The show was not found.")
+
+func (t *TVmaze) SearchShow(title string) (*ShowInfo, error) {
+	s := tvmazeShow{}
+	q := url.Values{"q": {title}, "embed": {"akas"}}
+	if err := t.get("/singlesearch/shows", q, &s); err != nil {
+		return nil, err
+	}
+	info := &ShowInfo{
+		ID:     s.ID,
+		TvDbId: s.Externals.TheTVDB,
+		Title:  s.Name,
+		Daily:  s.Type == "Talk Show" || s.Type == "News",
+	}
+	for _, a := range s.Embedded.Akas {
+		info.Aliases = append(info.Aliases, a.Name)
+	}
+	return info, nil
+}
+
+func (t *TVmaze) Episodes(id uint64) ([]EpisodeInfo, error) {
+	eps := []tvmazeEpisode{}
+	if err := t.get(fmt.Sprintf("/shows/%d/episodes", id), nil, &eps); err != nil {
+		return nil, err
+	}
+	out := []EpisodeInfo{}
+	for _, e := range eps {
+		// Specials have no episode number.
+		if e.Number == nil {
+			continue
+		}
+		ei := EpisodeInfo{Season: e.Season, Episode: *e.Number, Title: e.Name}
+		if d, err := time.Parse("2006-01-02", e.Airdate); err == nil {
+			ei.AirDate = NewAirDate(d.Date())
+		}
+		out = append(out, ei)
+	}
+	return out, nil
+}
+
+// lookupShowMetadata fills in the show's IDs and canonical title from the
+// metadata provider.
+func (s *Show) lookupShowMetadata(p MetadataProvider) (*ShowInfo, error) {
+	info, err := p.SearchShow(s.Title)
+	if err != nil {
+		return nil, err
+	}
+	s.MetadataID = info.ID
+	s.TvDbId = info.TvDbId
+	s.CanonicalTitle = info.Title
+	return info, nil
+}
+
+// seedWantedEpisodes adds every episode the provider lists for the show that
+// isn't in the episode table yet. Episodes the show's settings skip are added
+// as skipped. It returns how many were added.
+func (s *Show) seedWantedEpisodes(p MetadataProvider) (int, error) {
+	if s.MetadataID == 0 {
+		return 0, errors.New("The show has no metadata ID.")
+	}
+	eps, err := p.Episodes(s.MetadataID)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, ei := range eps {
+		e := &Episode{
+			ShowID:  s.ID,
+			Season:  ei.Season,
+			Episode: ei.Episode,
+			AirDate: ei.AirDate,
+			Title:   ei.Title,
+			State:   EpisodeWanted,
+		}
+		if !s.Episodal {
+			// Daily shows are kept by air date.
+			if e.AirDate.IsZero() {
+				continue
+			}
+			e.Season, e.Episode = 0, 0
+		}
+		if s.Skips(e) != "" {
+			e.State = EpisodeSkipped
+		}
+		if _, err := e.findExisting(); err == nil {
+			continue
+		}
+		checkDBLock <- 1
+		err = gDb.Insert(e)
+		<-checkDBLock
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+// RefreshShowMetadata looks the show up if it hasn't been yet, and adds any
+// newly listed episodes as wanted.
+func (s *Show) RefreshShowMetadata() error {
+	p := metadataProvider
+	if p == nil {
+		return errors.New("No metadata provider is configured.")
+	}
+	if s.MetadataID == 0 {
+		info, err := s.lookupShowMetadata(p)
+		if err != nil {
+			return err
+		}
+		if err = s.UpdateShow(); err != nil {
+			return err
+		}
+		if err = s.addAliases(info.Aliases); err != nil {
+			return err
+		}
+	}
+	n, err := s.seedWantedEpisodes(p)
+	PrintDebugf("Added %d wanted episodes of %s.\n", n, s.Title)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tvmazeServer serves the recorded TVmaze responses in test_data/tvmaze.
+func tvmazeServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/singlesearch/shows":
+			if strings.EqualFold(r.URL.Query().Get("q"), "no such show") {
+				http.NotFound(w, r)
+				return
+			}
+			assert.Equal(t, "akas", r.URL.Query().Get("embed"))
+			http.ServeFile(w, r, filepath.Join(pwd, "test_data", "tvmaze", "singlesearch.json"))
+		case "/shows/31/episodes":
+			http.ServeFile(w, r, filepath.Join(pwd, "test_data", "tvmaze", "episodes.json"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestTVmaze(t *testing.T) {
+	ts := tvmazeServer(t)
+	defer ts.Close()
+	p := NewTVmaze(ts.URL)
+
+	info, err := p.SearchShow("agents of shield")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(31), info.ID)
+	assert.Equal(t, uint64(263365), info.TvDbId)
+	assert.Equal(t, "Marvel's Agents of S.H.I.E.L.D.", info.Title)
+	assert.Contains(t, info.Aliases, "Agents of S.H.I.E.L.D.")
+	assert.False(t, info.Daily)
+
+	_, err = p.SearchShow("no such show")
+	assert.Equal(t, errNoMetadata, err)
+
+	eps, err := p.Episodes(31)
+	assert.NoError(t, err)
+	// The special has no episode number and is skipped.
+	assert.Len(t, eps, 4)
+	assert.Equal(t, EpisodeInfo{Season: 1, Episode: 1, Title: "Pilot", AirDate: NewAirDate(2013, time.September, 24)}, eps[0])
+}
+
+func TestAddShowWithMetadata(t *testing.T) {
+	ts := tvmazeServer(t)
+	defer ts.Close()
+	old := metadataProvider
+	metadataProvider = NewTVmaze(ts.URL)
+	defer func() { metadataProvider = old }()
+
+	s := newShow("agents of shield", "720p", true)
+	assert.NoError(t, s.AddShow())
+	defer s.DeleteShow()
+	assert.Equal(t, uint64(31), s.MetadataID)
+	assert.Equal(t, uint64(263365), s.TvDbId)
+	assert.Equal(t, "Marvel's Agents of S.H.I.E.L.D.", s.CanonicalTitle)
+	assert.Equal(t, "Agents Of Shield", s.Title)
+
+	aliases, err := GetAliases(s.ID)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, a := range aliases {
+		names = append(names, a.Alias)
+	}
+	assert.Contains(t, names, "Marvel's Agents of S.H.I.E.L.D.")
+	assert.Contains(t, names, "Marvel's Agents of SHIELD")
+
+	eps, err := GetEpisodesByShowID(s.ID)
+	assert.NoError(t, err)
+	assert.Len(t, *eps, 4)
+	for _, e := range *eps {
+		assert.Equal(t, EpisodeWanted, e.State)
+	}
+
+	// A wanted episode is still new, and recording it marks it downloaded.
+	e := &Episode{ShowID: s.ID, Season: 1, Episode: 2, Quality: "720p"}
+	assert.True(t, e.IsNewEpisode())
+	assert.False(t, e.IsUpgrade())
+	assert.NoError(t, e.RecordEpisode())
+	assert.Equal(t, EpisodeDownloaded, e.State)
+	assert.Equal(t, "2013.10.01", e.AirDate.String())
+	assert.False(t, e.IsNewEpisode())
+
+	// Refreshing doesn't add the same episodes twice.
+	assert.NoError(t, s.RefreshShowMetadata())
+	eps, _ = GetEpisodesByShowID(s.ID)
+	assert.Len(t, *eps, 4)
+
+	// Shows the provider doesn't know are still added.
+	u := newShow("no such show", "720p", true)
+	assert.NoError(t, u.AddShow())
+	assert.Equal(t, uint64(0), u.MetadataID)
+	u.DeleteShow()
+}
@@ -0,0 +1,269 @@
+/* Metrics
+ *
+ * /metrics serves counters, gauges and histograms in the Prometheus text
+ * format, next to the expvar JSON on /vars. Everything to do with a release
+ * is labeled with the watcher it came from: the IRC watcher's name, "rss",
+ * "backlog", "review" or "api".
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Why an announce was turned down, as a metric label.
+const (
+	rejectReview    = "review"
+	rejectUnmatched = "unmatched"
+	rejectNotWanted = "not_wanted"
+	rejectQuality   = "quality"
+)
+
+var (
+	announcesSeen     = newCounter("gumshoe_announces_total", "Releases announced to a watcher.", "watcher")
+	announcesMatched  = newCounter("gumshoe_announces_matched_total", "Announced releases that were queued.", "watcher")
+	announcesRejected = newCounter("gumshoe_announces_rejected_total", "Announced releases that weren't queued, by why.", "watcher", "reason")
+	fetchesTotal      = newCounter("gumshoe_fetches_total", "Torrent fetches, by HTTP status or \"error\".", "watcher", "status")
+	fetchDuration     = newHistogram("gumshoe_fetch_duration_seconds", "How long torrent fetches took.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "watcher")
+	queueDepth    = newGauge("gumshoe_queue_depth", "Items waiting in or being fetched from the download queue.", "watcher", "state")
+	ircConnected  = newGauge("gumshoe_irc_connected", "1 while an IRC watcher is connected to its server.", "watcher")
+	grabsTotal    = newCounter("gumshoe_grabs_total", "Releases handed to the torrent client, by show.", "watcher", "show")
+	lastFetchTime = newGauge("gumshoe_last_fetch_timestamp_seconds", "When a torrent was last fetched.")
+
+	allMetrics = []metricWriter{
+		announcesSeen, announcesMatched, announcesRejected,
+		fetchesTotal, fetchDuration, queueDepth, grabsTotal, lastFetchTime, ircConnected,
+	}
+)
+
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats label names and the values in key as {a="1",b="2"},
+// with extra pairs added on the end.
+func labelString(names []string, key string, extra ...string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], quoteLabel(v)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], quoteLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricVec is a counter or gauge with a value for each set of labels.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, values: map[string]float64{}}
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "gauge", labels: labels, values: map[string]float64{}}
+}
+
+func (m *metricVec) checkLabels(values []string) {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("%s takes %d labels, got %d", m.name, len(m.labels), len(values)))
+	}
+}
+
+func (m *metricVec) Add(v float64, labels ...string) {
+	m.checkLabels(labels)
+	m.lock.Lock()
+	m.values[labelKey(labels)] += v
+	m.lock.Unlock()
+}
+
+func (m *metricVec) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+func (m *metricVec) Set(v float64, labels ...string) {
+	m.checkLabels(labels)
+	m.lock.Lock()
+	m.values[labelKey(labels)] = v
+	m.lock.Unlock()
+}
+
+// Get is the value for labels, 0 if it was never set.
+func (m *metricVec) Get(labels ...string) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.values[labelKey(labels)]
+}
+
+// Reset forgets every value, for gauges that are filled in again each time.
+func (m *metricVec) Reset() {
+	m.lock.Lock()
+	m.values = map[string]float64{}
+	m.lock.Unlock()
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, k), formatFloat(m.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// histogramVec counts observations into buckets, for each set of labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) Observe(v float64, labels ...string) {
+	if len(labels) != len(h.labels) {
+		panic(fmt.Sprintf("%s takes %d labels, got %d", h.name, len(h.labels), len(labels)))
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	k := labelKey(labels)
+	o, ok := h.values[k]
+	if !ok {
+		o = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = o
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		o.counts[i]++
+	}
+	o.sum += v
+	o.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o := h.values[k]
+		var n uint64
+		for i, b := range h.buckets {
+			n += o.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, "le", formatFloat(b)), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, "le", "+Inf"), o.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, k), formatFloat(o.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, k), o.count)
+	}
+}
+
+// observeFetch records a fetch that got HTTP status, 0 when there was no
+// response at all.
+func observeFetch(watcher string, status int, took time.Duration) {
+	s := "error"
+	if status != 0 {
+		s = strconv.Itoa(status)
+	}
+	fetchesTotal.Inc(watcher, s)
+	fetchDuration.Observe(took.Seconds(), watcher)
+}
+
+// ircConnectedState reports whether an IRC watcher with status s is
+// connected to its server.
+func ircConnectedState(s string) bool {
+	switch s {
+	case "Connected", "Requesting Invite", "Watching Channel", "Nick Ready", "Nick Registered":
+		return true
+	}
+	return false
+}
+
+// updateQueueDepth counts what is in the download queue right now.
+func updateQueueDepth() error {
+	queueDepth.Reset()
+	for _, state := range []string{QueuePending, QueueFetching} {
+		items, err := ListQueue(state)
+		if err != nil {
+			return err
+		}
+		// Always there, so an empty queue reads 0 rather than nothing.
+		queueDepth.Set(0, "", state)
+		for _, q := range items {
+			queueDepth.Add(1, q.Watcher, state)
+		}
+	}
+	return nil
+}
+
+// getMetrics serves every metric in the Prometheus text format.
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	if err := updateQueueDepth(); err != nil {
+		writeAPIError(w, toAPIError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range allMetrics {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricFormat(t *testing.T) {
+	c := newCounter("test_total", "A test.", "watcher", "show")
+	c.Inc("irc", `The "Show"`)
+	c.Add(2, "irc", `The "Show"`)
+	c.Inc("rss", "a\\b")
+	b := &bytes.Buffer{}
+	c.writeTo(b)
+	assert.Equal(t, `# HELP test_total A test.
+# TYPE test_total counter
+test_total{watcher="irc",show="The \"Show\""} 3
+test_total{watcher="rss",show="a\\b"} 1
+`, b.String())
+
+	g := newGauge("test_gauge", "No labels.")
+	g.Set(1.5)
+	b.Reset()
+	g.writeTo(b)
+	assert.Contains(t, b.String(), "\ntest_gauge 1.5\n")
+
+	h := newHistogram("test_seconds", "Took.", []float64{0.5, 1}, "watcher")
+	for _, v := range []float64{0.2, 0.7, 0.9, 3} {
+		h.Observe(v, "rss")
+	}
+	b.Reset()
+	h.writeTo(b)
+	assert.Equal(t, `# HELP test_seconds Took.
+# TYPE test_seconds histogram
+test_seconds_bucket{watcher="rss",le="0.5"} 1
+test_seconds_bucket{watcher="rss",le="1"} 3
+test_seconds_bucket{watcher="rss",le="+Inf"} 4
+test_seconds_sum{watcher="rss"} 4.8
+test_seconds_count{watcher="rss"} 4
+`, b.String())
+}
+
+func TestFetchMetrics(t *testing.T) {
+	fails := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "fake torrent")
+	}))
+	defer ts.Close()
+
+	useTestConfig(t, func(c *TrackerConfig) {
+		c.Directories["user_dir"] = pwd
+		c.Directories["torrent_dir"] = "test_data"
+		c.Download.MaxRetries = 3
+		c.Download.Rate = 0
+	})
+	pause := throttlePause
+	throttlePause = 0
+	defer func() {
+		throttlePause = pause
+		os.Remove(filepath.Join(pwd, "test_data", "metrics.test.torrent"))
+	}()
+
+	q, err := EnqueueEpisodes("metrics", ts.URL+"/download.php/1/metrics.test.torrent", "", nil, false)
+	assert.NoError(t, err)
+	w := apiRequest("GET", "/metrics", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `gumshoe_queue_depth{watcher="metrics",state="pending"} 1`)
+
+	q.process()
+	fails = false
+	q.process()
+	assert.Equal(t, QueueDone, q.State)
+	assert.Equal(t, 1.0, fetchesTotal.Get("metrics", "503"))
+	assert.Equal(t, 1.0, fetchesTotal.Get("metrics", "200"))
+
+	w = apiRequest("GET", "/metrics", "")
+	assert.Contains(t, w.Body.String(), `gumshoe_fetch_duration_seconds_count{watcher="metrics"} 2`)
+	assert.NotContains(t, w.Body.String(), `gumshoe_queue_depth{watcher="metrics"`)
+	assert.Contains(t, w.Body.String(), `gumshoe_queue_depth{watcher="",state="pending"}`)
+
+	assert.Equal(t, http.StatusUnauthorized, anonRequest("GET", "/metrics", "", nil).Code)
+}
+
+func TestAnnounceMetrics(t *testing.T) {
+	assert.NoError(t, ProcessRelease("metrics", "Not.Tracked.S01E01.720p.HDTV.x264-GRP", "http://localhost/1.torrent", nil))
+	assert.Equal(t, 1.0, announcesSeen.Get("metrics"))
+	assert.Equal(t, 1.0, announcesRejected.Get("metrics", rejectUnmatched))
+	assert.Equal(t, 0.0, announcesMatched.Get("metrics"))
+
+	setIRCStatus("metrics", "Watching Channel")
+	assert.Equal(t, 1.0, ircConnected.Get("metrics"))
+	setIRCStatus("metrics", "Disconnected: EOF")
+	assert.Equal(t, 0.0, ircConnected.Get("metrics"))
+}
+
+func TestVarz(t *testing.T) {
+	w := apiRequest("GET", "/vars", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	vars := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars), w.Body.String())
+	assert.Contains(t, vars, "irc_status")
+}
@@ -31,7 +31,7 @@ func PrintDebugln(s ...interface{}) {
 }
 
 func PrintDebugf(f string, i ...interface{}) {
-	if tc.Operations.Debug {
+	if currentConfig().Operations.Debug {
 		log.Printf("[DEBUG] %s", fmt.Sprintf(f, i...))
 	}
 }
@@ -0,0 +1,326 @@
+/* Notifications
+ *
+ * Notifiers tell someone about events from the event bus: an episode handed
+ * to the torrent client, a fetch given up on, an IRC watcher losing its
+ * server or the tracker cookies running out. A notifier sends an email over
+ * SMTP, POSTs JSON to a webhook or runs a shell command. The message for each
+ * event type is a text/template over the event, its first line is the
+ * subject.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	notifySMTP    = "smtp"
+	notifyWebhook = "webhook"
+	notifyShell   = "shell"
+)
+
+var (
+	// How long a notifier gets to send one message.
+	notifyTimeout = 30 * time.Second
+
+	// Events a notifier sends when it doesn't list any.
+	defaultNotifyEvents = []string{EventFetchCompleted, EventFetchFailed, EventIRCDisconnect, EventCookieExpired}
+
+	defaultNotifyTemplates = map[string]string{
+		EventFetchCompleted: "Grabbed {{.Release}}\n\n{{.Release}} was handed to the torrent client.",
+		EventFetchFailed:    "Gave up on {{.Release}}\n\n{{.Message}}",
+		EventIRCDisconnect:  "IRC {{.Watcher}} disconnected\n\n{{.Message}}",
+		EventCookieExpired:  "The tracker cookies need renewing\n\n{{.Message}}",
+	}
+	fallbackNotifyTemplate = "{{.Type}}{{with .Release}} {{.}}{{end}}\n\n{{.Message}}"
+
+	notifyFuncs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"date": func(t int64) string {
+			return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+		},
+	}
+)
+
+// Notifier sends a message when one of Events happens, or any of
+// defaultNotifyEvents if it doesn't list them. Type is "smtp", "webhook" or
+// "shell", and picks which of the other fields are used.
+type Notifier struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Events []string `json:"events"`
+	// A template per event type for the message. Events without one use the
+	// built in template.
+	Templates map[string]string `json:"templates"`
+
+	// smtp: SMTPServer is host:port. The password can be a secret: reference.
+	SMTPServer   string   `json:"smtp_server"`
+	SMTPUser     string   `json:"smtp_user"`
+	SMTPPassword string   `json:"smtp_password"`
+	From         string   `json:"from"`
+	To           []string `json:"to"`
+
+	// webhook: Payload is a template for the JSON body, e.g.
+	// {"content": {{json .Text}}}. Without it the event and message are sent.
+	URL     string `json:"url"`
+	Payload string `json:"payload"`
+
+	// shell: run with sh -c, with the message on stdin and the event in
+	// GUMSHOE_* environment variables.
+	Command string `json:"command"`
+}
+
+// notification is what the templates see.
+type notification struct {
+	Event
+	// The rendered message, and its first line.
+	Text    string
+	Subject string
+}
+
+func (n Notifier) label() string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return n.Type
+}
+
+// Wants reports whether n is sent events of type typ.
+func (n Notifier) Wants(typ string) bool {
+	evs := n.Events
+	if len(evs) == 0 {
+		evs = defaultNotifyEvents
+	}
+	for _, e := range evs {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (n Notifier) template(typ string) string {
+	if t, ok := n.Templates[typ]; ok {
+		return t
+	}
+	if t, ok := defaultNotifyTemplates[typ]; ok {
+		return t
+	}
+	return fallbackNotifyTemplate
+}
+
+func render(name, text string, data interface{}) (string, error) {
+	t, err := template.New(name).Funcs(notifyFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	b := &bytes.Buffer{}
+	if err = t.Execute(b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// message renders the message for e.
+func (n Notifier) message(e Event) (notification, error) {
+	m := notification{Event: e}
+	text, err := render(e.Type, n.template(e.Type), e)
+	if err != nil {
+		return m, err
+	}
+	m.Text = strings.TrimSpace(text)
+	m.Subject = strings.SplitN(m.Text, "\n", 2)[0]
+	return m, nil
+}
+
+// Send tells n about e.
+func (n Notifier) Send(e Event) error {
+	m, err := n.message(e)
+	if err != nil {
+		return err
+	}
+	switch n.Type {
+	case notifySMTP:
+		return n.sendMail(m)
+	case notifyWebhook:
+		return n.postWebhook(m)
+	case notifyShell:
+		return n.runCommand(m)
+	}
+	return fmt.Errorf("Unknown notifier type %s.", n.Type)
+}
+
+func (n Notifier) sendMail(m notification) error {
+	host, _, err := net.SplitHostPort(n.SMTPServer)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if n.SMTPUser != "" {
+		auth = smtp.PlainAuth("", n.SMTPUser, resolveSecret(n.SMTPPassword), host)
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", n.From)
+	fmt.Fprintf(b, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(b, "Subject: gumshoe: %s\r\n", m.Subject)
+	fmt.Fprintf(b, "Date: %s\r\n", time.Unix(m.Time, 0).Format(time.RFC1123Z))
+	fmt.Fprint(b, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(b, "%s\r\n", strings.Replace(m.Text, "\n", "\r\n", -1))
+	return smtp.SendMail(n.SMTPServer, auth, n.From, n.To, b.Bytes())
+}
+
+func (n Notifier) postWebhook(m notification) error {
+	var body []byte
+	if n.Payload != "" {
+		p, err := render("payload", n.Payload, m)
+		if err != nil {
+			return err
+		}
+		body = []byte(p)
+	} else {
+		var err error
+		body, err = json.Marshal(map[string]interface{}{
+			"event":   m.Event,
+			"subject": m.Subject,
+			"text":    m.Text,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c := &http.Client{Timeout: notifyTimeout}
+	resp, err := c.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+func (n Notifier) runCommand(m notification) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", n.Command)
+	cmd.Stdin = strings.NewReader(m.Text + "\n")
+	cmd.Env = append(os.Environ(),
+		"GUMSHOE_EVENT="+m.Type,
+		"GUMSHOE_RELEASE="+m.Release,
+		"GUMSHOE_WATCHER="+m.Watcher,
+		"GUMSHOE_MESSAGE="+m.Message,
+		"GUMSHOE_SUBJECT="+m.Subject,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// validate adds the problems with n to v, with fields under f.
+func (n Notifier) validate(f string, v *ValidationErrors) {
+	switch n.Type {
+	case notifySMTP:
+		if _, _, err := net.SplitHostPort(n.SMTPServer); err != nil {
+			v.add(f+"smtp_server", "%s is not a host:port.", n.SMTPServer)
+		}
+		if n.From == "" {
+			v.add(f+"from", "Needed to send email.")
+		}
+		if len(n.To) == 0 {
+			v.add(f+"to", "Needed to send email.")
+		}
+	case notifyWebhook:
+		if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(f+"url", "%s is not an http or https URL.", n.URL)
+		}
+		if _, err := template.New("payload").Funcs(notifyFuncs).Parse(n.Payload); err != nil {
+			v.add(f+"payload", "%s", err)
+		}
+	case notifyShell:
+		if n.Command == "" {
+			v.add(f+"command", "Needed to run a command.")
+		}
+	default:
+		v.add(f+"type", "Unknown notifier type %s.", n.Type)
+	}
+	for i, e := range n.Events {
+		if !knownEventType(e) {
+			v.add(fmt.Sprintf("%sevents[%d]", f, i), "Unknown event type %s.", e)
+		}
+	}
+	for e, t := range n.Templates {
+		if !knownEventType(e) {
+			v.add(f+"templates."+e, "Unknown event type %s.", e)
+		} else if _, err := template.New(e).Funcs(notifyFuncs).Parse(t); err != nil {
+			v.add(f+"templates."+e, "%s", err)
+		}
+	}
+}
+
+// notify hands e to every notifier that wants it.
+func notify(e Event) {
+	for _, n := range currentConfig().Notifications {
+		if !n.Wants(e.Type) {
+			continue
+		}
+		if err := n.Send(e); err != nil {
+			log.Printf("[ERROR] Notifier %s: %s\n", n.label(), err)
+		}
+	}
+}
+
+// StartNotifier sends notifications for the events published from now on,
+// until stop is called. stop returns once the last notification is sent.
+func StartNotifier() (stop func()) {
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func(last int64) {
+		defer close(stopped)
+		for {
+			// The subscription is dropped if sending falls behind, the
+			// events missed meanwhile are picked up from the buffer.
+			replay, ch, cancel := events.Subscribe(last)
+			for _, e := range replay {
+				notify(e)
+				last = e.ID
+			}
+		receive:
+			for {
+				select {
+				case e, ok := <-ch:
+					if !ok {
+						break receive
+					}
+					notify(e)
+					last = e.ID
+				case <-done:
+					cancel()
+					return
+				}
+			}
+			cancel()
+		}
+	}(events.LastID())
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
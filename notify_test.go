@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sentMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// smtpSink takes one message over SMTP and sends on what was in it.
+func smtpSink(t *testing.T) (addr string, mail chan sentMail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail = make(chan sentMail, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		reply := func(s string) { c.Write([]byte(s + "\r\n")) }
+		m := sentMail{}
+		reply("220 localhost ESMTP sink")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				m.From = strings.Trim(line[10:], "<>")
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				m.To = append(m.To, strings.Trim(line[8:], "<>"))
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 Go ahead")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					m.Data += l
+				}
+				reply("250 OK")
+				mail <- m
+			case cmd == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), mail
+}
+
+func TestNotifySMTP(t *testing.T) {
+	addr, mail := smtpSink(t)
+	n := Notifier{
+		Type:       notifySMTP,
+		SMTPServer: addr,
+		From:       "gumshoe@example.com",
+		To:         []string{"me@example.com", "you@example.com"},
+	}
+	err := n.Send(Event{Type: EventFetchCompleted, Time: 1427328000, Release: "Walking.Bread.S01E01.720p"})
+	assert.NoError(t, err)
+	select {
+	case m := <-mail:
+		assert.Equal(t, "gumshoe@example.com", m.From)
+		assert.Equal(t, []string{"me@example.com", "you@example.com"}, m.To)
+		assert.Contains(t, m.Data, "Subject: gumshoe: Grabbed Walking.Bread.S01E01.720p\r\n")
+		assert.Contains(t, m.Data, "\r\n\r\nGrabbed Walking.Bread.S01E01.720p\r\n\r\nWalking.Bread.S01E01.720p was handed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("No mail was sent.")
+	}
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	bodies := make(chan []byte, 2)
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	e := Event{ID: 7, Type: EventFetchFailed, Release: "Walking.Bread.S01E01", Message: `Fetch returned "404 Not Found". Giving up after 4 tries.`}
+	n := Notifier{Type: notifyWebhook, URL: ts.URL}
+	assert.NoError(t, n.Send(e))
+	got := struct {
+		Event   Event
+		Subject string
+		Text    string
+	}{}
+	assert.NoError(t, json.Unmarshal(<-bodies, &got))
+	assert.Equal(t, e, got.Event)
+	assert.Equal(t, "Gave up on Walking.Bread.S01E01", got.Subject)
+	assert.Contains(t, got.Text, "Giving up after 4 tries.")
+
+	// A templated body, with a template of its own for the message.
+	n.Payload = `{"content": {{json .Text}}}`
+	n.Templates = map[string]string{EventFetchFailed: "{{.Release}} failed: {{.Message}}"}
+	assert.NoError(t, n.Send(e))
+	assert.Equal(t, `{"content": "Walking.Bread.S01E01 failed: Fetch returned \"404 Not Found\". Giving up after 4 tries."}`, string(<-bodies))
+
+	status = http.StatusInternalServerError
+	assert.Error(t, n.Send(e))
+}
+
+func TestNotifyShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-notify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	n := Notifier{Type: notifyShell, Command: `cat > ` + out + `; echo "$GUMSHOE_EVENT $GUMSHOE_WATCHER" >> ` + out}
+	assert.NoError(t, n.Send(Event{Type: EventIRCDisconnect, Watcher: "tracker", Message: "EOF"}))
+	b, _ := ioutil.ReadFile(out)
+	assert.Equal(t, "IRC tracker disconnected\n\nEOF\nirc_disconnected tracker\n", string(b))
+
+	n.Command = "echo oops; exit 3"
+	err = n.Send(Event{Type: EventCookieExpired})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "oops")
+	}
+}
+
+func TestNotifierEvents(t *testing.T) {
+	got := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := struct{ Event Event }{}
+		json.NewDecoder(r.Body).Decode(&e)
+		got <- e.Event.Type
+	}))
+	defer ts.Close()
+
+	c := useTestConfig(t, func(c *TrackerConfig) {
+		c.Notifications = []Notifier{{Type: notifyWebhook, URL: ts.URL}}
+	})
+	assert.True(t, c.Notifications[0].Wants(EventCookieExpired))
+	assert.False(t, c.Notifications[0].Wants(EventFetchRetry))
+
+	stop := StartNotifier()
+	defer stop()
+	publishEvent(EventFetchRetry, "", "Walking.Bread.S01E01", "Trying again in 1m0s.")
+	publishEvent(EventFetchFailed, "", "Walking.Bread.S01E01", "Giving up after 4 tries.")
+	select {
+	case typ := <-got:
+		assert.Equal(t, EventFetchFailed, typ)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The webhook wasn't called.")
+	}
+}
+
+func TestNotifierValidation(t *testing.T) {
+	fieldsOf := func(n Notifier) []string {
+		v := ValidationErrors{}
+		n.validate("n.", &v)
+		f := []string{}
+		for _, e := range v {
+			f = append(f, e.Field)
+		}
+		return f
+	}
+	assert.Empty(t, fieldsOf(Notifier{Type: notifySMTP, SMTPServer: "mail:25", From: "a@b", To: []string{"c@d"}}))
+	assert.Equal(t, []string{"n.smtp_server", "n.from", "n.to"}, fieldsOf(Notifier{Type: notifySMTP, SMTPServer: "mail"}))
+	assert.Equal(t, []string{"n.url"}, fieldsOf(Notifier{Type: notifyWebhook, URL: "ftp://example.com"}))
+	assert.Equal(t, []string{"n.payload"}, fieldsOf(Notifier{Type: notifyWebhook, URL: "https://example.com/hook", Payload: "{{.Text"}))
+	assert.Equal(t, []string{"n.command", "n.events[1]"}, fieldsOf(Notifier{Type: notifyShell, Events: []string{EventMatched, "grabbed"}}))
+	assert.Equal(t, []string{"n.templates.matched"}, fieldsOf(Notifier{Type: notifyShell, Command: "true", Templates: map[string]string{EventMatched: "{{"}}))
+	assert.Equal(t, []string{"n.type"}, fieldsOf(Notifier{Type: "pigeon"}))
+
+	c := &TrackerConfig{Notifications: []Notifier{{Name: "mail", Type: notifySMTP, SMTPPassword: "hunter2"}}}
+	r := c.Redacted()
+	assert.Equal(t, redactedValue, r.Notifications[0].SMTPPassword)
+	assert.Equal(t, "hunter2", c.Notifications[0].SMTPPassword)
+	r.restoreRedacted(c)
+	assert.Equal(t, "hunter2", r.Notifications[0].SMTPPassword)
+}
@@ -0,0 +1,457 @@
+/* Post-processing
+ *
+ * Finished downloads are sorted into the library. Video files in the
+ * download_dir are matched back to their episodes with the release parser and
+ * moved, hardlinked or copied into the library_dir, named by a template like
+ * Show Name/Season 02/Show Name - S02E23 - Title.mkv. The download_dir is
+ * looked through every post_process.interval minutes, and the torrent client
+ * can ask for a download to be done as soon as it finishes.
+ *
+ * Every step is recorded in the episode row: the file found for it, where it
+ * was put and, if that failed, why.
+ */
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Post-processing methods.
+const (
+	PostMove     = "move"
+	PostHardlink = "hardlink"
+	PostCopy     = "copy"
+)
+
+// Where post-processing of an episode's file got to.
+const (
+	PostFound  = "found"
+	PostMoved  = "moved"
+	PostLinked = "linked"
+	PostCopied = "copied"
+	PostFailed = "failed"
+)
+
+const (
+	defaultLibraryTemplate = `{{.Show}}/Season {{pad .Season}}/{{.Show}} - S{{pad .Season}}E{{pad .Episode}}` +
+		`{{if .LastEpisode}}-E{{pad .LastEpisode}}{{end}}{{with .Title}} - {{.}}{{end}}{{.Ext}}`
+	defaultDailyTemplate = `{{.Show}}/{{.Year}}/{{.Show}} - {{.AirDate}}{{with .Title}} - {{.}}{{end}}{{.Ext}}`
+)
+
+var (
+	// Time, in s, when the download_dir was last looked through
+	postProcessTimestamp = expvar.NewInt("postprocess_last_run_timestamp")
+	// String relating to the current state of the post-processor
+	postProcessStatus = expvar.NewString("postprocess_status")
+	// Files changed more recently than this may still be being written.
+	postSettleTime = time.Minute
+	// Starts looking through the download_dir right away.
+	postProcessWake = make(chan bool, 1)
+	// One post-processing run at a time.
+	postProcessLock sync.Mutex
+
+	videoExts = map[string]bool{
+		".mkv": true, ".mp4": true, ".m4v": true, ".avi": true, ".ts": true, ".wmv": true, ".mov": true, ".mpg": true,
+	}
+
+	libraryFuncs = template.FuncMap{
+		"pad": func(n int) string { return fmt.Sprintf("%02d", n) },
+	}
+	// Characters that can't be in a file name on one system or another.
+	unsafeNameChars = strings.NewReplacer("/", "-", `\`, "-", ":", " -", "*", "", "?", "", `"`, "'", "<", "", ">", "", "|", "-")
+)
+
+// PostProcess sorts finished downloads from the download_dir into the
+// library_dir. The download_dir is looked through every Interval minutes, 0
+// leaves it to the torrent client to ask. Method is "move", "hardlink" or
+// "copy", hardlink when it's empty so the torrent can keep seeding.
+// Template and DailyTemplate lay out the library, see defaultLibraryTemplate.
+type PostProcess struct {
+	Interval      int    `json:"interval"`
+	Method        string `json:"method"`
+	Template      string `json:"template"`
+	DailyTemplate string `json:"daily_template"`
+}
+
+// PostResult is what happened to one file.
+type PostResult struct {
+	File     string   `json:"file"`
+	Path     string   `json:"path,omitempty"`
+	State    string   `json:"state"`
+	Episodes []string `json:"episodes,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// libraryName is what the library templates see.
+type libraryName struct {
+	Show    string
+	Season  int
+	Episode int
+	// The last episode of a multi-episode file, 0 for a single episode.
+	LastEpisode int
+	Title       string
+	AirDate     string
+	Year        int
+	Quality     string
+	// The extension of the file, with the dot.
+	Ext string
+}
+
+func (p PostProcess) method() string {
+	if p.Method == "" {
+		return PostHardlink
+	}
+	return p.Method
+}
+
+func (p PostProcess) templates() (episodal, daily string) {
+	episodal, daily = p.Template, p.DailyTemplate
+	if episodal == "" {
+		episodal = defaultLibraryTemplate
+	}
+	if daily == "" {
+		daily = defaultDailyTemplate
+	}
+	return episodal, daily
+}
+
+// validate adds the problems with the post_process section to v.
+func (p PostProcess) validate(v *ValidationErrors) {
+	if p.Interval < 0 {
+		v.add("post_process.interval", "Can't be negative.")
+	}
+	switch p.Method {
+	case "", PostMove, PostHardlink, PostCopy:
+	default:
+		v.add("post_process.method", "Unknown method %s, use move, hardlink or copy.", p.Method)
+	}
+	if _, err := template.New("template").Funcs(libraryFuncs).Parse(p.Template); err != nil {
+		v.add("post_process.template", "%s", err)
+	}
+	if _, err := template.New("daily_template").Funcs(libraryFuncs).Parse(p.DailyTemplate); err != nil {
+		v.add("post_process.daily_template", "%s", err)
+	}
+}
+
+func safeName(s string) string {
+	return strings.Trim(unsafeNameChars.Replace(s), ". ")
+}
+
+// libraryPath is where the file src of the episodes eps of show goes under
+// the library directory lib.
+func libraryPath(p PostProcess, lib string, show Show, eps []Episode, src string) (string, error) {
+	first := eps[0]
+	n := libraryName{
+		Show:    safeName(show.Title),
+		Season:  first.Season,
+		Episode: first.Episode,
+		Title:   safeName(first.Title),
+		Quality: first.Quality,
+		Ext:     strings.ToLower(filepath.Ext(src)),
+	}
+	if len(eps) > 1 {
+		n.LastEpisode = eps[len(eps)-1].Episode
+	}
+	text, daily := p.templates()
+	if first.IsDaily() {
+		text = daily
+		n.AirDate = first.AirDate.Format("2006-01-02")
+		n.Year = first.AirDate.Year()
+	}
+	t, err := template.New("library").Funcs(libraryFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	b := &strings.Builder{}
+	if err = t.Execute(b, n); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(lib, filepath.FromSlash(b.String()))
+	if r, err := filepath.Rel(lib, dest); err != nil || r == "." || strings.HasPrefix(r, "..") {
+		return "", fmt.Errorf("%s isn't inside the library.", dest)
+	}
+	return dest, nil
+}
+
+// postDir is the full path of the directory dir_options key k names in tc.
+func postDir(tc *TrackerConfig, k string) string {
+	d := tc.Directories[k]
+	if d == "" || filepath.IsAbs(d) {
+		return d
+	}
+	return filepath.Join(tc.Directories["user_dir"], d)
+}
+
+// postEpisodes finds the episode rows of a file, adding rows for episodes we
+// didn't know about.
+func postEpisodes(src string) (Show, []Episode, error) {
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	rel, show, err := matchRelease(nil, name)
+	if err != nil {
+		// The file may only have the episode in its name, and the release
+		// name in the directory it's in.
+		if r, s, derr := matchRelease(nil, filepath.Base(filepath.Dir(src))); derr == nil && !r.SeasonPack {
+			rel, show, err = r, s, nil
+		}
+	}
+	if err != nil {
+		return show, nil, err
+	}
+	if rel.SeasonPack {
+		return show, nil, errors.New("The file name doesn't say which episode of the season it is.")
+	}
+	found, err := episodesFromRelease(show, rel)
+	if err != nil {
+		return show, nil, err
+	}
+	eps := []Episode{}
+	for _, e := range found {
+		have, err := e.findExisting()
+		if err != nil {
+			// Not one of ours, but it's in the library from now on.
+			e.State = EpisodeDownloaded
+			if err = e.RecordEpisode(); err != nil {
+				return show, nil, err
+			}
+			have = e
+		}
+		if have.Title == "" {
+			have.Title = e.Title
+		}
+		eps = append(eps, *have)
+	}
+	return show, eps, nil
+}
+
+// recordPostStep stores how far post-processing of e got.
+func recordPostStep(e *Episode, state, file, path, msg string) error {
+	e.PostState, e.File, e.Path, e.PostError = state, file, path, msg
+	if state == PostMoved || state == PostLinked || state == PostCopied {
+		e.State = EpisodeDownloaded
+	}
+	checkDBLock <- 1
+	_, err := gDb.Exec("update episode set PostState=?, File=?, Path=?, PostError=?, State=? where ID=?",
+		e.PostState, e.File, e.Path, e.PostError, e.State, e.ID)
+	<-checkDBLock
+	return err
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	return out.Close()
+}
+
+// placeFile puts src at dest with method, and returns the state it's in.
+func placeFile(method, src, dest string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return PostFailed, err
+	}
+	switch method {
+	case PostMove:
+		err := os.Rename(src, dest)
+		if err != nil {
+			// Another filesystem, copy it over instead.
+			if err = copyFile(src, dest); err == nil {
+				err = os.Remove(src)
+			}
+		}
+		if err != nil {
+			return PostFailed, err
+		}
+		return PostMoved, nil
+	case PostCopy:
+		if err := copyFile(src, dest); err != nil {
+			return PostFailed, err
+		}
+		return PostCopied, nil
+	}
+	if err := os.Link(src, dest); err != nil {
+		return PostFailed, err
+	}
+	return PostLinked, nil
+}
+
+// postProcessFile sorts one file into the library.
+func postProcessFile(p PostProcess, lib, src string) PostResult {
+	res := PostResult{File: src, State: PostFailed}
+	show, eps, err := postEpisodes(src)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	for _, e := range eps {
+		res.Episodes = append(res.Episodes, e.String())
+	}
+	fail := func(err error) PostResult {
+		res.Error = err.Error()
+		for i := range eps {
+			if rerr := recordPostStep(&eps[i], PostFailed, src, res.Path, res.Error); rerr != nil {
+				log.Printf("Unable to record post-processing of %s: %s\n", &eps[i], rerr)
+			}
+		}
+		return res
+	}
+
+	// Copies and hardlinks leave the file where it is, it's only done once.
+	prev := eps[0]
+	if prev.File == src && (prev.PostState == PostLinked || prev.PostState == PostCopied) {
+		res.Path, res.State = prev.Path, prev.PostState
+		return res
+	}
+	if res.Path, err = libraryPath(p, lib, show, eps, src); err != nil {
+		return fail(err)
+	}
+	for i := range eps {
+		if err = recordPostStep(&eps[i], PostFound, src, "", ""); err != nil {
+			return fail(err)
+		}
+	}
+
+	if fi, err := os.Stat(res.Path); err == nil {
+		si, _ := os.Stat(src)
+		switch {
+		case si != nil && os.SameFile(fi, si):
+		case prev.Path == res.Path && prev.File != src:
+			// An upgrade of a file we put there.
+			if err = os.Remove(res.Path); err != nil {
+				return fail(err)
+			}
+		default:
+			return fail(fmt.Errorf("%s is already in the library.", res.Path))
+		}
+	}
+	if res.State, err = placeFile(p.method(), src, res.Path); err != nil {
+		return fail(err)
+	}
+	for i := range eps {
+		if err = recordPostStep(&eps[i], res.State, src, res.Path, ""); err != nil {
+			log.Printf("Unable to record post-processing of %s: %s\n", &eps[i], err)
+		}
+	}
+	log.Printf("Post-processing: %s %s to %s\n", res.State, src, res.Path)
+	return res
+}
+
+// postFiles lists the video files under root. Files changed after settled
+// are left for later, they may still be being written.
+func postFiles(root string, settled time.Time) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !videoExts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		if strings.Contains(strings.ToLower(fi.Name()), "sample") || fi.ModTime().After(settled) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	return files, err
+}
+
+// PostProcessPath sorts the video files at path, a file or a directory in the
+// download_dir, into the library. An empty path is the whole download_dir.
+func PostProcessPath(path string, settled time.Time) ([]PostResult, error) {
+	tc := currentConfig()
+	lib, dl := postDir(tc, "library_dir"), postDir(tc, "download_dir")
+	if lib == "" || dl == "" {
+		return nil, errors.New("Set dir_options.download_dir and dir_options.library_dir to post-process downloads.")
+	}
+	if path == "" {
+		path = dl
+	}
+	path = filepath.Clean(path)
+	if r, err := filepath.Rel(dl, path); err != nil || strings.HasPrefix(r, "..") {
+		return nil, fmt.Errorf("%s is not in the download_dir.", path)
+	}
+	postProcessLock.Lock()
+	defer postProcessLock.Unlock()
+	files, err := postFiles(path, settled)
+	if err != nil {
+		return nil, err
+	}
+	results := []PostResult{}
+	for _, f := range files {
+		results = append(results, postProcessFile(tc.PostProcess, lib, f))
+	}
+	return results, nil
+}
+
+func runPostProcess() {
+	postProcessStatus.Set("Processing")
+	results, err := PostProcessPath("", time.Now().Add(-postSettleTime))
+	if err != nil {
+		log.Printf("Post-processing failed: %s\n", err)
+		postProcessStatus.Set(fmt.Sprintf("Error: %s", err))
+		return
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			PrintDebugf("Post-processing %s: %s\n", r.File, r.Error)
+		}
+	}
+	postProcessTimestamp.Set(time.Now().Unix())
+	postProcessStatus.Set("Idle")
+}
+
+// TriggerPostProcess looks through the download_dir without waiting for the
+// interval.
+func TriggerPostProcess() {
+	select {
+	case postProcessWake <- true:
+	default:
+	}
+}
+
+// StartPostProcess looks through the download_dir every
+// PostProcess.Interval minutes. Like the backlog search, the interval is read
+// again after every run.
+func StartPostProcess() {
+	postProcessStatus.Set("Ready")
+	go func() {
+		for {
+			wait := time.Duration(currentConfig().PostProcess.Interval) * time.Minute
+			if wait <= 0 {
+				wait = time.Minute
+			}
+			select {
+			case <-postProcessWake:
+				runPostProcess()
+			case <-time.After(wait):
+				if currentConfig().PostProcess.Interval > 0 {
+					runPostProcess()
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraryPath(t *testing.T) {
+	show := Show{Title: "Walking Bread"}
+	p := PostProcess{}
+	eps := []Episode{{Season: 2, Episode: 23, Title: "Who's There?"}}
+	dest, err := libraryPath(p, "/tv", show, eps, "/dl/walking.bread.s02e23.720p.MKV")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.FromSlash("/tv/Walking Bread/Season 02/Walking Bread - S02E23 - Who's There.mkv"), dest)
+
+	eps = []Episode{{Season: 2, Episode: 22, Title: "Finale: Part 1"}, {Season: 2, Episode: 23}}
+	dest, _ = libraryPath(p, "/tv", show, eps, "x.mp4")
+	assert.Equal(t, filepath.FromSlash("/tv/Walking Bread/Season 02/Walking Bread - S02E22-E23 - Finale - Part 1.mp4"), dest)
+
+	ad, _ := ParseAirDate("2015-03-26")
+	dest, _ = libraryPath(p, "/tv", Show{Title: "Daily Shown"}, []Episode{{AirDate: ad}}, "x.mkv")
+	assert.Equal(t, filepath.FromSlash("/tv/Daily Shown/2015/Daily Shown - 2015-03-26.mkv"), dest)
+
+	p.Template = "{{.Show}}/S{{.Season}}/{{.Episode}}{{.Ext}}"
+	dest, _ = libraryPath(p, "/tv", show, eps, "x.mkv")
+	assert.Equal(t, filepath.FromSlash("/tv/Walking Bread/S2/22.mkv"), dest)
+	p.Template = "../{{.Show}}{{.Ext}}"
+	_, err = libraryPath(p, "/tv", show, eps, "x.mkv")
+	assert.Error(t, err)
+
+	v := ValidationErrors{}
+	PostProcess{Interval: -1, Method: "teleport", Template: "{{.Show"}.validate(&v)
+	assert.Len(t, v, 3)
+}
+
+func TestPostProcess(t *testing.T) {
+	s := newShow("post show", "720p", true)
+	assert.NoError(t, s.AddShow())
+	defer s.DeleteShow()
+
+	dir, err := ioutil.TempDir("", "gumshoe-post")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dl, lib := filepath.Join(dir, "completed"), filepath.Join(dir, "tv")
+	os.MkdirAll(filepath.Join(dl, "Post.Show.S01E03.720p.HDTV.x264-GRP"), 0755)
+	os.Mkdir(lib, 0755)
+	write := func(name string) string {
+		f := filepath.Join(dl, filepath.FromSlash(name))
+		assert.NoError(t, ioutil.WriteFile(f, []byte(name), 0644))
+		return f
+	}
+	first := write("post.show.s01e02.720p.hdtv.x264-grp.mkv")
+	second := write("Post.Show.S01E03.720p.HDTV.x264-GRP/grp-ps103.mkv")
+	write("Post.Show.S01E03.720p.HDTV.x264-GRP/sample.mkv")
+	write("Post.Show.S01E03.720p.HDTV.x264-GRP/grp-ps103.nfo")
+	write("not.tracked.s01e01.720p.mkv")
+
+	useTestConfig(t, func(c *TrackerConfig) {
+		c.Directories = map[string]string{"user_dir": c.Directories["user_dir"], "data_dir": c.Directories["data_dir"], "download_dir": dl, "library_dir": lib}
+		c.PostProcess = PostProcess{}
+	})
+
+	// Nothing is touched while it may still be being written.
+	results, err := PostProcessPath("", time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	results, err = PostProcessPath("", time.Now())
+	require.NoError(t, err)
+	states := map[string]PostResult{}
+	for _, r := range results {
+		states[filepath.Base(r.File)] = r
+	}
+	require.Len(t, states, 3)
+	assert.Equal(t, PostFailed, states["not.tracked.s01e01.720p.mkv"].State)
+	assert.Contains(t, states["not.tracked.s01e01.720p.mkv"].Error, "not being tracked")
+
+	r := states[filepath.Base(first)]
+	assert.Equal(t, PostLinked, r.State)
+	assert.Equal(t, filepath.Join(lib, "Post Show", "Season 01", "Post Show - S01E02.mkv"), r.Path)
+	fi, _ := os.Stat(first)
+	li, err := os.Stat(r.Path)
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(fi, li))
+	// The release name only in the directory is good enough.
+	assert.Equal(t, []string{"S01E03"}, states["grp-ps103.mkv"].Episodes)
+
+	e, err := (&Episode{ShowID: s.ID, Season: 1, Episode: 2}).findExisting()
+	require.NoError(t, err)
+	require.NotNil(t, e)
+	assert.Equal(t, PostLinked, e.PostState)
+	assert.Equal(t, first, e.File)
+	assert.Equal(t, r.Path, e.Path)
+	assert.Equal(t, EpisodeDownloaded, e.State)
+
+	// Linked files are only done once, moved ones are gone.
+	useTestConfig(t, func(c *TrackerConfig) { c.PostProcess.Method = PostMove })
+	results, err = PostProcessPath(second, time.Now())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, PostLinked, results[0].State)
+
+	third := write("Post.Show.S01E04.720p.HDTV.x264-GRP.mkv")
+	results, err = PostProcessPath(third, time.Now())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, PostMoved, results[0].State)
+	_, err = os.Stat(third)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(results[0].Path)
+	assert.NoError(t, err)
+
+	// An upgrade replaces the file it put there before.
+	upgrade := write("Post.Show.S01E04.1080p.WEB-DL.x264-GRP.mkv")
+	results, _ = PostProcessPath(upgrade, time.Now())
+	require.Len(t, results, 1)
+	assert.Equal(t, PostMoved, results[0].State)
+	b, _ := ioutil.ReadFile(results[0].Path)
+	assert.Equal(t, "Post.Show.S01E04.1080p.WEB-DL.x264-GRP.mkv", string(b))
+
+	// Something else already at the path isn't replaced.
+	fourth := write("post.show.s01e05.720p.mkv")
+	taken := filepath.Join(lib, "Post Show", "Season 01", "Post Show - S01E05.mkv")
+	assert.NoError(t, ioutil.WriteFile(taken, []byte("mine"), 0644))
+	results, _ = PostProcessPath(fourth, time.Now())
+	require.Len(t, results, 1)
+	assert.Equal(t, PostFailed, results[0].State)
+	e, _ = (&Episode{ShowID: s.ID, Season: 1, Episode: 5}).findExisting()
+	require.NotNil(t, e)
+	assert.Equal(t, PostFailed, e.PostState)
+	assert.Contains(t, e.PostError, "already in the library")
+
+	_, err = PostProcessPath(dir, time.Now())
+	assert.Error(t, err)
+	w := apiRequest("POST", "/api/v1/postprocess", `{"path": "/etc"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = apiRequest("POST", "/api/v1/postprocess", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,127 @@
+/* Quality Profiles
+ *
+ * A profile is a ranked list of the resolution and source combinations a show
+ * may be fetched in, best first. Once an episode is on disk, a better release
+ * is fetched as an upgrade until the profile's cutoff is reached.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Quality is a resolution and source pair. An empty field matches anything.
+// Releases without a resolution are SD.
+type Quality struct {
+	Resolution string `json:"resolution"`
+	Source     string `json:"source"`
+}
+
+type QualityProfile struct {
+	Allowed []Quality `json:"allowed"`
+	// Upgrades stop once an episode has been fetched at this quality or better.
+	// Without a cutoff the first acceptable release is kept.
+	Cutoff *Quality `json:"cutoff,omitempty"`
+}
+
+// qualityOfRelease is the quality a parsed release was encoded at.
+func qualityOfRelease(r *Release) Quality {
+	q := Quality{Resolution: r.Resolution, Source: r.Source}
+	if q.Resolution == "" || q.Resolution == "480p" || q.Resolution == "576p" {
+		q.Resolution = "SD"
+	}
+	return q
+}
+
+// qualityOfName pulls the quality out of any release name, even one that
+// ParseRelease can't find an episode in.
+func qualityOfName(s string) Quality {
+	r := &Release{}
+	r.parseTags(trimReleaseName(s))
+	return qualityOfRelease(r)
+}
+
+// ParseQuality reads a quality written by Quality.String.
+func ParseQuality(s string) Quality {
+	f := strings.Fields(s)
+	q := Quality{}
+	if len(f) > 0 {
+		q.Resolution = f[0]
+	}
+	if len(f) > 1 {
+		q.Source = f[1]
+	}
+	return q
+}
+
+func (q Quality) String() string {
+	return strings.TrimSpace(q.Resolution + " " + q.Source)
+}
+
+// Matches reports whether the actual quality a satisfies q.
+func (q Quality) Matches(a Quality) bool {
+	if q.Resolution != "" && !strings.EqualFold(q.Resolution, a.Resolution) {
+		return false
+	}
+	return q.Source == "" || strings.EqualFold(q.Source, a.Source)
+}
+
+// Rank is the position of the best entry in the profile that q satisfies, or
+// -1 when the quality isn't allowed at all. Lower is better.
+func (p QualityProfile) Rank(q Quality) int {
+	for i, a := range p.Allowed {
+		if a.Matches(q) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Allows reports whether q is acceptable under the profile.
+func (p QualityProfile) Allows(q Quality) bool {
+	return p.Rank(q) >= 0
+}
+
+// IsUpgrade reports whether q should replace an episode we already have at
+// quality have.
+func (p QualityProfile) IsUpgrade(have, q Quality) bool {
+	if p.Cutoff == nil || !p.Allows(q) {
+		return false
+	}
+	haveRank := p.Rank(have)
+	if haveRank < 0 {
+		// Whatever we have isn't in the profile anymore, anything allowed is better.
+		return true
+	}
+	cutoff := p.Rank(*p.Cutoff)
+	if cutoff >= 0 && haveRank <= cutoff {
+		return false
+	}
+	return p.Rank(q) < haveRank
+}
+
+func (p QualityProfile) Validate() error {
+	if len(p.Allowed) == 0 {
+		return errors.New("A quality profile needs at least one allowed quality.")
+	}
+	if p.Cutoff != nil && !p.Allows(*p.Cutoff) {
+		return fmt.Errorf("Cutoff %s isn't one of the allowed qualities.", p.Cutoff)
+	}
+	return nil
+}
+
+// QualityProfileFor returns the profile named by a show's quality. Shows that
+// still use a plain resolution like "720p", or "420" and "" for SD, get a
+// profile allowing just that resolution.
+func QualityProfileFor(quality string) QualityProfile {
+	if p, ok := currentConfig().QualityProfiles[quality]; ok {
+		return p
+	}
+	res := quality
+	if res == "" || res == "420" {
+		res = "SD"
+	}
+	return QualityProfile{Allowed: []Quality{{Resolution: res}}}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testProfile = QualityProfile{
+	Allowed: []Quality{
+		{Resolution: "1080p", Source: "WEB-DL"},
+		{Resolution: "1080p"},
+		{Resolution: "720p"},
+	},
+	Cutoff: &Quality{Resolution: "1080p"},
+}
+
+func TestQualityOfName(t *testing.T) {
+	assert.Equal(t, Quality{"1080p", "WEB-DL"}, qualityOfName("Show.S01E06.1080p.WEB-DL.DD5.1.H.264-NTb.torrent"))
+	assert.Equal(t, Quality{"SD", "HDTV"}, qualityOfName("show.name.s01e02.HDTV.mp4.torrent"))
+	assert.Equal(t, Quality{"720p", "HDTV"}, ParseQuality(Quality{"720p", "HDTV"}.String()))
+}
+
+func TestQualityProfileRank(t *testing.T) {
+	assert.Equal(t, 0, testProfile.Rank(Quality{"1080p", "WEB-DL"}))
+	assert.Equal(t, 1, testProfile.Rank(Quality{"1080p", "HDTV"}))
+	assert.Equal(t, 2, testProfile.Rank(Quality{"720p", "HDTV"}))
+	assert.Equal(t, -1, testProfile.Rank(Quality{"SD", "HDTV"}))
+	assert.True(t, testProfile.Allows(Quality{"720p", "WEBRip"}))
+	assert.False(t, testProfile.Allows(Quality{"2160p", "WEB-DL"}))
+}
+
+func TestQualityProfileIsUpgrade(t *testing.T) {
+	assert.True(t, testProfile.IsUpgrade(Quality{"720p", "HDTV"}, Quality{"1080p", "HDTV"}))
+	// 1080p HDTV has reached the cutoff, so even the top quality isn't fetched.
+	assert.False(t, testProfile.IsUpgrade(Quality{"1080p", "HDTV"}, Quality{"1080p", "WEB-DL"}))
+	assert.False(t, testProfile.IsUpgrade(Quality{"720p", "HDTV"}, Quality{"720p", "WEB-DL"}))
+	assert.False(t, testProfile.IsUpgrade(Quality{"720p", "HDTV"}, Quality{"SD", "HDTV"}))
+
+	noCutoff := QualityProfile{Allowed: testProfile.Allowed}
+	assert.False(t, noCutoff.IsUpgrade(Quality{"720p", "HDTV"}, Quality{"1080p", "WEB-DL"}))
+}
+
+func TestQualityProfileValidate(t *testing.T) {
+	assert.NoError(t, testProfile.Validate())
+	assert.Error(t, QualityProfile{}.Validate())
+	assert.Error(t, QualityProfile{Allowed: testProfile.Allowed, Cutoff: &Quality{Resolution: "SD"}}.Validate())
+}
+
+func TestLegacyQualityProfile(t *testing.T) {
+	assert.True(t, QualityProfileFor("720p").Allows(Quality{"720p", "HDTV"}))
+	assert.False(t, QualityProfileFor("720p").Allows(Quality{"1080p", "HDTV"}))
+	assert.True(t, QualityProfileFor("420").Allows(Quality{"SD", "HDTV"}))
+	assert.True(t, QualityProfileFor("").Allows(Quality{"SD", ""}))
+}
+
+func TestEpisodeUpgrade(t *testing.T) {
+	useTestConfig(t, func(c *TrackerConfig) { c.QualityProfiles = map[string]QualityProfile{"hd": testProfile} })
+	s := newShow("Upgrade Test", "hd", true)
+	assert.NoError(t, s.AddShow())
+
+	e := &Episode{ShowID: s.ID, Season: 1, Episode: 1, Quality: "720p HDTV"}
+	assert.True(t, e.IsNewEpisode())
+	assert.False(t, e.IsUpgrade())
+	assert.NoError(t, e.RecordEpisode())
+	assert.False(t, e.IsNewEpisode())
+
+	better := &Episode{ShowID: s.ID, Season: 1, Episode: 1, Quality: "1080p HDTV"}
+	assert.True(t, better.IsNewEpisode())
+	assert.True(t, better.IsUpgrade())
+	assert.NoError(t, better.RecordEpisode())
+	assert.Equal(t, e.ID, better.ID)
+
+	// The cutoff has been reached.
+	best := &Episode{ShowID: s.ID, Season: 1, Episode: 1, Quality: "1080p WEB-DL"}
+	assert.False(t, best.IsNewEpisode())
+
+	eps, err := GetEpisodesByShowID(s.ID)
+	assert.NoError(t, err)
+	assert.Len(t, *eps, 1)
+	assert.Equal(t, "1080p HDTV", (*eps)[0].Quality)
+}
@@ -0,0 +1,349 @@
+/* Download Queue
+ *
+ * Every torrent gumshoe decides to grab goes through this queue. Items are
+ * stored in the database so nothing is lost when the daemon restarts, and a
+ * fixed pool of workers fetches them, retrying failures with a backoff.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QueuePending  = "pending"
+	QueueFetching = "fetching"
+	QueueDone     = "done"
+	QueueFailed   = "failed"
+)
+
+var (
+	// Wait before the first retry of a failed fetch. Each following retry waits
+	// twice as long as the one before.
+	queueBackoff = 30 * time.Second
+	// How often the dispatcher looks for items whose retry time has come.
+	queuePollInterval = 10 * time.Second
+	// Signals the dispatcher that a new item was added.
+	queueWake = make(chan bool, 1)
+)
+
+type QueueItem struct {
+	ID        int64   `json:"id"`
+	URL       string  `json:"url" binding:"required"`
+	Title     string  `json:"title"`
+	ShowID    int64   `json:"show_id"`
+	Season    int     `json:"season"`
+	Episode   int     `json:"episode"`
+	AirDate   AirDate `json:"airdate"`
+	Quality   string  `json:"quality"`
+	State     string  `json:"state"`
+	Retries   int     `json:"retries"`
+	LastError string  `json:"last_error"`
+	NextTry   int64   `json:"next_try"`
+	Added     int64   `json:"added"`
+	Updated   int64   `json:"updated"`
+	// Every episode a multi-episode release or season pack is fetched for,
+	// comma separated. Empty when there's only the one in Episode.
+	Episodes   string `json:"episodes"`
+	SeasonPack bool   `json:"season_pack"`
+	// Where the release came from: an IRC watcher, "rss", "backlog",
+	// "review" or "api".
+	Watcher string `json:"watcher"`
+}
+
+func newQueueItem(link, title string, eps []*Episode) *QueueItem {
+	now := time.Now().Unix()
+	q := &QueueItem{
+		URL:     link,
+		Title:   title,
+		State:   QueuePending,
+		NextTry: now,
+		Added:   now,
+		Updated: now,
+	}
+	if len(eps) > 0 {
+		ep := eps[0]
+		q.ShowID = ep.ShowID
+		q.Season = ep.Season
+		q.Episode = ep.Episode
+		q.AirDate = ep.AirDate
+		q.Quality = ep.Quality
+	}
+	if len(eps) > 1 {
+		nums := make([]string, len(eps))
+		for i, e := range eps {
+			nums[i] = strconv.Itoa(e.Episode)
+		}
+		q.Episodes = strings.Join(nums, ",")
+	}
+	return q
+}
+
+// episodes are the episode rows to record once the item is fetched.
+func (q *QueueItem) episodes() []*Episode {
+	if q.ShowID == 0 {
+		return nil
+	}
+	ep := &Episode{ShowID: q.ShowID, Season: q.Season, Episode: q.Episode, AirDate: q.AirDate, Quality: q.Quality}
+	if q.Episodes == "" {
+		return []*Episode{ep}
+	}
+	eps := []*Episode{}
+	for _, n := range strings.Split(q.Episodes, ",") {
+		e := *ep
+		e.Episode = GetInt(n)
+		eps = append(eps, &e)
+	}
+	return eps
+}
+
+// Start User Functions
+
+// Enqueue adds a torrent link to the download queue. ep may be nil when the
+// link isn't tied to a tracked episode.
+func Enqueue(link, title string, ep *Episode) (*QueueItem, error) {
+	if ep == nil {
+		return EnqueueEpisodes("", link, title, nil, false)
+	}
+	return EnqueueEpisodes("", link, title, []*Episode{ep}, false)
+}
+
+// EnqueueEpisodes adds a torrent link that covers several episodes of a
+// show, all in the same season. pack marks a season pack, watcher names
+// where the link came from.
+func EnqueueEpisodes(watcher, link, title string, eps []*Episode, pack bool) (*QueueItem, error) {
+	if link == "" {
+		return nil, errors.New("Queue item needs a URL.")
+	}
+	q := newQueueItem(link, title, eps)
+	q.SeasonPack = pack
+	q.Watcher = watcher
+	checkDBLock <- 1
+	err := gDb.Insert(q)
+	<-checkDBLock
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case queueWake <- true:
+	default:
+	}
+	return q, nil
+}
+
+func ListQueue(state string) ([]QueueItem, error) {
+	items := []QueueItem{}
+	checkDBLock <- 1
+	defer func() { <-checkDBLock }()
+	if state != "" {
+		_, err := gDb.Select(&items, "select * from queue where State=? order by Added", state)
+		return items, err
+	}
+	_, err := gDb.Select(&items, "select * from queue order by Added")
+	return items, err
+}
+
+func GetQueueItem(id int64) (QueueItem, error) {
+	q := QueueItem{}
+	checkDBLock <- 1
+	err := gDb.SelectOne(&q, "select * from queue where ID=?", id)
+	<-checkDBLock
+	return q, err
+}
+
+// CancelQueueItem removes an item from the queue. Items that are being
+// fetched right now can't be cancelled.
+func CancelQueueItem(id int64) error {
+	checkDBLock <- 1
+	defer func() { <-checkDBLock }()
+	res, err := gDb.Exec("delete from queue where ID=? and State!=?", id, QueueFetching)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Queue item doesn't exist or is being fetched.")
+	}
+	return nil
+}
+
+// IsEpisodeQueued reports whether an episode is already waiting in the queue,
+// so a second announce of the same release doesn't get fetched twice.
+func (e *Episode) IsEpisodeQueued() bool {
+	checkDBLock <- 1
+	n, err := gDb.SelectInt("select count(*) from queue where ShowID=? and Season=? and (Episode=? or ','||Episodes||',' like ?) and AirDate=? and State in (?, ?)",
+		e.ShowID, e.Season, e.Episode, fmt.Sprintf("%%,%d,%%", e.Episode), e.AirDate, QueuePending, QueueFetching)
+	<-checkDBLock
+	return err == nil && n > 0
+}
+
+// End User Functions
+
+func (q *QueueItem) update() error {
+	q.Updated = time.Now().Unix()
+	checkDBLock <- 1
+	_, err := gDb.Update(q)
+	<-checkDBLock
+	return err
+}
+
+// retryDelay is the backoff before retry number n.
+func retryDelay(n int) time.Duration {
+	if n < 1 {
+		return 0
+	}
+	return queueBackoff << uint(n-1)
+}
+
+// name is the release title, or the link when there isn't one.
+func (q *QueueItem) name() string {
+	if q.Title != "" {
+		return q.Title
+	}
+	return q.URL
+}
+
+// fetch downloads a single item, hands it to the torrent client and records
+// the release and the episodes it was fetched for.
+func (q *QueueItem) fetch() error {
+	ff, err := NewFileFetch(q.URL, q.Title)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = ff.RetrieveEpisode()
+	observeFetch(q.Watcher, ff.Status, time.Since(start))
+	if err != nil {
+		return err
+	}
+	if err = handOffTorrent(ff.SaveLocation); err != nil {
+		return err
+	}
+	if q.ShowID != 0 {
+		r := &ReleaseRecord{ShowID: q.ShowID, Name: q.Title, URL: q.URL, Quality: q.Quality, Season: q.Season,
+			SeasonPack: q.SeasonPack}
+		if err = RecordRelease(r, q.episodes()); err != nil {
+			log.Printf("Episode is downloading, but didn't update the db: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// process fetches an item and moves it to its next state.
+func (q *QueueItem) process() {
+	publishEvent(EventFetchStarted, "", q.name(), "Fetching %s.", q.URL)
+	err := q.fetch()
+	if err == nil {
+		q.State = QueueDone
+		q.LastError = ""
+		publishEvent(EventFetchCompleted, "", q.name(), "Handed to the torrent client.")
+		if q.ShowID != 0 {
+			if s, err := GetShow(q.ShowID); err == nil {
+				grabsTotal.Inc(q.Watcher, s.Title)
+			}
+		}
+	} else {
+		log.Printf("FAIL: episode not retrieved: %s\n", err)
+		q.LastError = err.Error()
+		q.Retries++
+		if q.Retries > currentConfig().Download.MaxRetries {
+			q.State = QueueFailed
+			publishEvent(EventFetchFailed, "", q.name(), "%s. Giving up after %d tries.", err, q.Retries)
+		} else {
+			q.State = QueuePending
+			wait := retryDelay(q.Retries)
+			// Not before the tracker said it would take requests again.
+			if te, ok := err.(*ThrottledError); ok {
+				if d := time.Until(te.Until).Round(time.Second); d > wait {
+					wait = d
+				}
+			}
+			q.NextTry = time.Now().Add(wait).Unix()
+			publishEvent(EventFetchRetry, "", q.name(), "%s. Trying again in %s.", err, wait)
+		}
+	}
+	if err = q.update(); err != nil {
+		log.Printf("Unable to update queue item %d: %s\n", q.ID, err)
+	}
+}
+
+// readyItems returns the items that are due, oldest first.
+func readyItems() ([]QueueItem, error) {
+	items := []QueueItem{}
+	checkDBLock <- 1
+	_, err := gDb.Select(&items, "select * from queue where State=? and NextTry<=? order by Added",
+		QueuePending, time.Now().Unix())
+	<-checkDBLock
+	return items, err
+}
+
+// claimItem marks a pending item as fetching once a worker is free to fetch
+// it. Items cancelled while they waited for a worker are gone by then.
+func claimItem(id int64) (QueueItem, error) {
+	q := QueueItem{}
+	checkDBLock <- 1
+	defer func() { <-checkDBLock }()
+	res, err := gDb.Exec("update queue set State=?, Updated=? where ID=? and State=?",
+		QueueFetching, time.Now().Unix(), id, QueuePending)
+	if err != nil {
+		return q, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return q, errors.New("Queue item was cancelled or is being fetched.")
+	}
+	err = gDb.SelectOne(&q, "select * from queue where ID=?", id)
+	return q, err
+}
+
+func queueWorker() {
+	for id := range concurrentFetches {
+		q, err := claimItem(id)
+		if err != nil {
+			PrintDebugf("Skipping queue item %d: %s\n", id, err)
+			continue
+		}
+		q.process()
+	}
+}
+
+// queueDispatcher hands due items to the workers. An item is only claimed by
+// the worker that takes it, so it can be cancelled until then.
+func queueDispatcher() {
+	for {
+		items, err := readyItems()
+		if err != nil {
+			log.Printf("Unable to read the download queue: %s\n", err)
+		}
+		for _, q := range items {
+			concurrentFetches <- q.ID
+		}
+		select {
+		case <-queueWake:
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
+
+// StartQueue starts the queue dispatcher and Download.QueueSize workers.
+// Items left in the fetching state by an earlier run are retried.
+func StartQueue() error {
+	checkDBLock <- 1
+	_, err := gDb.Exec("update queue set State=? where State=?", QueuePending, QueueFetching)
+	<-checkDBLock
+	if err != nil {
+		return err
+	}
+	workers := currentConfig().Download.QueueSize
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go queueWorker()
+	}
+	go queueDispatcher()
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueue(t *testing.T) {
+	ep := &Episode{ShowID: int64(1), Season: 4, Episode: 1}
+	q, err := Enqueue("http://localhost/download.php/1/walking.bread.s04e01.torrent", "walking.bread.s04e01.720p.hdtv", ep)
+	assert.NoError(t, err)
+	assert.NotEqual(t, int64(0), q.ID)
+	assert.Equal(t, QueuePending, q.State)
+	assert.True(t, ep.IsEpisodeQueued())
+
+	got, err := GetQueueItem(q.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, q.URL, got.URL)
+	assert.Equal(t, 4, got.Season)
+
+	items, err := ListQueue(QueuePending)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, items)
+
+	assert.NoError(t, CancelQueueItem(q.ID))
+	assert.Error(t, CancelQueueItem(q.ID))
+	assert.False(t, ep.IsEpisodeQueued())
+
+	_, err = Enqueue("", "no url", nil)
+	assert.Error(t, err)
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), retryDelay(0))
+	assert.Equal(t, queueBackoff, retryDelay(1))
+	assert.Equal(t, 4*queueBackoff, retryDelay(3))
+}
+
+func TestClaimQueueItem(t *testing.T) {
+	q, err := Enqueue("http://localhost/download.php/2/claim.test.torrent", "claim.test", nil)
+	assert.NoError(t, err)
+	c, err := Enqueue("http://localhost/download.php/3/cancelled.test.torrent", "cancelled.test", nil)
+	assert.NoError(t, err)
+
+	// Waiting for a worker doesn't stop an item from being cancelled.
+	assert.NoError(t, CancelQueueItem(c.ID))
+	_, err = claimItem(c.ID)
+	assert.Error(t, err)
+
+	got, err := claimItem(q.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, QueueFetching, got.State)
+	assert.Equal(t, "claim.test", got.Title)
+	_, err = claimItem(q.ID)
+	assert.Error(t, err, "An item was claimed twice.")
+	assert.Error(t, CancelQueueItem(q.ID))
+
+	got.State = QueueDone
+	got.update()
+}
+
+func TestTorrentFileName(t *testing.T) {
+	for link, want := range map[string]string{
+		"http://localhost/download.php/1/walking.bread.s04e01.torrent?passkey=secret": "walking.bread.s04e01.torrent",
+		"http://localhost/download.php?id=1&passkey=secret":                           "Walking.Bread.S04E01.720p.HDTV.torrent",
+		"http://localhost/get/..%2F..%2Fetc%2Fpasswd.torrent":                         "passwd.torrent",
+	} {
+		u, err := url.Parse(link)
+		assert.NoError(t, err)
+		assert.Equal(t, want, torrentFileName(u, "Walking.Bread.S04E01.720p.HDTV"), link)
+	}
+	u, _ := url.Parse("http://localhost/")
+	assert.Equal(t, "download.torrent", torrentFileName(u, ""))
+}
+
+func TestQueueProcess(t *testing.T) {
+	fails := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "fake torrent")
+	}))
+	defer ts.Close()
+
+	useTestConfig(t, func(c *TrackerConfig) {
+		c.Directories["user_dir"] = pwd
+		c.Directories["torrent_dir"] = "test_data"
+		c.Download.MaxRetries = 1
+		// Fetch from the test server again straight away.
+		c.Download.Rate = 0
+	})
+	pause := throttlePause
+	throttlePause = 0
+	defer func() {
+		throttlePause = pause
+		os.Remove(filepath.Join(pwd, "test_data", "queue.test.torrent"))
+	}()
+
+	q, err := Enqueue(ts.URL+"/download.php/1/queue.test.torrent", "", nil)
+	assert.NoError(t, err)
+
+	q.process()
+	assert.Equal(t, QueuePending, q.State)
+	assert.Equal(t, 1, q.Retries)
+	assert.NotEmpty(t, q.LastError)
+	assert.True(t, q.NextTry > time.Now().Unix())
+
+	q.process()
+	assert.Equal(t, QueueFailed, q.State)
+
+	fails = false
+	q.State = QueuePending
+	q.process()
+	assert.Equal(t, QueueDone, q.State)
+	assert.Empty(t, q.LastError)
+	_, err = os.Stat(filepath.Join(pwd, "test_data", "queue.test.torrent"))
+	assert.NoError(t, err)
+
+	got, err := GetQueueItem(q.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, QueueDone, got.State)
+}
@@ -0,0 +1,299 @@
+/* Release Name Parser
+ *
+ * Breaks a scene release name like Show.Name.S01E02.Title.720p.HDTV.x264-GRP
+ * into its parts. This is what gumshoe uses unless a watcher has its own
+ * episode regex configured.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type Release struct {
+	Name         string  `json:"name"`
+	Show         string  `json:"show"`
+	Season       int     `json:"season"`
+	Episodes     []int   `json:"episodes"`
+	AirDate      AirDate `json:"airdate"`
+	Daily        bool    `json:"daily"`
+	SeasonPack   bool    `json:"season_pack"`
+	EpisodeTitle string  `json:"episode_title,omitempty"`
+	Proper       bool    `json:"proper"`
+	Repack       bool    `json:"repack"`
+	Rerun        bool    `json:"rerun"`
+	Resolution   string  `json:"resolution,omitempty"`
+	Source       string  `json:"source,omitempty"`
+	Codec        string  `json:"codec,omitempty"`
+	Group        string  `json:"group,omitempty"`
+}
+
+var (
+	// Separators that can come before an episode marker.
+	relSep = `(?:^|[. _\-\[(])`
+	// S01E02, S01E01E02, S01E01-E03 and S01E01-03
+	relSxxExx = regexp.MustCompile(`(?i)` + relSep + `s(\d{1,2})[. ]?e(\d{1,3})((?:[-. ]?e\d{1,3})*)(?:-(\d{1,3}))?(?:[. _\-\])]|$)`)
+	// 1x02 and 1x02-03
+	relNxNN = regexp.MustCompile(`(?i)` + relSep + `(\d{1,2})x(\d{2,3})(?:-(\d{2,3}))?(?:[. _\-\])]|$)`)
+	// S02 or Season.2 on its own
+	relSeason = regexp.MustCompile(`(?i)` + relSep + `(?:s|season[. ]?)(\d{1,2})(?:[. _\-\])]|$)`)
+	// 102 and 1002
+	relNumbered = regexp.MustCompile(`[. _\-](\d{3,4})(?:[. _\-]|$)`)
+
+	relExtraEpisode = regexp.MustCompile(`(?i)e(\d{1,3})`)
+	relResolution   = regexp.MustCompile(`(?i)(?:^|[. _\-\[])(480p|576p|720p|1080[pi]|2160p|4k)(?:[. _\-\]]|$)`)
+	relSource       = regexp.MustCompile(`(?i)(?:^|[. _\-\[])(hdtv|pdtv|sdtv|dsr|web[. \-]?dl|web[. \-]?rip|web|blu[. \-]?ray|bdrip|brrip|dvdrip|hdrip|dvd)(?:[. _\-\]]|$)`)
+	relCodec        = regexp.MustCompile(`(?i)(?:^|[. _\-\[])(x264|x265|h[. ]?264|h[. ]?265|hevc|avc|xvid|divx)(?:[. _\-\]]|$)`)
+	relProper       = regexp.MustCompile(`(?i)(?:^|[. _\-])proper(?:[. _\-]|$)`)
+	relRepack       = regexp.MustCompile(`(?i)(?:^|[. _\-])(?:repack|rerip)(?:[. _\-]|$)`)
+	relRerun        = regexp.MustCompile(`(?i)(?:^|[. _\-])(?:rerun|repeat)(?:[. _\-]|$)`)
+	relGroup        = regexp.MustCompile(`-([A-Za-z0-9]+)$`)
+	// The first tag after the episode marker, which ends the episode title.
+	relFirstTag = regexp.MustCompile(`(?i)(?:^|[. _\-])(?:480p|576p|720p|1080[pi]|2160p|4k|hdtv|pdtv|sdtv|web|webrip|web-dl|webdl|bluray|blu-ray|bdrip|brrip|dvdrip|hdrip|dvd|x264|x265|h\.?264|h\.?265|hevc|xvid|proper|repack|rerip|internal|readnfo|dd5\.1|aac2?\.0|ac3|ddp5\.1)(?:[. _\-]|$)`)
+
+	relSources = map[string]string{
+		"hdtv": "HDTV", "pdtv": "PDTV", "sdtv": "SDTV", "dsr": "DSR",
+		"webdl": "WEB-DL", "webrip": "WEBRip", "web": "WEB-DL",
+		"bluray": "BluRay", "bdrip": "BluRay", "brrip": "BluRay",
+		"dvdrip": "DVD", "dvd": "DVD", "hdrip": "HDRip",
+	}
+	relCodecs = map[string]string{
+		"x264": "x264", "h264": "x264", "avc": "x264",
+		"x265": "x265", "h265": "x265", "hevc": "x265",
+		"xvid": "XviD", "divx": "XviD",
+	}
+)
+
+// Episode returns the first episode the release covers.
+func (r *Release) Episode() int {
+	if len(r.Episodes) == 0 {
+		return 0
+	}
+	return r.Episodes[0]
+}
+
+func (r *Release) String() string {
+	switch {
+	case r.Daily:
+		return fmt.Sprintf("%s %s", r.Show, r.AirDate)
+	case r.SeasonPack:
+		return fmt.Sprintf("%s S%02d", r.Show, r.Season)
+	}
+	return fmt.Sprintf("%s S%02dE%02d", r.Show, r.Season, r.Episode())
+}
+
+// trimReleaseName strips the path and file extensions off a release name.
+func trimReleaseName(name string) string {
+	n := path.Base(strings.TrimSpace(name))
+	for _, ext := range []string{".torrent", ".mp4", ".mkv", ".avi", ".m4v", ".ts", ".wmv"} {
+		if strings.HasSuffix(strings.ToLower(n), ext) {
+			n = n[:len(n)-len(ext)]
+		}
+	}
+	return n
+}
+
+func cleanShowName(s string) string {
+	s = strings.Trim(s, " ._-[(")
+	s = strings.Replace(s, "_", " ", -1)
+	s = strings.Replace(s, ".", " ", -1)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func episodeRange(first, last int) []int {
+	eps := []int{}
+	for e := first; e <= last && e-first < 100; e++ {
+		eps = append(eps, e)
+	}
+	return eps
+}
+
+// findNumbered finds 102 or 1002 style numbering. Years and the 264 of H.264
+// aren't episode numbers.
+func findNumbered(n string) []int {
+	for _, m := range relNumbered.FindAllStringSubmatchIndex(n, -1) {
+		num := n[m[2]:m[3]]
+		if m[0] == 0 || (len(num) == 4 && (strings.HasPrefix(num, "19") || strings.HasPrefix(num, "20"))) {
+			continue
+		}
+		if m[0] > 0 && strings.ContainsAny(n[m[0]-1:m[0]], "hH") {
+			continue
+		}
+		return m
+	}
+	return nil
+}
+
+// ParseRelease parses a scene release name. An error is returned when no
+// episode, air date or season marker can be found.
+func ParseRelease(name string) (*Release, error) {
+	n := trimReleaseName(name)
+	r := &Release{Name: name}
+
+	var loc []int
+	if m := relSxxExx.FindStringSubmatchIndex(n); m != nil {
+		loc = m
+		r.Season = GetInt(n[m[2]:m[3]])
+		first := GetInt(n[m[4]:m[5]])
+		r.Episodes = []int{first}
+		if m[6] != m[7] {
+			for _, e := range relExtraEpisode.FindAllStringSubmatch(n[m[6]:m[7]], -1) {
+				r.Episodes = append(r.Episodes, GetInt(e[1]))
+			}
+		}
+		if m[8] != -1 {
+			r.Episodes = append(r.Episodes, GetInt(n[m[8]:m[9]]))
+		}
+		// A dash between two episodes means every episode in between too.
+		last := r.Episodes[len(r.Episodes)-1]
+		if strings.Contains(n[m[4]:m[1]], "-") && last > first {
+			r.Episodes = episodeRange(first, last)
+		}
+	} else if m := relNxNN.FindStringSubmatchIndex(n); m != nil {
+		loc = m
+		r.Season = GetInt(n[m[2]:m[3]])
+		first := GetInt(n[m[4]:m[5]])
+		r.Episodes = []int{first}
+		if m[6] != -1 {
+			r.Episodes = episodeRange(first, GetInt(n[m[6]:m[7]]))
+		}
+	} else if d, m, _ := findAirDate(n); m != nil && m[0] > 0 {
+		loc = m
+		r.Daily = true
+		r.AirDate = d
+	} else if m := relSeason.FindStringSubmatchIndex(n); m != nil && m[0] > 0 {
+		loc = m
+		r.Season = GetInt(n[m[2]:m[3]])
+		r.SeasonPack = true
+	} else if m := findNumbered(n); m != nil {
+		loc = m
+		num := n[m[2]:m[3]]
+		split := len(num) - 2
+		r.Season = GetInt(num[:split])
+		r.Episodes = []int{GetInt(num[split:])}
+	} else {
+		return nil, fmt.Errorf("No episode found in %s", name)
+	}
+
+	r.Show = cleanShowName(n[:loc[0]])
+	if r.Show == "" {
+		return nil, errors.New("Release has no show name.")
+	}
+	rest := n[loc[1]:]
+	if t := relFirstTag.FindStringIndex(rest); t != nil {
+		r.EpisodeTitle = cleanShowName(rest[:t[0]])
+	} else if g := relGroup.FindStringIndex(rest); g != nil {
+		r.EpisodeTitle = cleanShowName(rest[:g[0]])
+	} else {
+		r.EpisodeTitle = cleanShowName(rest)
+	}
+	r.parseTags(n)
+	return r, nil
+}
+
+// parseTags fills in the quality and group from anywhere in the name.
+func (r *Release) parseTags(n string) {
+	if m := relResolution.FindStringSubmatch(n); m != nil {
+		r.Resolution = strings.ToLower(m[1])
+		if r.Resolution == "4k" {
+			r.Resolution = "2160p"
+		}
+	}
+	if m := relSource.FindStringSubmatch(n); m != nil {
+		key := strings.ToLower(strings.NewReplacer(".", "", "-", "", " ", "").Replace(m[1]))
+		r.Source = relSources[key]
+	}
+	if m := relCodec.FindStringSubmatch(n); m != nil {
+		key := strings.ToLower(strings.NewReplacer(".", "", " ", "").Replace(m[1]))
+		r.Codec = relCodecs[key]
+	}
+	r.Proper = relProper.MatchString(n)
+	r.Repack = relRepack.MatchString(n)
+	r.Rerun = relRerun.MatchString(n)
+	if m := relGroup.FindStringSubmatch(n); m != nil && !strings.HasSuffix(strings.ToLower(n), "web-dl") {
+		r.Group = m[1]
+	}
+}
+
+// releaseFromMatch builds a release from the groups of a user supplied
+// episode regex: show, season, episode, airdate and enum.
+func releaseFromMatch(name string, eMatch map[string]string) *Release {
+	r := &Release{
+		Name:   name,
+		Show:   cleanShowName(eMatch["show"]),
+		Season: GetInt(eMatch["season"]),
+	}
+	// A date that doesn't parse is left out, like a season that isn't a number.
+	r.AirDate, _ = ParseAirDate(eMatch["airdate"])
+	if e := eMatch["episode"]; e != "" {
+		r.Episodes = []int{GetInt(e)}
+	}
+	if enum := eMatch["enum"]; len(enum) > 1 {
+		split := len(enum) - 2
+		if split < 1 {
+			split = 1
+		}
+		r.Season = GetInt(enum[:split])
+		r.Episodes = []int{GetInt(enum[split:])}
+	}
+	r.Daily = !r.AirDate.IsZero()
+	r.parseTags(trimReleaseName(name))
+	return r
+}
+
+// legacyEpisodeGroups names the groups of an episode regex without named
+// groups, in the order the original config format used them.
+var legacyEpisodeGroups = []string{"show", "season", "episode", "airdate", "season", "episode", "title"}
+
+func hasNamedGroups(p *regexp.Regexp) bool {
+	for _, n := range p.SubexpNames() {
+		if n != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEpisodeGroups makes sure a user supplied episode regex has the named
+// groups releaseFromMatch needs: show, and one of episode, enum or airdate.
+// A regex without named groups uses the positional legacyEpisodeGroups.
+func checkEpisodeGroups(p *regexp.Regexp) error {
+	if !hasNamedGroups(p) {
+		if p.NumSubexp() < 3 {
+			return errors.New("Needs show, season and episode groups.")
+		}
+		return nil
+	}
+	names := map[string]bool{}
+	for _, n := range p.SubexpNames() {
+		names[n] = true
+	}
+	if !names["show"] {
+		return errors.New("Needs a (?P<show>...) group.")
+	}
+	if !names["episode"] && !names["enum"] && !names["airdate"] {
+		return errors.New("Needs an episode, enum or airdate group.")
+	}
+	return nil
+}
+
+// parseReleaseWith uses the episode regex p, if one is configured, and falls
+// back to the built-in parser for names p doesn't match.
+func parseReleaseWith(p *regexp.Regexp, name string) (*Release, map[string]string, error) {
+	if p != nil {
+		if eMatch, err := matchEpisodeToPattern(p, name); err == nil {
+			if r := releaseFromMatch(name, eMatch); r.Show != "" {
+				return r, eMatch, nil
+			}
+		}
+	}
+	r, err := ParseRelease(name)
+	if err != nil && p != nil {
+		return nil, nil, fmt.Errorf("%s, and the episode regex didn't match it either", err)
+	}
+	return r, nil, err
+}
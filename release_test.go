@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var releaseTests = []struct {
+	name     string
+	expected Release
+}{
+	{"X.Company.S01E06.In.Enemy.Hands.1080p.WEB-DL.DD5.1.H.264-NTb.torrent", Release{
+		Show: "X Company", Season: 1, Episodes: []int{6}, EpisodeTitle: "In Enemy Hands",
+		Resolution: "1080p", Source: "WEB-DL", Codec: "x264", Group: "NTb"}},
+	{"conan.2015.03.26.will.ferrell.hdtv.x264-daview.mp4.torrent", Release{
+		Show: "conan", AirDate: NewAirDate(2015, time.March, 26), Daily: true, EpisodeTitle: "will ferrell",
+		Source: "HDTV", Codec: "x264", Group: "daview"}},
+	{"the.thundermans.s02e23.the.girl.with.the.dragon.snafu.hdtv.x264-w4f.mp4.torrent", Release{
+		Show: "the thundermans", Season: 2, Episodes: []int{23}, EpisodeTitle: "the girl with the dragon snafu",
+		Source: "HDTV", Codec: "x264", Group: "w4f"}},
+	{"the.thundermans.s02e22.one.hit.thunder.hdtv.x264-w4f.mp4.torrent", Release{
+		Show: "the thundermans", Season: 2, Episodes: []int{22}, EpisodeTitle: "one hit thunder",
+		Source: "HDTV", Codec: "x264", Group: "w4f"}},
+	{"Show.Name.1x02.720p.HDTV.x264-GRP", Release{
+		Show: "Show Name", Season: 1, Episodes: []int{2}, Resolution: "720p", Source: "HDTV", Codec: "x264", Group: "GRP"}},
+	{"Show.Name.102.HDTV.XviD-GRP", Release{
+		Show: "Show Name", Season: 1, Episodes: []int{2}, Source: "HDTV", Codec: "XviD", Group: "GRP"}},
+	{"Show.Name.1002.Title.HDTV.x264-GRP", Release{
+		Show: "Show Name", Season: 10, Episodes: []int{2}, EpisodeTitle: "Title", Source: "HDTV", Codec: "x264", Group: "GRP"}},
+	{"Show.Name.S01E01E02.720p.WEBRip.x265-GRP", Release{
+		Show: "Show Name", Season: 1, Episodes: []int{1, 2}, Resolution: "720p", Source: "WEBRip", Codec: "x265", Group: "GRP"}},
+	{"Show.Name.S01E01-E03.1080p.BluRay.x264-GRP", Release{
+		Show: "Show Name", Season: 1, Episodes: []int{1, 2, 3}, Resolution: "1080p", Source: "BluRay", Codec: "x264", Group: "GRP"}},
+	{"Show.Name.S02E22-23.HDTV.x264-GRP", Release{
+		Show: "Show Name", Season: 2, Episodes: []int{22, 23}, Source: "HDTV", Codec: "x264", Group: "GRP"}},
+	{"Show.Name.S03.720p.BluRay.x264-GRP", Release{
+		Show: "Show Name", Season: 3, SeasonPack: true, Resolution: "720p", Source: "BluRay", Codec: "x264", Group: "GRP"}},
+	{"Show Name Season 4 1080p WEB-DL", Release{
+		Show: "Show Name", Season: 4, SeasonPack: true, Resolution: "1080p", Source: "WEB-DL"}},
+	{"Show.Name.S05E06.PROPER.720p.HDTV.x264-GRP", Release{
+		Show: "Show Name", Season: 5, Episodes: []int{6}, Proper: true, Resolution: "720p", Source: "HDTV", Codec: "x264", Group: "GRP"}},
+	{"Show.Name.S05E06.REPACK.HDTV.x264-GRP", Release{
+		Show: "Show Name", Season: 5, Episodes: []int{6}, Repack: true, Source: "HDTV", Codec: "x264", Group: "GRP"}},
+	{"Daily.Shown.2015-03-26.Guest.2160p.WEB.h265-GRP", Release{
+		Show: "Daily Shown", AirDate: NewAirDate(2015, time.March, 26), Daily: true, EpisodeTitle: "Guest",
+		Resolution: "2160p", Source: "WEB-DL", Codec: "x265", Group: "GRP"}},
+}
+
+func TestParseRelease(t *testing.T) {
+	for _, rt := range releaseTests {
+		r, err := ParseRelease(rt.name)
+		if !assert.NoError(t, err, rt.name) {
+			continue
+		}
+		rt.expected.Name = rt.name
+		assert.Equal(t, &rt.expected, r, rt.name)
+	}
+}
+
+func TestParseReleaseFailure(t *testing.T) {
+	for _, n := range []string{
+		"blah.blahblah.not.a.real.episode.torrent",
+		"S01E02.720p.HDTV",
+		"Some.Movie.2015.1080p.BluRay.H.264-GRP",
+		"",
+	} {
+		_, err := ParseRelease(n)
+		assert.Error(t, err, n)
+	}
+}
+
+// Every URL in the fetch test corpus should be a parseable release.
+func TestParseReleaseTestUrls(t *testing.T) {
+	testUrls, err := ioutil.ReadFile(filepath.Join(pwd, "test_data", "test_urls"))
+	assert.NoError(t, err)
+	for _, u := range bytes.Split(bytes.TrimSpace(testUrls), []byte("\n")) {
+		r, err := ParseRelease(string(u))
+		if assert.NoError(t, err, string(u)) {
+			assert.NotEmpty(t, r.Show, string(u))
+		}
+	}
+}
+
+func TestParseReleaseWithRegex(t *testing.T) {
+	p := regexp.MustCompile(`(?P<show>.+?)\.Chapter\.(?P<season>\d+)\.Part\.(?P<episode>\d+)\.`)
+	r, groups, err := parseReleaseWith(p, "Show.Name.Chapter.3.Part.12.720p.HDTV.x264-GRP")
+	assert.NoError(t, err)
+	assert.Equal(t, "12", groups["episode"])
+	assert.Equal(t, "Show Name", r.Show)
+	assert.Equal(t, 3, r.Season)
+	assert.Equal(t, 12, r.Episode())
+	assert.Equal(t, "720p", r.Resolution)
+
+	// The episode regex goes first, the built-in parser reads what it doesn't match.
+	y := regexp.MustCompile(`(?P<show>.+?)\.\d{4}\.S(?P<season>\d+)E(?P<episode>\d+)`)
+	r, groups, err = parseReleaseWith(y, "Show.Name.2015.S01E02.720p")
+	assert.NoError(t, err)
+	assert.Equal(t, "Show Name", r.Show)
+	r, groups, err = parseReleaseWith(p, "Show.Name.S10E02.720p")
+	assert.NoError(t, err)
+	assert.Nil(t, groups)
+	assert.Equal(t, 10, r.Season)
+
+	// Positional groups from older configs.
+	legacy := regexp.MustCompile(`(\S+?)\.(?i:s(\d{2})e(\d{2})|(\d{4}.\d{2}.\d{2})|(\d)x?(\d{2}))\.`)
+	r, groups, err = parseReleaseWith(legacy, "Show.Name.1x02.HDTV.x264-GRP")
+	assert.NoError(t, err)
+	assert.Equal(t, "Show.Name", groups["show"])
+	assert.Equal(t, "Show Name", r.Show)
+	assert.Equal(t, 1, r.Season)
+	assert.Equal(t, 2, r.Episode())
+
+	_, _, err = parseReleaseWith(p, "Show.Name.Ep.12.720p")
+	assert.Error(t, err)
+	_, _, err = parseReleaseWith(regexp.MustCompile(`\.Ep\.(?P<episode>\d+)`), "Show.Name.Ep.12.720p")
+	assert.Error(t, err)
+
+	assert.NoError(t, checkEpisodeGroups(p))
+	assert.NoError(t, checkEpisodeGroups(regexp.MustCompile(`(?P<show>.+?)\.(?P<airdate>\d{4}\.\d{2}\.\d{2})`)))
+	assert.NoError(t, checkEpisodeGroups(legacy))
+	assert.Error(t, checkEpisodeGroups(regexp.MustCompile(`(\S+)\.s(\d{2})`)))
+	assert.Error(t, checkEpisodeGroups(regexp.MustCompile(`(?P<show>.+?)\.`)))
+}
@@ -0,0 +1,77 @@
+/* Release Database
+ *
+ * One download can hold more than one episode, like S02E22-E23 or a whole
+ * season in a season pack. Every download that gets fetched is kept in the
+ * release table, and the episode rows it covers point back to it, so none of
+ * them are fetched again on their own.
+ */
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type ReleaseRecord struct {
+	ID         int64  `json:"id"`
+	ShowID     int64  `json:"show_id"`
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Quality    string `json:"quality"`
+	Season     int    `json:"season"`
+	SeasonPack bool   `json:"season_pack"`
+	Added      int64  `json:"added"`
+}
+
+// Start User Functions
+
+func (r *ReleaseRecord) AddRelease() error {
+	r.Added = time.Now().Unix()
+	checkDBLock <- 1
+	err := gDb.Insert(r)
+	<-checkDBLock
+	return err
+}
+
+func GetRelease(id int64) (ReleaseRecord, error) {
+	r := ReleaseRecord{}
+	checkDBLock <- 1
+	err := gDb.SelectOne(&r, "select * from release where ID=?", id)
+	<-checkDBLock
+	return r, err
+}
+
+func GetReleasesByShowID(sid int64) ([]ReleaseRecord, error) {
+	rs := []ReleaseRecord{}
+	checkDBLock <- 1
+	_, err := gDb.Select(&rs, "select * from release where ShowID=? order by Added", sid)
+	<-checkDBLock
+	return rs, err
+}
+
+// Episodes are the episode rows the release was fetched for.
+func (r *ReleaseRecord) Episodes() ([]Episode, error) {
+	eps := []Episode{}
+	checkDBLock <- 1
+	_, err := gDb.Select(&eps, "select * from episode where ReleaseID=? order by Season, Episode, AirDate", r.ID)
+	<-checkDBLock
+	return eps, err
+}
+
+// RecordRelease stores a fetched release and marks every episode it was
+// fetched for as snatched.
+func RecordRelease(r *ReleaseRecord, eps []*Episode) error {
+	if err := r.AddRelease(); err != nil {
+		return err
+	}
+	for _, e := range eps {
+		e.ReleaseID = r.ID
+		e.State = EpisodeSnatched
+		if err := e.RecordEpisode(); err != nil {
+			return fmt.Errorf("Unable to record %s: %s", e, err)
+		}
+	}
+	return nil
+}
+
+// End User Functions
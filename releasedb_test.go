@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiEpisodeRelease(t *testing.T) {
+	// The built-in parser, not whatever episode_regex a test left set.
+	oldPattern := episodePattern
+	defer func() { episodePattern = oldPattern }()
+	episodePattern = nil
+
+	s := newShow("double bill", "720p", true)
+	assert.NoError(t, s.AddShow())
+	defer s.DeleteShow()
+
+	eps, err := ParseTorrentString("Double.Bill.S02E22-E23.Finale.720p.HDTV.x264-GRP")
+	assert.NoError(t, err)
+	if assert.Len(t, eps, 2) {
+		assert.Equal(t, 22, eps[0].Episode)
+		assert.Equal(t, "Finale", eps[0].Title)
+		assert.Equal(t, 23, eps[1].Episode)
+		assert.Equal(t, 2, eps[1].Season)
+		assert.Equal(t, eps[0].Quality, eps[1].Quality)
+	}
+
+	// Either episode is queued once the release is.
+	q, err := EnqueueEpisodes("", "http://localhost/1.torrent", "Double.Bill.S02E22-E23", eps, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "22,23", q.Episodes)
+	assert.True(t, (&Episode{ShowID: s.ID, Season: 2, Episode: 23}).IsEpisodeQueued())
+	assert.False(t, (&Episode{ShowID: s.ID, Season: 2, Episode: 2}).IsEpisodeQueued())
+	assert.Len(t, q.episodes(), 2)
+	CancelQueueItem(q.ID)
+
+	r := &ReleaseRecord{ShowID: s.ID, Name: q.Title, Season: 2}
+	assert.NoError(t, RecordRelease(r, q.episodes()))
+	got, err := r.Episodes()
+	assert.NoError(t, err)
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, EpisodeSnatched, got[1].State)
+		assert.Equal(t, r.ID, got[1].ReleaseID)
+	}
+	rs, err := GetReleasesByShowID(s.ID)
+	assert.NoError(t, err)
+	assert.Len(t, rs, 1)
+
+	// Neither is fetched again on its own.
+	eps, _ = ParseTorrentString("Double.Bill.S02E23.720p.HDTV.x264-GRP")
+	_, reason := wantedEpisodes(*s, &Release{}, eps)
+	assert.Contains(t, reason, "already have")
+}
+
+func TestSeasonPackPolicy(t *testing.T) {
+	s := newShow("pack show", "720p", true)
+	assert.NoError(t, s.AddShow())
+	defer s.DeleteShow()
+	rel, err := ParseRelease("Pack.Show.S01.720p.HDTV.x264-GRP")
+	assert.NoError(t, err)
+
+	eps, err := episodesFromRelease(*s, rel)
+	assert.NoError(t, err)
+	assert.Empty(t, eps)
+	s.SeasonPacks = true
+	_, reason := wantedEpisodes(*s, rel, eps)
+	assert.Contains(t, reason, "No episodes of season 1")
+
+	for i := 1; i <= 4; i++ {
+		e := &Episode{ShowID: s.ID, Season: 1, Episode: i, State: EpisodeWanted}
+		if i == 1 {
+			e.State = EpisodeDownloaded
+			e.Quality = "720p HDTV"
+		}
+		assert.NoError(t, e.AddEpisode())
+	}
+	eps, err = episodesFromRelease(*s, rel)
+	assert.NoError(t, err)
+	assert.Len(t, eps, 4)
+
+	s.SeasonPacks = false
+	_, reason = wantedEpisodes(*s, rel, eps)
+	assert.Equal(t, "Season packs aren't taken for this show.", reason)
+
+	// Three of the four episodes are wanted.
+	s.SeasonPacks, s.PackThreshold = true, 75
+	want, reason := wantedEpisodes(*s, rel, eps)
+	assert.Empty(t, reason)
+	assert.Len(t, want, 3)
+
+	s.PackThreshold = 80
+	want, reason = wantedEpisodes(*s, rel, eps)
+	assert.Empty(t, want)
+	assert.Contains(t, reason, "Only 3 of the 4 episodes")
+}
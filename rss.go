@@ -0,0 +1,312 @@
+/* RSS Watcher
+ *
+ * Polls a tracker's RSS or Atom feed and sends every new item through the same
+ * episode pipeline as the IRC announce channel.
+ */
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Time, in s, when the feed was last successfully polled
+	rssUpdateTimestamp = expvar.NewInt("rss_last_update_timestamp")
+	// String relating to the current state of the RSS watcher
+	rssStatus = expvar.NewString("rss_status")
+	// Channel that is used to turn on and off the RSS watcher.
+	RSSEnabled = make(chan bool)
+	// Set once StartRSS has started _TrackRSSStatus, which reads RSSEnabled.
+	rssRunning atomic.Bool
+	// Shortest time between two polls of the same feed, no matter what the
+	// server or the config asks for.
+	minRSSPoll = time.Minute
+)
+
+// feedItem is the part of an RSS item or Atom entry that gumshoe cares about.
+type feedItem struct {
+	Title string
+	Link  string
+	GUID  string
+}
+
+type rssDoc struct {
+	Channel struct {
+		TTL   int `xml:"ttl"`
+		Items []struct {
+			Title     string `xml:"title"`
+			Link      string `xml:"link"`
+			GUID      string `xml:"guid"`
+			Enclosure struct {
+				URL string `xml:"url,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomDoc struct {
+	Entries []struct {
+		Title string `xml:"title"`
+		ID    string `xml:"id"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// parseFeed decodes an RSS 2.0 or Atom document. The returned ttl is the
+// number of minutes the server asked clients to cache the feed, or 0.
+func parseFeed(b []byte) (items []feedItem, ttl int, err error) {
+	root := struct {
+		XMLName xml.Name
+	}{}
+	if err = xml.Unmarshal(b, &root); err != nil {
+		return nil, 0, fmt.Errorf("Invalid feed: %s", err)
+	}
+
+	switch root.XMLName.Local {
+	case "rss":
+		doc := rssDoc{}
+		if err = xml.Unmarshal(b, &doc); err != nil {
+			return nil, 0, err
+		}
+		for _, i := range doc.Channel.Items {
+			fi := feedItem{Title: i.Title, Link: i.Enclosure.URL, GUID: i.GUID}
+			if fi.Link == "" {
+				fi.Link = i.Link
+			}
+			items = append(items, fi)
+		}
+		ttl = doc.Channel.TTL
+	case "feed":
+		doc := atomDoc{}
+		if err = xml.Unmarshal(b, &doc); err != nil {
+			return nil, 0, err
+		}
+		for _, e := range doc.Entries {
+			fi := feedItem{Title: e.Title, GUID: e.ID}
+			for _, l := range e.Links {
+				if fi.Link == "" || l.Rel == "enclosure" {
+					fi.Link = l.Href
+				}
+			}
+			items = append(items, fi)
+		}
+	default:
+		return nil, 0, fmt.Errorf("Unknown feed type: %s", root.XMLName.Local)
+	}
+
+	for i := range items {
+		items[i].Title = strings.TrimSpace(items[i].Title)
+		items[i].Link = strings.TrimSpace(items[i].Link)
+		if items[i].GUID == "" {
+			items[i].GUID = items[i].Link
+		}
+	}
+	return items, ttl, nil
+}
+
+// RSSWatcher polls a single feed. Items are only handed to Handle once, the
+// first time they show up in the feed.
+type RSSWatcher struct {
+	Feed       RSSFeed
+	HttpClient *http.Client
+	Handle     func(title, link string) error
+
+	seen      map[string]bool
+	serverTtl int
+	stop      chan bool
+	// Set when the feed is a Torznab indexer.
+	torznab *Torznab
+}
+
+func NewRSSWatcher(f RSSFeed) *RSSWatcher {
+	f.Passkey = resolveSecret(f.Passkey)
+	w := &RSSWatcher{
+		Feed:       f,
+		HttpClient: &http.Client{Timeout: 30 * time.Second},
+		seen:       map[string]bool{},
+		stop:       make(chan bool),
+	}
+	// A bad regex leaves p nil, which uses the built-in release parser.
+	p, _ := compileEpisodeRegex(f.EpisodeRegexp)
+	if f.EpisodeRegexp == "" {
+		p = nil
+	}
+	w.Handle = func(title, link string) error {
+		return ProcessRelease("rss", title, link, p)
+	}
+	if f.isTorznab() {
+		w.torznab = NewTorznab(f)
+		w.torznab.HttpClient = w.HttpClient
+	}
+	return w
+}
+
+func (f RSSFeed) isTorznab() bool {
+	return strings.ToLower(f.Type) == feedTypeTorznab
+}
+
+// FeedURL fills in the passkey and uid. %passkey% and %uid% in the configured
+// URL are replaced, otherwise they are added as query parameters.
+func (w *RSSWatcher) FeedURL() (string, error) {
+	raw := strings.Replace(w.Feed.URL, "%passkey%", url.QueryEscape(w.Feed.Passkey), -1)
+	raw = strings.Replace(raw, "%uid%", url.QueryEscape(w.Feed.Uid), -1)
+	// A feed that doubles as the backlog search lists everything without one.
+	raw = strings.Replace(raw, searchQueryVar, "", -1)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.New("RSS feed URL must be absolute.")
+	}
+	q := u.Query()
+	if w.Feed.Passkey != "" && !strings.Contains(w.Feed.URL, "%passkey%") {
+		q.Set("passkey", w.Feed.Passkey)
+	}
+	if w.Feed.Uid != "" && !strings.Contains(w.Feed.URL, "%uid%") {
+		q.Set("uid", w.Feed.Uid)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Interval is how long to wait before the next poll.
+func (w *RSSWatcher) Interval() time.Duration {
+	ttl := w.Feed.RssTtl
+	if w.Feed.UseServerTtl && w.serverTtl > 0 {
+		ttl = w.serverTtl
+	}
+	d := time.Duration(ttl) * time.Minute
+	if d < minRSSPoll {
+		return minRSSPoll
+	}
+	return d
+}
+
+func (w *RSSWatcher) fetch() ([]feedItem, error) {
+	if w.torznab != nil {
+		// A search for nothing lists the latest releases.
+		res, err := w.torznab.TVSearch(TVQuery{})
+		if err != nil {
+			return nil, err
+		}
+		return torznabItems(res), nil
+	}
+	feed, err := w.FeedURL()
+	if err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(w.Feed.HttpMethod)
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, feed, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("RSS feed returned %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	items, ttl, err := parseFeed(body)
+	if err != nil {
+		return nil, err
+	}
+	w.serverTtl = ttl
+	return items, nil
+}
+
+// Poll fetches the feed once and hands every unseen item to Handle. It
+// returns the number of new items. Only the items still in the feed are
+// remembered, so seen doesn't grow for as long as gumshoe runs.
+func (w *RSSWatcher) Poll() (int, error) {
+	items, err := w.fetch()
+	if err != nil {
+		return 0, err
+	}
+	rssUpdateTimestamp.Set(time.Now().Unix())
+
+	n := 0
+	seen := map[string]bool{}
+	for _, i := range items {
+		if i.Title == "" || i.Link == "" {
+			continue
+		}
+		seen[i.GUID] = true
+		if w.seen[i.GUID] {
+			continue
+		}
+		n++
+		PrintDebugf("RSS: new item %s\n", i.Title)
+		if err := w.Handle(i.Title, i.Link); err != nil {
+			log.Println(err)
+		}
+	}
+	w.seen = seen
+	return n, nil
+}
+
+// Run polls the feed until Stop is called.
+func (w *RSSWatcher) Run() {
+	rssStatus.Set("Watching Feed")
+	for {
+		if _, err := w.Poll(); err != nil {
+			log.Printf("RSS poll failed: %s\n", err)
+			rssStatus.Set(fmt.Sprintf("Poll Error: %s", err))
+		} else {
+			rssStatus.Set("Watching Feed")
+		}
+		select {
+		case <-w.stop:
+			rssStatus.Set("Stopped")
+			return
+		case <-time.After(w.Interval()):
+		}
+	}
+}
+
+func (w *RSSWatcher) Stop() {
+	close(w.stop)
+}
+
+func _TrackRSSStatus() {
+	var w *RSSWatcher
+	for e := range RSSEnabled {
+		if e && w == nil {
+			w = NewRSSWatcher(currentConfig().RSS)
+			go w.Run()
+		} else if !e && w != nil {
+			w.Stop()
+			w = nil
+		}
+	}
+}
+
+func StartRSS() {
+	rssStatus.Set("Ready")
+	go _TrackRSSStatus()
+	rssRunning.Store(true)
+	RSSEnabled <- currentConfig().Operations.WatchMethods["rss"]
+}
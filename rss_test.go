@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRSSFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>Test Tracker</title>
+    <ttl>15</ttl>
+    <item>
+      <title>Walking.bread.S01E06.In.Enemy.Hands.1080p.WEB-DL.DD5.1.H.264-NTb</title>
+      <link>http://localhost/details.php?id=344553</link>
+      <guid>344553</guid>
+      <enclosure url="http://localhost/download.php/344553/Walking.bread.S01E06.torrent" type="application/x-bittorrent"/>
+    </item>
+    <item>
+      <title>the.thundermans.s02e22.one.hit.thunder.hdtv.x264-w4f</title>
+      <link>http://localhost/download.php/344547/the.thundermans.s02e22.torrent</link>
+    </item>
+  </channel>
+</rss>`
+
+var testAtomFeed = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Test Tracker</title>
+  <entry>
+    <title>daily.shown.2015.03.26.will.ferrell.1080p.hdtv.x264-daview</title>
+    <id>urn:344551</id>
+    <link rel="alternate" href="http://localhost/details.php?id=344551"/>
+    <link rel="enclosure" href="http://localhost/download.php/344551/daily.shown.torrent"/>
+  </entry>
+</feed>`
+
+func TestParseFeedRSS(t *testing.T) {
+	items, ttl, err := parseFeed([]byte(testRSSFeed))
+	assert.NoError(t, err)
+	assert.Equal(t, 15, ttl)
+	assert.Len(t, items, 2)
+	assert.Equal(t, "http://localhost/download.php/344553/Walking.bread.S01E06.torrent", items[0].Link)
+	assert.Equal(t, "344553", items[0].GUID)
+	assert.Equal(t, items[1].Link, items[1].GUID)
+}
+
+func TestParseFeedAtom(t *testing.T) {
+	items, ttl, err := parseFeed([]byte(testAtomFeed))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ttl)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "http://localhost/download.php/344551/daily.shown.torrent", items[0].Link)
+	assert.Equal(t, "urn:344551", items[0].GUID)
+
+	_, _, err = parseFeed([]byte("<html></html>"))
+	assert.Error(t, err)
+}
+
+func TestFeedURL(t *testing.T) {
+	w := NewRSSWatcher(RSSFeed{URL: "http://localhost/rss/%uid%/feed?passkey=%passkey%", Passkey: "abc", Uid: "42"})
+	u, err := w.FeedURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/rss/42/feed?passkey=abc", u)
+
+	w = NewRSSWatcher(RSSFeed{URL: "http://localhost/rss", Passkey: "abc", Uid: "42"})
+	u, err = w.FeedURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost/rss?passkey=abc&uid=42", u)
+
+	w = NewRSSWatcher(RSSFeed{URL: "not a feed"})
+	_, err = w.FeedURL()
+	assert.Error(t, err)
+}
+
+func TestRSSInterval(t *testing.T) {
+	w := NewRSSWatcher(RSSFeed{RssTtl: 10})
+	assert.Equal(t, 10*time.Minute, w.Interval())
+	w.serverTtl = 15
+	assert.Equal(t, 10*time.Minute, w.Interval())
+	w.Feed.UseServerTtl = true
+	assert.Equal(t, 15*time.Minute, w.Interval())
+	w.Feed.RssTtl = 0
+	w.serverTtl = 0
+	assert.Equal(t, minRSSPoll, w.Interval())
+}
+
+func TestRSSPoll(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "abc", r.URL.Query().Get("passkey"))
+		fmt.Fprint(w, testRSSFeed)
+	}))
+	defer ts.Close()
+
+	handled := []string{}
+	w := NewRSSWatcher(RSSFeed{URL: ts.URL, Passkey: "abc", RssTtl: 5, UseServerTtl: true})
+	w.Handle = func(title, link string) error {
+		handled = append(handled, link)
+		return nil
+	}
+
+	n, err := w.Poll()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, handled, 2)
+	assert.Equal(t, 15*time.Minute, w.Interval())
+
+	// Items already seen are not handed off a second time.
+	n, err = w.Poll()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Len(t, handled, 2)
+
+	// Items that dropped out of the feed are forgotten.
+	w.seen["gone"] = true
+	_, err = w.Poll()
+	assert.NoError(t, err)
+	assert.Len(t, w.seen, 2)
+	assert.NotContains(t, w.seen, "gone")
+}
+
+func TestRSSPollError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	w := NewRSSWatcher(RSSFeed{URL: ts.URL})
+	_, err := w.Poll()
+	assert.Error(t, err)
+}
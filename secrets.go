@@ -0,0 +1,340 @@
+/* Secrets Store
+ *
+ * Passwords, passkeys and the tracker cookie jar are kept in one file sealed
+ * with NaCl secretbox. The key is derived with scrypt from a passphrase, which
+ * is read from a keyfile (-k) or the GUMSHOE_PASSPHRASE environment variable.
+ *
+ * Config fields holding a password can name a secret instead of holding the
+ * password itself, e.g. "torrent_pass": "secret:transmission". A plain text
+ * tracker.cj from before the store was set up is moved into it.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	secretsFileName = "secrets.box"
+	secretsMagic    = "GSS1"
+	secretRefPrefix = "secret:"
+	// The tracker cookies are kept in the store under this name.
+	cookieJarSecret = "tracker_cookies"
+	redactedValue   = "********"
+)
+
+var (
+	// scrypt cost, tests turn it down.
+	scryptN = 1 << 15
+
+	secrets *SecretStore
+
+	ErrNoSecrets = errors.New("No secrets store is open. Set GUMSHOE_PASSPHRASE or use -k.")
+)
+
+type SecretStore struct {
+	path    string
+	key     [32]byte
+	salt    []byte
+	secrets map[string]string
+	lock    sync.Mutex
+}
+
+func deriveSecretsKey(passphrase, salt []byte) (key [32]byte, err error) {
+	k, err := scrypt.Key(passphrase, salt, scryptN, 8, 1, 32)
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], k)
+	return key, nil
+}
+
+// OpenSecretStore unseals the store at path, or starts an empty one if the
+// file doesn't exist yet. A wrong passphrase is an error.
+func OpenSecretStore(path string, passphrase []byte) (*SecretStore, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("The secrets passphrase is empty.")
+	}
+	s := &SecretStore{path: path, secrets: map[string]string{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.salt = make([]byte, 32)
+		if _, err = io.ReadFull(rand.Reader, s.salt); err != nil {
+			return nil, err
+		}
+		s.key, err = deriveSecretsKey(passphrase, s.salt)
+		return s, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(b) < len(secretsMagic)+32+24+secretbox.Overhead || string(b[:len(secretsMagic)]) != secretsMagic {
+		return nil, fmt.Errorf("%s is not a gumshoe secrets file.", path)
+	}
+	b = b[len(secretsMagic):]
+	s.salt = b[:32]
+	var nonce [24]byte
+	copy(nonce[:], b[32:56])
+	if s.key, err = deriveSecretsKey(passphrase, s.salt); err != nil {
+		return nil, err
+	}
+	plain, ok := secretbox.Open(nil, b[56:], &nonce, &s.key)
+	if !ok {
+		return nil, fmt.Errorf("Unable to unseal %s, the passphrase is wrong.", path)
+	}
+	if err = json.Unmarshal(plain, &s.secrets); err != nil {
+		return nil, fmt.Errorf("Secrets in %s are corrupt: %s", path, err)
+	}
+	return s, nil
+}
+
+// Save seals the store with a fresh nonce and replaces the file.
+func (s *SecretStore) Save() error {
+	s.lock.Lock()
+	plain, err := json.Marshal(s.secrets)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	out := bytes.NewBufferString(secretsMagic)
+	out.Write(s.salt)
+	out.Write(nonce[:])
+	out.Write(secretbox.Seal(nil, plain, &nonce, &s.key))
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(out.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Get is safe to call when no store is open.
+func (s *SecretStore) Get(name string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, ok := s.secrets[name]
+	return v, ok
+}
+
+// Set stores a secret and saves the store.
+func (s *SecretStore) Set(name, value string) error {
+	if s == nil {
+		return ErrNoSecrets
+	}
+	if name == "" {
+		return errors.New("A secret needs a name.")
+	}
+	s.lock.Lock()
+	s.secrets[name] = value
+	s.lock.Unlock()
+	return s.Save()
+}
+
+func (s *SecretStore) Delete(name string) error {
+	if s == nil {
+		return ErrNoSecrets
+	}
+	s.lock.Lock()
+	_, ok := s.secrets[name]
+	delete(s.secrets, name)
+	s.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("No secret named %s.", name)
+	}
+	return s.Save()
+}
+
+// Names lists the secrets in the store, never their values.
+func (s *SecretStore) Names() []string {
+	names := []string{}
+	if s == nil {
+		return names
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for n := range s.secrets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// secretsPassphrase reads the passphrase from the keyfile, falling back to
+// the environment.
+func secretsPassphrase(keyfile string) ([]byte, error) {
+	if keyfile != "" {
+		b, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read keyfile: %s", err)
+		}
+		return bytes.TrimSpace(b), nil
+	}
+	return []byte(os.Getenv("GUMSHOE_PASSPHRASE")), nil
+}
+
+// OpenSecrets opens the store in the user's data directory. Without a
+// passphrase gumshoe runs without one, and secret references can't be used.
+func OpenSecrets(keyfile string) error {
+	p, err := secretsPassphrase(keyfile)
+	if err != nil {
+		return err
+	}
+	f := CreateLocalPath(currentConfig(), secretsFileName)
+	if len(p) == 0 {
+		if _, err := os.Stat(f); err == nil {
+			log.Printf("[WARN] %s exists but no passphrase was given, secrets are unavailable.\n", f)
+		}
+		return nil
+	}
+	s, err := OpenSecretStore(f, p)
+	if err != nil {
+		return err
+	}
+	secrets = s
+	if err = importCookieFile(CreateLocalPath(currentConfig(), "tracker.cj")); err != nil {
+		log.Printf("[ERROR] Unable to move the tracker cookies into the secrets store: %s\n", err)
+	}
+	return nil
+}
+
+// importCookieFile moves the tracker cookies in the plain text file f into
+// the secrets store, and deletes f.
+func importCookieFile(f string) error {
+	b, err := ioutil.ReadFile(f)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, &tempCookies{}); err != nil {
+		return fmt.Errorf("%s is not a cookie file: %s", f, err)
+	}
+	if err = secrets.Set(cookieJarSecret, string(b)); err != nil {
+		return err
+	}
+	log.Printf("Moved the tracker cookies in %s into the secrets store.\n", f)
+	return os.Remove(f)
+}
+
+func isSecretRef(v string) bool {
+	return strings.HasPrefix(v, secretRefPrefix)
+}
+
+// resolveSecret returns the value a config field refers to. Values that
+// aren't secret references are returned as they are.
+func resolveSecret(v string) string {
+	if !isSecretRef(v) {
+		return v
+	}
+	name := strings.TrimPrefix(v, secretRefPrefix)
+	s, ok := secrets.Get(name)
+	if !ok {
+		log.Printf("[ERROR] Secret %s is not in the secrets store.\n", name)
+	}
+	return s
+}
+
+func redact(v string) string {
+	if v == "" || isSecretRef(v) {
+		return v
+	}
+	return redactedValue
+}
+
+// unredact keeps the old value of a field that came back redacted.
+func unredact(v, old string) string {
+	if v == redactedValue {
+		return old
+	}
+	return v
+}
+
+// Redacted is a copy of the config that is safe to show. Passwords and URLs
+// that can carry a key, like webhooks and the backlog search, are masked.
+// References to secrets are left as they are.
+func (tc *TrackerConfig) Redacted() *TrackerConfig {
+	r := *tc
+	r.IRC = make(IRCChannels, len(tc.IRC))
+	for i, c := range tc.IRC {
+		c.Key = redact(c.Key)
+		r.IRC[i] = c
+	}
+	r.Download.TorrentPass = redact(tc.Download.TorrentPass)
+	r.RSS.Passkey = redact(tc.RSS.Passkey)
+	r.Operations.PasswordHash = redact(tc.Operations.PasswordHash)
+	r.Backlog.SearchURL = redact(tc.Backlog.SearchURL)
+	r.Notifications = make([]Notifier, len(tc.Notifications))
+	for i, n := range tc.Notifications {
+		n.SMTPPassword = redact(n.SMTPPassword)
+		n.URL = redact(n.URL)
+		r.Notifications[i] = n
+	}
+	return &r
+}
+
+// restoreRedacted puts back the passwords from old into any field of tc that
+// still holds the redacted placeholder, so a redacted config can be edited
+// and sent back.
+func (tc *TrackerConfig) restoreRedacted(old *TrackerConfig) {
+	for i, c := range tc.IRC {
+		oc, _ := old.IRC.Get(c.Name)
+		tc.IRC[i].Key = unredact(c.Key, oc.Key)
+	}
+	tc.Download.TorrentPass = unredact(tc.Download.TorrentPass, old.Download.TorrentPass)
+	tc.RSS.Passkey = unredact(tc.RSS.Passkey, old.RSS.Passkey)
+	tc.Operations.PasswordHash = unredact(tc.Operations.PasswordHash, old.Operations.PasswordHash)
+	tc.Backlog.SearchURL = unredact(tc.Backlog.SearchURL, old.Backlog.SearchURL)
+	for i, n := range tc.Notifications {
+		for _, on := range old.Notifications {
+			if on.Name == n.Name {
+				tc.Notifications[i].SMTPPassword = unredact(n.SMTPPassword, on.SMTPPassword)
+				tc.Notifications[i].URL = unredact(n.URL, on.URL)
+				break
+			}
+		}
+	}
+}
+
+// ImportCookies replaces the tracker cookie jar in the secrets store.
+func ImportCookies(c *tempCookies) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err = secrets.Set(cookieJarSecret, string(b)); err != nil {
+		return err
+	}
+	return reloadCookies()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSecrets(t *testing.T) (string, func()) {
+	scryptN = 1 << 10
+	dir, err := ioutil.TempDir("", "gumshoe")
+	assert.NoError(t, err)
+	return filepath.Join(dir, secretsFileName), func() { os.RemoveAll(dir) }
+}
+
+func TestSecretStore(t *testing.T) {
+	f, cleanup := tempSecrets(t)
+	defer cleanup()
+
+	s, err := OpenSecretStore(f, []byte("hunter2"))
+	assert.NoError(t, err)
+	assert.Empty(t, s.Names())
+	assert.NoError(t, s.Set("irc", "ircpass"))
+	assert.NoError(t, s.Set("transmission", "tpass"))
+
+	b, err := ioutil.ReadFile(f)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "ircpass")
+
+	s, err = OpenSecretStore(f, []byte("hunter2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"irc", "transmission"}, s.Names())
+	v, ok := s.Get("irc")
+	assert.True(t, ok)
+	assert.Equal(t, "ircpass", v)
+
+	assert.NoError(t, s.Delete("irc"))
+	assert.Error(t, s.Delete("irc"))
+
+	_, err = OpenSecretStore(f, []byte("wrong"))
+	assert.Error(t, err)
+	_, err = OpenSecretStore(f, nil)
+	assert.Error(t, err)
+
+	var none *SecretStore
+	_, ok = none.Get("irc")
+	assert.False(t, ok)
+	assert.Equal(t, ErrNoSecrets, none.Set("irc", "x"))
+}
+
+func TestSecretRefsAndRedaction(t *testing.T) {
+	f, cleanup := tempSecrets(t)
+	defer cleanup()
+	s, err := OpenSecretStore(f, []byte("hunter2"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("transmission", "tpass"))
+	orig := secrets
+	secrets = s
+	defer func() { secrets = orig }()
+
+	assert.Equal(t, "tpass", resolveSecret("secret:transmission"))
+	assert.Equal(t, "", resolveSecret("secret:missing"))
+	assert.Equal(t, "plain", resolveSecret("plain"))
+
+	c := &TrackerConfig{
+		IRC:      IRCChannels{{Name: "one", Key: "ircpass"}},
+		Download: Download{TorrentPass: "secret:transmission"},
+		RSS:      RSSFeed{Passkey: "abc123"},
+		Backlog:  Backlog{SearchURL: "http://tracker.test/search?passkey=abc123&q=%query%"},
+		Notifications: []Notifier{
+			{Name: "hook", Type: notifyWebhook, URL: "https://hooks.test/services/T0/B0/token"},
+		},
+	}
+	r := c.Redacted()
+	assert.Equal(t, redactedValue, r.IRC[0].Key)
+	assert.Equal(t, redactedValue, r.Backlog.SearchURL)
+	assert.Equal(t, redactedValue, r.Notifications[0].URL)
+	assert.Equal(t, "secret:transmission", r.Download.TorrentPass)
+	assert.Equal(t, redactedValue, r.RSS.Passkey)
+	assert.Equal(t, "ircpass", c.IRC[0].Key)
+	assert.NotContains(t, r.String(), "abc123")
+
+	assert.NotContains(t, r.String(), "token")
+
+	r.RSS.Passkey = "newkey"
+	r.restoreRedacted(c)
+	assert.Equal(t, "ircpass", r.IRC[0].Key)
+	assert.Equal(t, "newkey", r.RSS.Passkey)
+	assert.Equal(t, c.Backlog.SearchURL, r.Backlog.SearchURL)
+	assert.Equal(t, c.Notifications[0].URL, r.Notifications[0].URL)
+}
+
+func TestCookiesFromSecrets(t *testing.T) {
+	f, cleanup := tempSecrets(t)
+	defer cleanup()
+	s, err := OpenSecretStore(f, []byte("hunter2"))
+	assert.NoError(t, err)
+	origSecrets, origTc, origCj := secrets, currentConfig(), GetTrackerCookies()
+	defer func() {
+		secrets = origSecrets
+		origTc.SetGlobalTrackerConfig()
+		useTrackerCookies(origCj)
+	}()
+	secrets = s
+	(&TrackerConfig{
+		Directories: map[string]string{"user_dir": filepath.Dir(f)},
+		Download:    Download{Secure: true},
+	}).SetGlobalTrackerConfig()
+
+	err = ImportCookies(&tempCookies{Cookies: []map[string]string{
+		{"Name": "uid", "Value": "1", "Domain": "tracker.test", "Path": "/", "Expires": "1900000000"},
+	}})
+	assert.NoError(t, err)
+	if assert.Len(t, GetTrackerCookies(), 1) {
+		assert.Equal(t, "uid", GetTrackerCookies()[0].Name)
+	}
+
+	s, err = OpenSecretStore(f, []byte("hunter2"))
+	assert.NoError(t, err)
+	_, ok := s.Get(cookieJarSecret)
+	assert.True(t, ok)
+}
+
+func TestImportCookieFile(t *testing.T) {
+	f, cleanup := tempSecrets(t)
+	defer cleanup()
+	origSecrets, origTc := secrets, currentConfig()
+	defer func() {
+		secrets = origSecrets
+		origTc.SetGlobalTrackerConfig()
+	}()
+	os.Setenv("GUMSHOE_PASSPHRASE", "hunter2")
+	defer os.Unsetenv("GUMSHOE_PASSPHRASE")
+	(&TrackerConfig{Directories: map[string]string{"user_dir": filepath.Dir(f)}}).SetGlobalTrackerConfig()
+
+	cj := filepath.Join(filepath.Dir(f), "tracker.cj")
+	jar := `{"Cookies": [{"Name": "uid", "Value": "1", "Domain": "tracker.test"}]}`
+	assert.NoError(t, ioutil.WriteFile(cj, []byte(jar), 0600))
+	assert.NoError(t, OpenSecrets(""))
+	v, ok := secrets.Get(cookieJarSecret)
+	assert.True(t, ok)
+	assert.Equal(t, jar, v)
+	_, err := os.Stat(cj)
+	assert.True(t, os.IsNotExist(err), "The plain text cookie file is still there.")
+
+	// A file that isn't a cookie jar is left alone.
+	assert.NoError(t, ioutil.WriteFile(cj, []byte("nope"), 0600))
+	assert.NoError(t, OpenSecrets(""))
+	v, _ = secrets.Get(cookieJarSecret)
+	assert.Equal(t, jar, v)
+	_, err = os.Stat(cj)
+	assert.NoError(t, err)
+}
@@ -6,9 +6,10 @@
 package main
 
 import (
+  "fmt"
+  "log"
+  "strings"
   "time"
-
-  //"github.com/garfunkel/go-tvdb"
 )
 
 type Show struct {
@@ -18,6 +19,30 @@ type Show struct {
 	Quality    string `json:"quality"`
 	Episodal   bool   `json:"episodal"`
 	LastUpdate int64  `json:"last_update"`
+	// Filled in by the metadata provider.
+	MetadataID     uint64 `json:"metadata_id"`
+	CanonicalTitle string `json:"canonical_title"`
+	// Episodes before this one aren't wanted, e.g. 3 and 1 to start at S03E01.
+	StartSeason  int `json:"start_season"`
+	StartEpisode int `json:"start_episode"`
+	// Daily show options. MaxAge skips episodes that aired more than that
+	// many days ago, 0 means any age.
+	SkipWeekends bool `json:"skip_weekends"`
+	SkipReruns   bool `json:"skip_reruns"`
+	MaxAge       int  `json:"max_age_days"`
+	// Season packs are only taken when SeasonPacks is set, and then only when
+	// at least PackThreshold percent of the season's episodes are wanted. 0
+	// takes any pack with a wanted episode in it.
+	SeasonPacks   bool `json:"season_packs"`
+	PackThreshold int  `json:"pack_threshold"`
+}
+
+// Other titles a show is released under.
+type ShowAlias struct {
+	ID     int64  `json:"id"`
+	ShowID int64  `json:"show_id"`
+	Alias  string `json:"alias" binding:"required"`
+	Source string `json:"source"`
 }
 
 func newShow(t, q string, e bool) *Show {
@@ -29,12 +54,46 @@ func newShow(t, q string, e bool) *Show {
 	}
 }
 
+// Start User Functions
+
+// AddShow stores a new show. With a metadata provider configured the show is
+// looked up first, and its aliases and episodes are added along with it. A
+// failed lookup doesn't stop the show from being added.
 func (s *Show) AddShow() error {
+	var info *ShowInfo
+	if metadataProvider != nil {
+		var err error
+		if info, err = s.lookupShowMetadata(metadataProvider); err != nil {
+			log.Printf("Unable to find %s with the metadata provider: %s\n", s.Title, err)
+		}
+	}
 	err := gDb.Insert(s)
-	return err
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		if err = s.addAliases(info.Aliases); err != nil {
+			log.Printf("Unable to add aliases of %s: %s\n", s.Title, err)
+		}
+		if n, err := s.seedWantedEpisodes(metadataProvider); err != nil {
+			log.Printf("Unable to add episodes of %s: %s\n", s.Title, err)
+		} else {
+			PrintDebugf("Added %d wanted episodes of %s.\n", n, s.Title)
+		}
+	}
+	return s.ApplyStart()
 }
 
+// DeleteShow removes the show along with its aliases, episodes, releases and
+// queued fetches.
 func (s *Show) DeleteShow() error {
+	checkDBLock <- 1
+	defer func() { <-checkDBLock }()
+	for _, t := range []string{"show_alias", "episode", "release", "queue"} {
+		if _, err := gDb.Exec(fmt.Sprintf("delete from %s where ShowID=?", t), s.ID); err != nil {
+			return err
+		}
+	}
 	_, err := gDb.Exec("delete from show where ID=?", s.ID)
 	return err
 }
@@ -46,20 +105,138 @@ func (s *Show) UpdateShow() error {
 	return err
 }
 
+// Skips explains why the show's settings rule out e, and is empty when they
+// don't.
+func (s *Show) Skips(e *Episode) string {
+	if s.beforeStart(e) {
+		return fmt.Sprintf("Episode is before the start of the show at S%02dE%02d.", s.StartSeason, s.StartEpisode)
+	}
+	if !e.IsDaily() {
+		return ""
+	}
+	switch {
+	case s.SkipWeekends && e.AirDate.Weekend():
+		return fmt.Sprintf("Episode aired on a %s, weekends are skipped.", e.AirDate.Weekday())
+	case s.SkipReruns && e.Rerun:
+		return "Episode is a rerun, reruns are skipped."
+	case s.MaxAge > 0 && e.AirDate.Before(Today().AddDate(0, 0, -s.MaxAge)):
+		return fmt.Sprintf("Episode aired more than %d days ago.", s.MaxAge)
+	}
+	return ""
+}
+
+// AllowsQuality checks the quality of the release name r against the show's
+// quality profile.
+func (s *Show) AllowsQuality(r string) bool {
+	return QualityProfileFor(s.Quality).Allows(qualityOfName(r))
+}
+
+// SetOptions copies the settings a user can change from o.
+func (s *Show) SetOptions(o Show) {
+	s.StartSeason, s.StartEpisode = o.StartSeason, o.StartEpisode
+	s.SkipWeekends, s.SkipReruns, s.MaxAge = o.SkipWeekends, o.SkipReruns, o.MaxAge
+	s.SeasonPacks, s.PackThreshold = o.SeasonPacks, o.PackThreshold
+}
+
+// beforeStart reports whether e comes before the show's start point.
+func (s *Show) beforeStart(e *Episode) bool {
+	if !s.Episodal || s.StartSeason == 0 {
+		return false
+	}
+	return e.Season < s.StartSeason || (e.Season == s.StartSeason && e.Episode < s.StartEpisode)
+}
+
+// ApplyStart skips the wanted episodes before the show's start point and
+// adds the start episode itself as wanted.
+func (s *Show) ApplyStart() error {
+	if !s.Episodal || s.StartSeason == 0 {
+		return nil
+	}
+	checkDBLock <- 1
+	_, err := gDb.Exec("update episode set State=? where ShowID=? and State=? and (Season<? or (Season=? and Episode<?))",
+		EpisodeSkipped, s.ID, EpisodeWanted, s.StartSeason, s.StartSeason, s.StartEpisode)
+	<-checkDBLock
+	if err != nil {
+		return err
+	}
+	e := &Episode{ShowID: s.ID, Season: s.StartSeason, Episode: s.StartEpisode, State: EpisodeWanted}
+	if e.Episode == 0 {
+		e.Episode = 1
+	}
+	if _, err = e.findExisting(); err == nil {
+		return nil
+	}
+	e.Added = time.Now().UnixNano()
+	checkDBLock <- 1
+	err = gDb.Insert(e)
+	<-checkDBLock
+	return err
+}
+
 func ListShows() ([]Show, error) {
 	shows := []Show{}
+	checkDBLock <- 1
 	_, err := gDb.Select(&shows, "select * from show order by Title")
+	<-checkDBLock
 	return shows, err
 }
 
 func GetShow(id int64) (Show, error) {
 	show := Show{}
+	checkDBLock <- 1
 	err := gDb.SelectOne(&show, "select * from show where ID=?", id)
+	<-checkDBLock
 	return show, err
 }
 
+// addAliases stores the canonical title and other titles of the show.
+func (s *Show) addAliases(aliases []string) error {
+	for _, a := range append([]string{s.CanonicalTitle}, aliases...) {
+		if err := s.AddAlias(a, "metadata"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddAlias stores another title for the show. Titles it already has are
+// skipped.
+func (s *Show) AddAlias(alias, source string) error {
+	alias = strings.TrimSpace(alias)
+	if alias == "" || strings.EqualFold(alias, s.Title) {
+		return nil
+	}
+	old, err := GetAliases(s.ID)
+	if err != nil {
+		return err
+	}
+	for _, a := range old {
+		if strings.EqualFold(a.Alias, alias) {
+			return nil
+		}
+	}
+	return gDb.Insert(&ShowAlias{ShowID: s.ID, Alias: alias, Source: source})
+}
+
+func GetAliases(sid int64) ([]ShowAlias, error) {
+	aliases := []ShowAlias{}
+	_, err := gDb.Select(&aliases, "select * from show_alias where ShowID=? order by Alias", sid)
+	return aliases, err
+}
+
+func DeleteAlias(sid, id int64) error {
+	_, err := gDb.Exec("delete from show_alias where ShowID=? and ID=?", sid, id)
+	return err
+}
+
+// GetShowByTitle finds the show a title belongs to, allowing for aliases and
+// small differences in spelling. See MatchShow.
 func GetShowByTitle(title string) (Show, error) {
-	show := Show{}
-	err := gDb.SelectOne(&show, "select * from show where Title like '%%?%%'", episodeRewriter(title))
-	return show, err
+	matches, err := MatchShow(title)
+	if err != nil {
+		return Show{}, err
+	}
+	return bestShowMatch(title, matches)
 }
+
+// End User Functions
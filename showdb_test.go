@@ -14,9 +14,10 @@ var testDataDir string
 
 func TestMain(m *testing.M) {
 	flag.Parse()
-	tc = NewTrackerConfig()
+	tc := NewTrackerConfig()
 	tc.LoadGumshoeConfig(configFile)
 	tc.Operations.Debug = true
+	tc.SetGlobalTrackerConfig()
 
 	err := InitDb()
 	if err != nil {
@@ -99,3 +100,21 @@ func TestGetShowByTitle(t *testing.T) {
 		t.Errorf("show objects do not match.\nExpected: %s\nActual: %s\n", expected, s)
 	}
 }
+
+func TestDeleteShow(t *testing.T) {
+	s := newShow("Deleted Show", "720p", true)
+	assert.NoError(t, s.AddShow())
+	assert.NoError(t, s.AddAlias("Removed Show", "user"))
+	assert.NoError(t, gDb.Insert(&Episode{ShowID: s.ID, Season: 1, Episode: 1, State: EpisodeWanted}))
+	assert.NoError(t, (&ReleaseRecord{ShowID: s.ID, Name: "Deleted.Show.S01E01.720p"}).AddRelease())
+	assert.NoError(t, gDb.Insert(&QueueItem{ShowID: s.ID, URL: "http://localhost/1.torrent", State: QueuePending}))
+
+	assert.NoError(t, s.DeleteShow())
+	_, err := GetShow(s.ID)
+	assert.Error(t, err)
+	for _, table := range []string{"show_alias", "episode", "release", "queue"} {
+		n, err := gDb.SelectInt("select count(*) from "+table+" where ShowID=?", s.ID)
+		assert.NoError(t, err)
+		assert.Zero(t, n, table)
+	}
+}
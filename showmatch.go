@@ -0,0 +1,314 @@
+/* Show Title Matching
+ *
+ * Release names rarely spell a show the way we do: punctuation is dropped,
+ * years and countries are tacked on and "The" comes and goes. Titles and
+ * aliases are normalized before they are compared, and near misses are
+ * scored. A release that could be more than one show, or that only just
+ * resembles one, goes on a review list instead of being guessed at.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// Scores range from 0 to 1. A title scoring at least matchThreshold against
+	// a single show is a match, anything between reviewThreshold and that
+	// needs a person to look at it.
+	matchThreshold  = 0.85
+	reviewThreshold = 0.6
+	// Two shows scoring within this much of each other are ambiguous.
+	matchMargin = 0.05
+
+	titleYear    = regexp.MustCompile(`^(19|20)\d{2}$`)
+	titleCountry = map[string]bool{"us": true, "uk": true, "au": true, "nz": true, "ca": true}
+
+	ErrShowNotTracked = errors.New("The show is not being tracked.")
+)
+
+// normalizeTitle reduces a title to lowercase words without punctuation, a
+// leading "The", or a trailing year or country code. Letters split up by
+// dots, as in S.H.I.E.L.D, are joined back into one word.
+func normalizeTitle(s string) string {
+	words, _ := splitTitle(s)
+	return strings.Join(words, " ")
+}
+
+// titleQualifiers returns the year and country codes normalizeTitle strips
+// from the end of a title. They tell apart shows that only differ in them.
+func titleQualifiers(s string) map[string]bool {
+	_, q := splitTitle(s)
+	m := map[string]bool{}
+	for _, w := range q {
+		m[w] = true
+	}
+	return m
+}
+
+func splitTitle(s string) (words, qualifiers []string) {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "&", " and ", -1)
+	s = strings.NewReplacer("'", "", "’", "").Replace(s)
+	words = strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	joined := []string{}
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		for utf8.RuneCountInString(words[i]) == 1 && i+1 < len(words) && utf8.RuneCountInString(words[i+1]) == 1 {
+			i++
+			w += words[i]
+		}
+		joined = append(joined, w)
+	}
+	words = joined
+
+	if len(words) > 1 && words[0] == "the" {
+		words = words[1:]
+	}
+	for len(words) > 1 {
+		last := words[len(words)-1]
+		if !titleYear.MatchString(last) && !titleCountry[last] {
+			break
+		}
+		qualifiers = append(qualifiers, last)
+		words = words[:len(words)-1]
+	}
+	return words, qualifiers
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// titleScore compares two normalized titles. 1 is identical.
+func titleScore(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+	l := utf8.RuneCountInString(a)
+	if n := utf8.RuneCountInString(b); n > l {
+		l = n
+	}
+	return 1 - float64(levenshtein(a, b))/float64(l)
+}
+
+type ShowMatch struct {
+	Show  Show    `json:"show"`
+	Title string  `json:"title"` // the title or alias that matched
+	Score float64 `json:"score"`
+	// The title is spelled exactly like the show's title or an alias.
+	Exact bool `json:"exact"`
+	// The title's year or country is the same as the show's.
+	Qualified bool `json:"qualified,omitempty"`
+}
+
+// MatchShow scores a title against every tracked show and its aliases. Shows
+// scoring at least reviewThreshold are returned, best first.
+func MatchShow(title string) ([]ShowMatch, error) {
+	shows, err := ListShows()
+	if err != nil {
+		return nil, err
+	}
+	aliases := []ShowAlias{}
+	if _, err = gDb.Select(&aliases, "select * from show_alias"); err != nil {
+		return nil, err
+	}
+	byShow := map[int64][]string{}
+	for _, a := range aliases {
+		byShow[a.ShowID] = append(byShow[a.ShowID], a.Alias)
+	}
+
+	n := normalizeTitle(title)
+	q := titleQualifiers(title)
+	matches := []ShowMatch{}
+	for _, s := range shows {
+		best := ShowMatch{Show: s}
+		for _, t := range append([]string{s.Title}, byShow[s.ID]...) {
+			exact := strings.EqualFold(strings.TrimSpace(title), t)
+			if score := titleScore(n, normalizeTitle(t)); score > best.Score || (exact && !best.Exact) {
+				best.Score = score
+				best.Title = t
+				best.Exact = exact
+			}
+			for w := range titleQualifiers(t) {
+				best.Qualified = best.Qualified || q[w]
+			}
+		}
+		if best.Score >= reviewThreshold {
+			matches = append(matches, best)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches, nil
+}
+
+// AmbiguousMatchError is returned when a title can't be matched to a show
+// with enough confidence.
+type AmbiguousMatchError struct {
+	Title      string
+	Candidates []ShowMatch
+}
+
+func (e *AmbiguousMatchError) Error() string {
+	names := []string{}
+	for _, c := range e.Candidates {
+		names = append(names, fmt.Sprintf("%s (%.2f)", c.Show.Title, c.Score))
+	}
+	return fmt.Sprintf("%s could be %s.", e.Title, strings.Join(names, " or "))
+}
+
+// bestShowMatch picks the show a title belongs to. It fails with
+// ErrShowNotTracked when nothing is close, and an *AmbiguousMatchError when
+// there is no clear winner. A title spelled exactly like one show's title or
+// alias always goes to that show, and of shows scoring about the same the one
+// with the title's year or country wins.
+func bestShowMatch(title string, matches []ShowMatch) (Show, error) {
+	if len(matches) == 0 {
+		return Show{}, ErrShowNotTracked
+	}
+	exact := []ShowMatch{}
+	for _, m := range matches {
+		if m.Exact {
+			exact = append(exact, m)
+		}
+	}
+	if len(exact) == 1 {
+		return exact[0].Show, nil
+	}
+	best := matches[0]
+	qualified := []ShowMatch{}
+	for _, m := range matches {
+		if m.Qualified && m.Score >= best.Score-matchMargin {
+			qualified = append(qualified, m)
+		}
+	}
+	if len(qualified) == 1 && qualified[0].Score >= matchThreshold {
+		return qualified[0].Show, nil
+	}
+	clear := len(matches) == 1 || matches[1].Score < best.Score-matchMargin ||
+		(best.Score == 1 && matches[1].Score < 1)
+	if best.Score >= matchThreshold && clear {
+		return best.Show, nil
+	}
+	return Show{}, &AmbiguousMatchError{Title: title, Candidates: matches}
+}
+
+// A release whose show couldn't be picked with confidence. Picking a show
+// adds the title as an alias, so the next release matches on its own.
+type MatchReview struct {
+	ID         int64  `json:"id"`
+	Title      string `json:"title"`
+	Release    string `json:"release"`
+	Link       string `json:"link"`
+	Candidates string `json:"candidates"` // JSON list of ShowMatch
+	Added      int64  `json:"added"`
+}
+
+// AddMatchReview puts a release on the review list. A release that is
+// already there isn't added again.
+func AddMatchReview(release, link string, am *AmbiguousMatchError) (*MatchReview, error) {
+	c, err := json.Marshal(am.Candidates)
+	if err != nil {
+		return nil, err
+	}
+	checkDBLock <- 1
+	defer func() { <-checkDBLock }()
+	have := MatchReview{}
+	if err := gDb.SelectOne(&have, "select * from match_review where Release=?", release); err == nil {
+		return &have, nil
+	}
+	r := &MatchReview{
+		Title:      am.Title,
+		Release:    release,
+		Link:       link,
+		Candidates: string(c),
+		Added:      time.Now().Unix(),
+	}
+	return r, gDb.Insert(r)
+}
+
+func ListMatchReviews() ([]MatchReview, error) {
+	reviews := []MatchReview{}
+	checkDBLock <- 1
+	_, err := gDb.Select(&reviews, "select * from match_review order by Added")
+	<-checkDBLock
+	return reviews, err
+}
+
+func GetMatchReview(id int64) (MatchReview, error) {
+	r := MatchReview{}
+	err := gDb.SelectOne(&r, "select * from match_review where ID=?", id)
+	return r, err
+}
+
+func DeleteMatchReview(id int64) error {
+	checkDBLock <- 1
+	_, err := gDb.Exec("delete from match_review where ID=?", id)
+	<-checkDBLock
+	return err
+}
+
+// ResolveMatchReview settles a review by picking the show the release
+// belongs to. The title becomes an alias of the show and the release is sent
+// through the pipeline again.
+func ResolveMatchReview(id, sid int64) error {
+	r, err := GetMatchReview(id)
+	if err != nil {
+		return err
+	}
+	show, err := GetShow(sid)
+	if err != nil {
+		return err
+	}
+	if err = show.AddAlias(r.Title, "review"); err != nil {
+		return err
+	}
+	if err = DeleteMatchReview(id); err != nil {
+		return err
+	}
+	if r.Link != "" {
+		return ProcessRelease("review", r.Release, r.Link, nil)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTitle(t *testing.T) {
+	for in, want := range map[string]string{
+		"Marvels.Agents.of.S.H.I.E.L.D":   "marvels agents of shield",
+		"Marvel's Agents of S.H.I.E.L.D.": "marvels agents of shield",
+		"The Office US":                   "office",
+		"The Office (UK)":                 "office",
+		"Conan 2015":                      "conan",
+		"Law & Order: SVU":                "law and order svu",
+		"1883":                            "1883",
+		"The":                             "the",
+		"X Company":                       "x company",
+	} {
+		assert.Equal(t, want, normalizeTitle(in), in)
+	}
+}
+
+func TestTitleScore(t *testing.T) {
+	assert.Equal(t, 1.0, titleScore("conan", "conan"))
+	assert.True(t, titleScore("walking bread", "walkng bread") > matchThreshold)
+	assert.True(t, titleScore("walking bread", "daily shown") < reviewThreshold)
+	assert.Equal(t, 0.0, titleScore("", ""))
+}
+
+func TestGetShowByTitleFuzzy(t *testing.T) {
+	s, err := GetShowByTitle("The.Walking.Bread")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), s.ID)
+
+	s, err = GetShowByTitle("Walkng Bread 2015")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), s.ID)
+
+	_, err = GetShowByTitle("Something Else Entirely")
+	assert.Equal(t, ErrShowNotTracked, err)
+
+	shield := newShow("Agents of Shield", "720p", true)
+	assert.NoError(t, shield.AddShow())
+	defer shield.DeleteShow()
+	assert.NoError(t, shield.AddAlias("Marvel's Agents of S.H.I.E.L.D.", "user"))
+	assert.NoError(t, shield.AddAlias("marvel's agents of s.h.i.e.l.d.", "user"))
+	a, err := GetAliases(shield.ID)
+	assert.NoError(t, err)
+	assert.Len(t, a, 1)
+
+	s, err = GetShowByTitle("Marvels.Agents.of.S.H.I.E.L.D")
+	assert.NoError(t, err)
+	assert.Equal(t, shield.ID, s.ID)
+}
+
+func TestAmbiguousMatchReview(t *testing.T) {
+	us := newShow("The Office (US)", "720p", true)
+	uk := newShow("The Office (UK)", "720p", true)
+	assert.NoError(t, us.AddShow())
+	assert.NoError(t, uk.AddShow())
+	defer us.DeleteShow()
+	defer uk.DeleteShow()
+
+	_, err := GetShowByTitle("The Office")
+	am, ok := err.(*AmbiguousMatchError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Len(t, am.Candidates, 2)
+	}
+
+	// A country in the release name picks the show with that country.
+	s, err := GetShowByTitle("The.Office.US")
+	assert.NoError(t, err)
+	assert.Equal(t, us.ID, s.ID)
+	s, err = GetShowByTitle("The Office UK")
+	assert.NoError(t, err)
+	assert.Equal(t, uk.ID, s.ID)
+
+	tr := TraceRelease("The.Office.S02E01.720p.HDTV.x264-GRP")
+	assert.False(t, tr.WouldFetch)
+	assert.Contains(t, tr.Reason, "review list")
+
+	assert.NoError(t, ProcessRelease("review", "The.Office.S02E01.720p.HDTV.x264-GRP", "", nil))
+	assert.NoError(t, ProcessRelease("review", "The.Office.S02E01.720p.HDTV.x264-GRP", "", nil))
+	reviews, err := ListMatchReviews()
+	require.NoError(t, err)
+	require.Len(t, reviews, 1)
+	assert.Equal(t, "The Office", reviews[0].Title)
+	assert.Contains(t, reviews[0].Candidates, "The Office (UK)")
+
+	assert.NoError(t, ResolveMatchReview(reviews[0].ID, us.ID))
+	reviews, _ = ListMatchReviews()
+	assert.Empty(t, reviews)
+	// The title is now an alias of the US show and matches it exactly.
+	s, err = GetShowByTitle("The Office")
+	assert.NoError(t, err)
+	assert.Equal(t, us.ID, s.ID)
+	_, err = GetShowByTitle("Office")
+	assert.Error(t, err)
+}
@@ -0,0 +1,310 @@
+/* TLS
+ *
+ * The webserver speaks HTTPS when the config names a certificate and key, or
+ * asks for a self-signed certificate, which is made in the data_dir the first
+ * time gumshoe starts. Plain HTTP on http_redirect_port is sent on to HTTPS.
+ *
+ * The certificate is read again when its files change or gumshoe gets a
+ * SIGHUP, so a renewed one is picked up without a restart. One the config
+ * names instead is handed to the running server the same way.
+ */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	selfSignedCert = "gumshoe.crt"
+	selfSignedKey  = "gumshoe.key"
+	selfSignedLife = 2 * 365 * 24 * time.Hour
+)
+
+// Sent a value whenever gumshoe gets a SIGHUP.
+var certReload = make(chan bool, 1)
+
+// httpListen is everything about how the webserver listens. A change to any
+// of it means starting a new server.
+type httpListen struct {
+	Addr string
+	// Empty for plain HTTP.
+	CertFile, KeyFile string
+	SelfSigned        bool
+	// host:port that redirects to HTTPS, if any.
+	RedirectAddr string
+}
+
+func (l httpListen) TLS() bool {
+	return l.CertFile != ""
+}
+
+func (l httpListen) String() string {
+	if l.TLS() {
+		return "https://" + l.Addr
+	}
+	return "http://" + l.Addr
+}
+
+// sameSockets reports whether l and o are both HTTPS on the same addresses,
+// so a server listening as o can carry on with just l's certificate.
+func (l httpListen) sameSockets(o httpListen) bool {
+	return l.TLS() && o.TLS() && l.Addr == o.Addr && l.RedirectAddr == o.RedirectAddr
+}
+
+// useCert hands certs the certificate l names, making it first if it's a
+// self-signed one.
+func useCert(certs *certReloader, l httpListen) error {
+	if l.SelfSigned {
+		host, _, _ := net.SplitHostPort(l.Addr)
+		if err := ensureSelfSignedCert(l, host); err != nil {
+			return fmt.Errorf("Unable to make a self-signed certificate: %s", err)
+		}
+	}
+	return certs.Use(l.CertFile, l.KeyFile)
+}
+
+// tlsPath puts a relative cert or key path in the data_dir of c.
+func tlsPath(c *TrackerConfig, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return CreateLocalPath(c, p)
+}
+
+// httpListenConfig works out how the webserver of c listens.
+func httpListenConfig(c *TrackerConfig) httpListen {
+	o := c.Operations
+	l := httpListen{Addr: httpAddress(o)}
+	cert, key := o.TLSCert, o.TLSKey
+	if o.TLSSelfSigned && cert == "" && key == "" {
+		cert, key = selfSignedCert, selfSignedKey
+	}
+	if cert == "" || key == "" {
+		return l
+	}
+	l.CertFile, l.KeyFile, l.SelfSigned = tlsPath(c, cert), tlsPath(c, key), o.TLSSelfSigned
+	if o.RedirectPort != "" {
+		l.RedirectAddr = net.JoinHostPort(o.BindAddress, o.RedirectPort)
+	}
+	return l
+}
+
+// validateTLS checks the TLS options of the config. A self-signed
+// certificate doesn't have to exist yet, any other has to load.
+func (tc *TrackerConfig) validateTLS(v *ValidationErrors) {
+	o := tc.Operations
+	if o.TLSCert != "" && o.TLSKey == "" {
+		v.add("operations.tls_key", "Needed with tls_cert.")
+	}
+	if o.TLSKey != "" && o.TLSCert == "" {
+		v.add("operations.tls_cert", "Needed with tls_key.")
+	}
+	l := httpListenConfig(tc)
+	if l.TLS() && !l.SelfSigned {
+		if _, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile); err != nil {
+			v.add("operations.tls_cert", "Unable to load %s: %s", l.CertFile, err)
+		}
+	}
+	if p := o.RedirectPort; p != "" {
+		if n, err := strconv.Atoi(p); err != nil || !validPort(n) {
+			v.add("operations.http_redirect_port", "%s is not a valid port.", p)
+		} else if !l.TLS() {
+			v.add("operations.http_redirect_port", "Only used with TLS.")
+		} else if p == o.HttpPort {
+			v.add("operations.http_redirect_port", "Can't be the same as http_port.")
+		}
+	}
+}
+
+// writeSelfSignedCert makes a certificate for this machine's names and
+// addresses, and writes it and its key as PEM.
+func writeSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gumshoe"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedLife),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certHosts are the names a self-signed certificate is made for.
+func certHosts(bind string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		hosts = append([]string{h}, hosts...)
+	}
+	if ip := net.ParseIP(bind); bind != "" && (ip == nil || !ip.IsUnspecified()) && bind != "localhost" {
+		hosts = append(hosts, bind)
+	}
+	return hosts
+}
+
+// ensureSelfSignedCert makes the self-signed certificate if it isn't there.
+func ensureSelfSignedCert(l httpListen, bind string) error {
+	if _, err := os.Stat(l.CertFile); err == nil {
+		return nil
+	}
+	log.Printf("Making a self-signed certificate in %s.\n", l.CertFile)
+	return writeSelfSignedCert(l.CertFile, l.KeyFile, certHosts(bind))
+}
+
+// notifyCertReload passes SIGHUPs on to certReload.
+func notifyCertReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			select {
+			case certReload <- true:
+			default:
+			}
+		}
+	}()
+}
+
+// certReloader hands the TLS server whatever certificate was read last.
+type certReloader struct {
+	certFile, keyFile string
+
+	lock            sync.RWMutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	return c, c.Load()
+}
+
+// Load reads the certificate and key. If they can't be read the one already
+// in use is kept.
+func (c *certReloader) Load() error {
+	return c.Use(c.files())
+}
+
+// Use switches to the certificate in certFile and keyFile, and watches them
+// from then on. If they can't be read the one already in use is kept.
+func (c *certReloader) Use(certFile, keyFile string) error {
+	cm, km := modTime(certFile), modTime(keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load the TLS certificate %s: %s", certFile, err)
+	}
+	c.lock.Lock()
+	c.certFile, c.keyFile = certFile, keyFile
+	c.cert, c.certMod, c.keyMod = &cert, cm, km
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *certReloader) files() (certFile, keyFile string) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.certFile, c.keyFile
+}
+
+// Changed reports whether the files are newer than the certificate in use.
+func (c *certReloader) Changed() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return !modTime(c.certFile).Equal(c.certMod) || !modTime(c.keyFile).Equal(c.keyMod)
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate on a SIGHUP or when its files change, until
+// stop is closed.
+func (c *certReloader) Watch(stop chan bool) {
+	t := time.NewTicker(configPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-certReload:
+			log.Println("Got SIGHUP, reloading the TLS certificate.")
+		case <-t.C:
+			if !c.Changed() {
+				continue
+			}
+			cert, _ := c.files()
+			log.Printf("TLS certificate %s changed, reloading.\n", cert)
+		}
+		if err := c.Load(); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+	}
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same path on the HTTPS
+// port.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		if httpsPort != "443" {
+			u.Host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
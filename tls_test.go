@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tlsTestConfig(dir string) *TrackerConfig {
+	return &TrackerConfig{
+		Directories: map[string]string{"user_dir": dir, "data_dir": "data"},
+		Operations:  Operations{HttpPort: "8443", BindAddress: "127.0.0.1"},
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "data"), 0700)
+
+	c := tlsTestConfig(dir)
+	assert.False(t, httpListenConfig(c).TLS())
+	c.Operations.TLSSelfSigned = true
+	c.Operations.RedirectPort = "8080"
+	l := httpListenConfig(c)
+	assert.Equal(t, filepath.Join(dir, "data", selfSignedCert), l.CertFile)
+	assert.Equal(t, "127.0.0.1:8080", l.RedirectAddr)
+	assert.Equal(t, "https://127.0.0.1:8443", l.String())
+
+	assert.NoError(t, ensureSelfSignedCert(l, "nas.lan"))
+	fi, err := os.Stat(l.KeyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	certs, err := newCertReloader(l.CertFile, l.KeyFile)
+	assert.NoError(t, err)
+	cert, _ := certs.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.NoError(t, leaf.VerifyHostname("localhost"))
+	assert.NoError(t, leaf.VerifyHostname("nas.lan"))
+	assert.NoError(t, leaf.VerifyHostname("127.0.0.1"))
+
+	// It's only made once.
+	before, _ := ioutil.ReadFile(l.CertFile)
+	assert.NoError(t, ensureSelfSignedCert(l, ""))
+	after, _ := ioutil.ReadFile(l.CertFile)
+	assert.Equal(t, before, after)
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "c.pem"), filepath.Join(dir, "k.pem")
+
+	assert.NoError(t, writeSelfSignedCert(certFile, keyFile, []string{"localhost"}))
+	first, _ := ioutil.ReadFile(certFile)
+	certs, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	assert.False(t, certs.Changed())
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	ts.TLS = &tls.Config{GetCertificate: certs.GetCertificate}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// get fails unless the server shows the certificate in pem.
+	get := func(pem []byte) error {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: "localhost"},
+			DisableKeepAlives: true,
+		}}
+		resp, err := c.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	assert.NoError(t, get(first))
+
+	assert.NoError(t, writeSelfSignedCert(certFile, keyFile, []string{"localhost"}))
+	second, _ := ioutil.ReadFile(certFile)
+	assert.True(t, certs.Changed())
+	assert.NoError(t, certs.Load())
+	assert.False(t, certs.Changed())
+	assert.Error(t, get(first))
+	assert.NoError(t, get(second))
+
+	// A broken file leaves the last good certificate in use.
+	assert.NoError(t, ioutil.WriteFile(certFile, []byte("junk"), 0644))
+	assert.Error(t, certs.Load())
+	assert.NoError(t, get(second))
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	w := httptest.NewRecorder()
+	redirectToHTTPS("8443").ServeHTTP(w, httptest.NewRequest("GET", "http://nas.lan:8080/api/v1/shows?limit=5", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://nas.lan:8443/api/v1/shows?limit=5", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	redirectToHTTPS("443").ServeHTTP(w, httptest.NewRequest("POST", "http://nas.lan/api/v1/backlog", nil))
+	assert.Equal(t, "https://nas.lan/api/v1/backlog", w.Header().Get("Location"))
+}
+
+func TestTLSValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fieldsOf := func(c *TrackerConfig) []string {
+		v := ValidationErrors{}
+		c.validateTLS(&v)
+		f := []string{}
+		for _, e := range v {
+			f = append(f, e.Field)
+		}
+		return f
+	}
+	c := tlsTestConfig(dir)
+	c.Operations.RedirectPort = "8080"
+	assert.Equal(t, []string{"operations.http_redirect_port"}, fieldsOf(c))
+
+	c.Operations.TLSCert = "missing.pem"
+	assert.Equal(t, []string{"operations.tls_key", "operations.http_redirect_port"}, fieldsOf(c))
+	c.Operations.TLSKey = "missing-key.pem"
+	assert.Equal(t, []string{"operations.tls_cert"}, fieldsOf(c))
+
+	// A self-signed certificate is made when the server starts.
+	c.Operations.TLSSelfSigned = true
+	assert.Empty(t, fieldsOf(c))
+	c.Operations.RedirectPort = c.Operations.HttpPort
+	assert.Equal(t, []string{"operations.http_redirect_port"}, fieldsOf(c))
+
+	n := *c
+	n.Operations.TLSSelfSigned = false
+	assert.True(t, diffConfig(c, &n).TLS)
+}
+
+// trusting is a client for the server with the certificate in certFile.
+func trusting(certFile string) *http.Client {
+	pem, _ := ioutil.ReadFile(certFile)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	return &http.Client{Timeout: time.Second, Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestEnableTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	first := httpListen{CertFile: filepath.Join(dir, "c1.pem"), KeyFile: filepath.Join(dir, "k1.pem")}
+	second := httpListen{CertFile: filepath.Join(dir, "c2.pem"), KeyFile: filepath.Join(dir, "k2.pem")}
+	for _, l := range []httpListen{first, second} {
+		assert.NoError(t, writeSelfSignedCert(l.CertFile, l.KeyFile, []string{"localhost"}))
+	}
+
+	addr := "127.0.0.1:" + freePort(t)
+	first.Addr, second.Addr = addr, addr
+	rebind := make(chan httpListen)
+	go serveHTTP(newHTTPHandler(pwd), httpListen{Addr: addr}, rebind)
+	defer close(rebind)
+	getUntil(t, &http.Client{}, "http://"+addr+"/status")
+
+	// Turned on for a server that's already running, on the same port.
+	configStatus.Set("OK")
+	rebind <- first
+	getUntil(t, trusting(first.CertFile), "https://"+addr+"/status")
+	assert.Equal(t, "OK", configStatus.Value())
+
+	// A new certificate is handed to the running server.
+	rebind <- second
+	getUntil(t, trusting(second.CertFile), "https://"+addr+"/status")
+	_, err = trusting(first.CertFile).Get("https://" + addr + "/status")
+	assert.Error(t, err)
+
+	// One that doesn't load leaves the last good one in use.
+	rebind <- httpListen{Addr: addr, CertFile: filepath.Join(dir, "missing.pem"), KeyFile: second.KeyFile}
+	for i := 0; i < 50 && configStatus.Value() == "OK"; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Contains(t, configStatus.Value(), "missing.pem")
+	getUntil(t, trusting(second.CertFile), "https://"+addr+"/status")
+}
@@ -0,0 +1,207 @@
+/* Torrent Client
+ *
+ * Once a .torrent has been fetched it is handed off to a torrent client. The
+ * Transmission RPC interface is used when a client URL is configured, otherwise
+ * the file is dropped into a directory that the client watches.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var torrentClient TorrentClient
+
+type Torrent struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	PercentDone float64 `json:"percentDone"`
+	Status      int     `json:"status"`
+}
+
+type TorrentClient interface {
+	// AddTorrent hands the contents of a .torrent file to the client. name is
+	// the file name it was saved under.
+	AddTorrent(name string, metainfo []byte) error
+	GetTorrents() ([]Torrent, error)
+}
+
+// NewTorrentClient picks the client from the config. It returns nil when
+// neither a client URL nor a watch directory is configured.
+func NewTorrentClient(d Download, dirs map[string]string) TorrentClient {
+	if d.TorrentURL != "" {
+		return NewTransmissionClient(d.TorrentURL, d.TorrentUser, resolveSecret(d.TorrentPass))
+	}
+	if dirs["watch_dir"] != "" {
+		return &WatchDirClient{Dir: filepath.Join(dirs["user_dir"], dirs["watch_dir"])}
+	}
+	return nil
+}
+
+func SetTorrentClient() {
+	tc := currentConfig()
+	torrentClient = NewTorrentClient(tc.Download, tc.Directories)
+}
+
+// handOffTorrent sends a fetched .torrent file to the configured client.
+func handOffTorrent(f string) error {
+	if torrentClient == nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	if err = torrentClient.AddTorrent(filepath.Base(f), b); err != nil {
+		return fmt.Errorf("Torrent client rejected %s: %s", filepath.Base(f), err)
+	}
+	return nil
+}
+
+// WatchDirClient copies torrents into a directory the torrent client picks
+// files up from.
+type WatchDirClient struct {
+	Dir string
+}
+
+func (w *WatchDirClient) AddTorrent(name string, metainfo []byte) error {
+	if !strings.HasSuffix(name, ".torrent") {
+		name = name + ".torrent"
+	}
+	// Write under a temporary name so the client never sees half a file.
+	tmp := filepath.Join(w.Dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, metainfo, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(w.Dir, name))
+}
+
+func (w *WatchDirClient) GetTorrents() ([]Torrent, error) {
+	files, err := filepath.Glob(filepath.Join(w.Dir, "*.torrent"))
+	if err != nil {
+		return nil, err
+	}
+	torrents := []Torrent{}
+	for i, f := range files {
+		torrents = append(torrents, Torrent{ID: i, Name: filepath.Base(f)})
+	}
+	return torrents, nil
+}
+
+// TransmissionClient talks to the Transmission RPC interface.
+type TransmissionClient struct {
+	URL        string
+	User       string
+	Pass       string
+	HttpClient *http.Client
+
+	lock      sync.Mutex
+	sessionId string
+}
+
+func NewTransmissionClient(u, user, pass string) *TransmissionClient {
+	return &TransmissionClient{
+		URL:        u,
+		User:       user,
+		Pass:       pass,
+		HttpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type rpcRequest struct {
+	Method    string      `json:"method"`
+	Arguments interface{} `json:"arguments"`
+}
+
+type rpcResponse struct {
+	Result    string          `json:"result"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+func (t *TransmissionClient) post(body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", t.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.lock.Lock()
+	req.Header.Set("X-Transmission-Session-Id", t.sessionId)
+	t.lock.Unlock()
+	if t.User != "" {
+		req.SetBasicAuth(t.User, t.Pass)
+	}
+	return t.HttpClient.Do(req)
+}
+
+// call runs a single RPC method. Transmission answers 409 with a fresh session
+// id when ours is missing or stale, so the request is sent again once.
+func (t *TransmissionClient) call(method string, args interface{}, result interface{}) error {
+	body, err := json.Marshal(rpcRequest{Method: method, Arguments: args})
+	if err != nil {
+		return err
+	}
+	resp, err := t.post(body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		sid := resp.Header.Get("X-Transmission-Session-Id")
+		if sid == "" {
+			return errors.New("Transmission didn't send a session id.")
+		}
+		t.lock.Lock()
+		t.sessionId = sid
+		t.lock.Unlock()
+		if resp, err = t.post(body); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Transmission returned %s", resp.Status)
+	}
+
+	r := rpcResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if r.Result != "success" {
+		return errors.New(r.Result)
+	}
+	if result != nil {
+		return json.Unmarshal(r.Arguments, result)
+	}
+	return nil
+}
+
+func (t *TransmissionClient) AddTorrent(name string, metainfo []byte) error {
+	args := map[string]interface{}{
+		"metainfo": base64.StdEncoding.EncodeToString(metainfo),
+	}
+	return t.call("torrent-add", args, nil)
+}
+
+func (t *TransmissionClient) GetTorrents() ([]Torrent, error) {
+	args := map[string]interface{}{
+		"fields": []string{"id", "name", "percentDone", "status"},
+	}
+	result := struct {
+		Torrents []Torrent `json:"torrents"`
+	}{}
+	if err := t.call("torrent-get", args, &result); err != nil {
+		return nil, err
+	}
+	return result.Torrents, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// transmissionStub acts like the Transmission RPC endpoint, including the
+// session id handshake.
+func transmissionStub(t *testing.T, added *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Transmission-Session-Id") != "sid-1" {
+			w.Header().Set("X-Transmission-Session-Id", "sid-1")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "tuser", user)
+		assert.Equal(t, "tpass", pass)
+
+		req := struct {
+			Method    string                 `json:"method"`
+			Arguments map[string]interface{} `json:"arguments"`
+		}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch req.Method {
+		case "torrent-add":
+			mi, err := base64.StdEncoding.DecodeString(req.Arguments["metainfo"].(string))
+			assert.NoError(t, err)
+			*added = append(*added, string(mi))
+			fmt.Fprint(w, `{"result": "success", "arguments": {"torrent-added": {"id": 1}}}`)
+		case "torrent-get":
+			fmt.Fprint(w, `{"result": "success", "arguments": {"torrents": [{"id": 1, "name": "walking.bread.s01e06", "percentDone": 0.5, "status": 4}]}}`)
+		default:
+			fmt.Fprint(w, `{"result": "method name not recognized"}`)
+		}
+	}))
+}
+
+func TestTransmissionClient(t *testing.T) {
+	added := []string{}
+	ts := transmissionStub(t, &added)
+	defer ts.Close()
+
+	c := NewTransmissionClient(ts.URL, "tuser", "tpass")
+	assert.NoError(t, c.AddTorrent("walking.bread.s01e06.torrent", []byte("fake torrent")))
+	assert.Equal(t, []string{"fake torrent"}, added)
+	assert.Equal(t, "sid-1", c.sessionId)
+
+	torrents, err := c.GetTorrents()
+	assert.NoError(t, err)
+	assert.Len(t, torrents, 1)
+	assert.Equal(t, "walking.bread.s01e06", torrents[0].Name)
+	assert.Equal(t, 0.5, torrents[0].PercentDone)
+
+	assert.Error(t, c.call("session-close", nil, nil))
+}
+
+func TestWatchDirClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gumshoe-watch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := &WatchDirClient{Dir: dir}
+	assert.NoError(t, c.AddTorrent("walking.bread.s01e06", []byte("fake torrent")))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "walking.bread.s01e06.torrent"))
+	assert.NoError(t, err)
+	assert.Equal(t, "fake torrent", string(b))
+
+	torrents, err := c.GetTorrents()
+	assert.NoError(t, err)
+	assert.Len(t, torrents, 1)
+}
+
+func TestNewTorrentClient(t *testing.T) {
+	assert.Nil(t, NewTorrentClient(Download{}, map[string]string{}))
+	_, ok := NewTorrentClient(Download{TorrentURL: "http://localhost:9091/transmission/rpc"}, map[string]string{}).(*TransmissionClient)
+	assert.True(t, ok)
+	_, ok = NewTorrentClient(Download{}, map[string]string{"watch_dir": "watch"}).(*WatchDirClient)
+	assert.True(t, ok)
+}
@@ -0,0 +1,348 @@
+/* Torznab Search
+ *
+ * Torznab is the Newznab search API for torrent indexers, spoken by Jackett,
+ * Prowlarr and many trackers. Gumshoe asks the indexer what it can search
+ * for, then searches for episodes by season and episode, and by TheTVDB id
+ * when the indexer supports it.
+ *
+ * A Torznab indexer is set up as the RSS feed with "type": "torznab". The
+ * feed's passkey is the API key.
+ */
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	feedTypeRSS     = "rss"
+	feedTypeTorznab = "torznab"
+	// All of TV, used when the feed doesn't list categories.
+	torznabTVCategory = "5000"
+)
+
+// TorznabCaps is what an indexer says it can do.
+type TorznabCaps struct {
+	Search     bool
+	TVSearch   bool
+	TVParams   map[string]bool
+	Categories []TorznabCategory
+}
+
+// SupportsTV reports whether a tvsearch parameter, e.g. "tvdbid", can be used.
+func (c *TorznabCaps) SupportsTV(p string) bool {
+	return c.TVSearch && c.TVParams[p]
+}
+
+type TorznabCategory struct {
+	ID   string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+	Subs []struct {
+		ID   string `xml:"id,attr" json:"id"`
+		Name string `xml:"name,attr" json:"name"`
+	} `xml:"subcat" json:"subcats"`
+}
+
+type torznabSearching struct {
+	Available       string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+type torznabCapsDoc struct {
+	Searching struct {
+		Search   torznabSearching `xml:"search"`
+		TVSearch torznabSearching `xml:"tv-search"`
+	} `xml:"searching"`
+	Categories []TorznabCategory `xml:"categories>category"`
+}
+
+// TorznabResult is one release an indexer found. Attrs holds the
+// torznab:attr elements of the result, e.g. seeders and size.
+type TorznabResult struct {
+	feedItem
+	Attrs map[string]string
+}
+
+func (r *TorznabResult) Seeders() int {
+	n, _ := strconv.Atoi(r.Attrs["seeders"])
+	return n
+}
+
+type torznabDoc struct {
+	Channel struct {
+		Items []struct {
+			Title     string `xml:"title"`
+			Link      string `xml:"link"`
+			GUID      string `xml:"guid"`
+			Enclosure struct {
+				URL string `xml:"url,attr"`
+			} `xml:"enclosure"`
+			Attrs []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"attr"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// checkTorznab makes sure a response is the document wanted, e.g. "rss".
+// Indexers report problems, like a bad API key, as an error document with a
+// 200 status.
+func checkTorznab(b []byte, want string) error {
+	root := struct {
+		XMLName     xml.Name
+		Code        string `xml:"code,attr"`
+		Description string `xml:"description,attr"`
+	}{}
+	if err := xml.Unmarshal(b, &root); err != nil {
+		return fmt.Errorf("Invalid Torznab response: %s", err)
+	}
+	switch root.XMLName.Local {
+	case want:
+		return nil
+	case "error":
+		return fmt.Errorf("Torznab error %s: %s", root.Code, root.Description)
+	}
+	return fmt.Errorf("Unknown Torznab response: %s", root.XMLName.Local)
+}
+
+// parseTorznab decodes search results.
+func parseTorznab(b []byte) ([]TorznabResult, error) {
+	if err := checkTorznab(b, "rss"); err != nil {
+		return nil, err
+	}
+	doc := torznabDoc{}
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	results := []TorznabResult{}
+	for _, i := range doc.Channel.Items {
+		r := TorznabResult{
+			feedItem: feedItem{
+				Title: strings.TrimSpace(i.Title),
+				Link:  strings.TrimSpace(i.Enclosure.URL),
+				GUID:  i.GUID,
+			},
+			Attrs: map[string]string{},
+		}
+		if r.Link == "" {
+			r.Link = strings.TrimSpace(i.Link)
+		}
+		if r.GUID == "" {
+			r.GUID = r.Link
+		}
+		for _, a := range i.Attrs {
+			r.Attrs[a.Name] = a.Value
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// Torznab searches one indexer.
+type Torznab struct {
+	Feed       RSSFeed
+	HttpClient *http.Client
+
+	caps *TorznabCaps
+	lock sync.Mutex
+}
+
+func NewTorznab(f RSSFeed) *Torznab {
+	f.Passkey = resolveSecret(f.Passkey)
+	return &Torznab{
+		Feed:       f,
+		HttpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// apiURL builds the request for the API function fn. The passkey is sent as the API
+// key, and like an RSS feed the URL can have %passkey% and %uid% in it
+// instead.
+func (t *Torznab) apiURL(fn string, q url.Values) (string, error) {
+	raw := strings.Replace(t.Feed.URL, "%passkey%", url.QueryEscape(t.Feed.Passkey), -1)
+	raw = strings.Replace(raw, "%uid%", url.QueryEscape(t.Feed.Uid), -1)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.New("Torznab URL must be absolute.")
+	}
+	v := u.Query()
+	for k := range q {
+		v.Set(k, q.Get(k))
+	}
+	v.Set("t", fn)
+	if t.Feed.Passkey != "" && !strings.Contains(t.Feed.URL, "%passkey%") {
+		v.Set("apikey", t.Feed.Passkey)
+	}
+	if t.Feed.Uid != "" && !strings.Contains(t.Feed.URL, "%uid%") {
+		v.Set("uid", t.Feed.Uid)
+	}
+	u.RawQuery = v.Encode()
+	return u.String(), nil
+}
+
+func (t *Torznab) get(fn string, q url.Values) ([]byte, error) {
+	u, err := t.apiURL(fn, q)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.HttpClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Torznab %s returned %s", fn, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Caps asks the indexer what it supports. The answer is kept for the life of
+// the Torznab.
+func (t *Torznab) Caps() (*TorznabCaps, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.caps != nil {
+		return t.caps, nil
+	}
+	b, err := t.get("caps", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkTorznab(b, "caps"); err != nil {
+		return nil, err
+	}
+	doc := torznabCapsDoc{}
+	if err = xml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	c := &TorznabCaps{
+		Search:     doc.Searching.Search.Available == "yes",
+		TVSearch:   doc.Searching.TVSearch.Available == "yes",
+		TVParams:   map[string]bool{},
+		Categories: doc.Categories,
+	}
+	for _, p := range strings.Split(doc.Searching.TVSearch.SupportedParams, ",") {
+		c.TVParams[strings.TrimSpace(p)] = true
+	}
+	t.caps = c
+	return c, nil
+}
+
+// TVQuery is a tvsearch. Empty fields are left out, and a query with none
+// lists the indexer's latest TV releases.
+type TVQuery struct {
+	Q      string
+	Season string
+	Ep     string
+	TvDbId uint64
+}
+
+func (q TVQuery) values() url.Values {
+	v := url.Values{}
+	if q.Q != "" {
+		v.Set("q", q.Q)
+	}
+	if q.Season != "" {
+		v.Set("season", q.Season)
+	}
+	if q.Ep != "" {
+		v.Set("ep", q.Ep)
+	}
+	if q.TvDbId != 0 {
+		v.Set("tvdbid", strconv.FormatUint(q.TvDbId, 10))
+	}
+	return v
+}
+
+func (t *Torznab) categories() string {
+	if t.Feed.Categories != "" {
+		return t.Feed.Categories
+	}
+	return torznabTVCategory
+}
+
+// TVSearch runs a tvsearch in the feed's categories.
+func (t *Torznab) TVSearch(q TVQuery) ([]TorznabResult, error) {
+	v := q.values()
+	v.Set("cat", t.categories())
+	b, err := t.get("tvsearch", v)
+	if err != nil {
+		return nil, err
+	}
+	return parseTorznab(b)
+}
+
+// TextSearch is a plain search, for indexers without tvsearch.
+func (t *Torznab) TextSearch(q string) ([]TorznabResult, error) {
+	b, err := t.get("search", url.Values{"q": {q}, "cat": {t.categories()}})
+	if err != nil {
+		return nil, err
+	}
+	return parseTorznab(b)
+}
+
+// episodeQuery builds the best tvsearch the indexer supports for an episode.
+// Daily episodes are searched by year and month/day, as Newznab asks.
+func episodeQuery(c *TorznabCaps, s Show, e Episode) (TVQuery, bool) {
+	q := TVQuery{}
+	if s.TvDbId != 0 && c.SupportsTV("tvdbid") {
+		q.TvDbId = s.TvDbId
+	} else if c.SupportsTV("q") {
+		q.Q = s.Title
+	} else {
+		return q, false
+	}
+	if !c.SupportsTV("season") || !c.SupportsTV("ep") {
+		return q, false
+	}
+	if e.IsDaily() {
+		q.Season = e.AirDate.Format("2006")
+		q.Ep = e.AirDate.Format("01/02")
+	} else {
+		q.Season = strconv.Itoa(e.Season)
+		q.Ep = strconv.Itoa(e.Episode)
+	}
+	return q, true
+}
+
+// Search finds releases of an episode, so the indexer can be the backlog
+// search.
+func (t *Torznab) Search(s Show, e Episode) ([]feedItem, error) {
+	c, err := t.Caps()
+	if err != nil {
+		return nil, err
+	}
+	var res []TorznabResult
+	if q, ok := episodeQuery(c, s, e); ok {
+		res, err = t.TVSearch(q)
+	} else if c.Search {
+		res, err = t.TextSearch(searchQuery(s, e))
+	} else {
+		return nil, errors.New("The indexer can't search for TV.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return torznabItems(res), nil
+}
+
+func torznabItems(res []TorznabResult) []feedItem {
+	items := make([]feedItem, len(res))
+	for i, r := range res {
+		items[i] = r.feedItem
+	}
+	return items
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTorznabCaps = `<?xml version="1.0" encoding="UTF-8"?>
+<caps>
+  <server title="Test Indexer"/>
+  <searching>
+    <search available="yes" supportedParams="q"/>
+    <tv-search available="%s" supportedParams="q,season,ep,tvdbid"/>
+  </searching>
+  <categories>
+    <category id="5000" name="TV">
+      <subcat id="5040" name="TV/HD"/>
+    </category>
+  </categories>
+</caps>`
+
+var testTorznabResults = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:torznab="http://torznab.com/schemas/2015/feed">
+  <channel>
+    <item>
+      <title>Walking.bread.S01E07.720p.HDTV.x264-GRP</title>
+      <guid>https://indexer/details/1</guid>
+      <link>https://indexer/dl/1.torrent</link>
+      <torznab:attr name="seeders" value="12"/>
+      <torznab:attr name="tvdbid" value="153021"/>
+    </item>
+  </channel>
+</rss>`
+
+var testTorznabError = `<?xml version="1.0" encoding="UTF-8"?>
+<error code="100" description="Invalid API Key"/>`
+
+// torznabServer is an indexer stub. Requests are recorded in queries.
+func torznabServer(t *testing.T, tvSearch string, queries *[]url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("apikey") != "abc" {
+			fmt.Fprint(w, testTorznabError)
+			return
+		}
+		*queries = append(*queries, q)
+		switch q.Get("t") {
+		case "caps":
+			fmt.Fprintf(w, testTorznabCaps, tvSearch)
+		case "tvsearch", "search":
+			fmt.Fprint(w, testTorznabResults)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestParseTorznab(t *testing.T) {
+	res, err := parseTorznab([]byte(testTorznabResults))
+	assert.NoError(t, err)
+	if assert.Len(t, res, 1) {
+		assert.Equal(t, "https://indexer/dl/1.torrent", res[0].Link)
+		assert.Equal(t, "https://indexer/details/1", res[0].GUID)
+		assert.Equal(t, 12, res[0].Seeders())
+		assert.Equal(t, "153021", res[0].Attrs["tvdbid"])
+	}
+
+	_, err = parseTorznab([]byte(testTorznabError))
+	assert.EqualError(t, err, "Torznab error 100: Invalid API Key")
+}
+
+func TestTorznabSearch(t *testing.T) {
+	queries := []url.Values{}
+	ts := torznabServer(t, "yes", &queries)
+	defer ts.Close()
+
+	tz := NewTorznab(RSSFeed{URL: ts.URL + "/api", Passkey: "abc", Type: feedTypeTorznab})
+	c, err := tz.Caps()
+	assert.NoError(t, err)
+	assert.True(t, c.SupportsTV("tvdbid"))
+	assert.Equal(t, "5040", c.Categories[0].Subs[0].ID)
+
+	items, err := tz.Search(Show{Title: "Walking Bread", TvDbId: 153021}, Episode{Season: 1, Episode: 7})
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	q := queries[len(queries)-1]
+	assert.Equal(t, "tvsearch", q.Get("t"))
+	assert.Equal(t, "153021", q.Get("tvdbid"))
+	assert.Equal(t, "", q.Get("q"))
+	assert.Equal(t, "1", q.Get("season"))
+	assert.Equal(t, "7", q.Get("ep"))
+	assert.Equal(t, torznabTVCategory, q.Get("cat"))
+
+	// Daily episodes are searched by year and month/day.
+	_, err = tz.Search(Show{Title: "Daily Shown"}, Episode{AirDate: NewAirDate(2015, time.March, 26)})
+	assert.NoError(t, err)
+	q = queries[len(queries)-1]
+	assert.Equal(t, "Daily Shown", q.Get("q"))
+	assert.Equal(t, "2015", q.Get("season"))
+	assert.Equal(t, "03/26", q.Get("ep"))
+
+	// Caps are only asked for once.
+	n := 0
+	for _, q := range queries {
+		if q.Get("t") == "caps" {
+			n++
+		}
+	}
+	assert.Equal(t, 1, n)
+
+	tz = NewTorznab(RSSFeed{URL: ts.URL + "/api", Passkey: "wrong"})
+	_, err = tz.Caps()
+	assert.Error(t, err)
+}
+
+func TestTorznabTextSearch(t *testing.T) {
+	queries := []url.Values{}
+	ts := torznabServer(t, "no", &queries)
+	defer ts.Close()
+
+	tz := NewTorznab(RSSFeed{URL: ts.URL + "/api", Passkey: "abc", Categories: "5040"})
+	_, err := tz.Search(Show{Title: "Walking Bread", TvDbId: 153021}, Episode{Season: 1, Episode: 7})
+	assert.NoError(t, err)
+	q := queries[len(queries)-1]
+	assert.Equal(t, "search", q.Get("t"))
+	assert.Equal(t, "Walking Bread S01E07", q.Get("q"))
+	assert.Equal(t, "5040", q.Get("cat"))
+}
+
+func TestRSSWatcherTorznab(t *testing.T) {
+	queries := []url.Values{}
+	ts := torznabServer(t, "yes", &queries)
+	defer ts.Close()
+
+	f := RSSFeed{URL: ts.URL + "/api", Passkey: "abc", Type: "Torznab"}
+	w := NewRSSWatcher(f)
+	got := []string{}
+	w.Handle = func(title, link string) error {
+		got = append(got, link)
+		return nil
+	}
+	n, err := w.Poll()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"https://indexer/dl/1.torrent"}, got)
+	assert.Equal(t, "tvsearch", queries[0].Get("t"))
+
+	_, ok := NewBacklogSearcher(&TrackerConfig{RSS: f}).(*Torznab)
+	assert.True(t, ok)
+}
@@ -1,10 +1,36 @@
 (function() {
 	var app = angular.module('gumshoe', ['fundoo.services']);
 
+  // Anything the server won't answer without a session goes to the login
+  // page.
+  function toLogin() {
+    window.location = "/login.html";
+  }
+
+  $(document).ajaxError(function(event, xhr) {
+    if (xhr.status === 401) {
+      toLogin();
+    }
+  });
+
+  app.config(['$httpProvider', function($httpProvider) {
+    $httpProvider.interceptors.push(['$q', function($q) {
+      return {
+        responseError: function(rejection) {
+          if (rejection.status === 401) {
+            toLogin();
+          }
+          return $q.reject(rejection);
+        }
+      };
+    }]);
+  }]);
+
   app.controller('ConfigController', ['$log', '$scope', function($log, $scope){
     var setCtrl = this;
     setCtrl.current = {};
     setCtrl.updates = [];
+    setCtrl.errors = [];
     setCtrl.preventNav = false;
 
     $.getJSON("/settings")
@@ -34,14 +60,22 @@
       sNew.dir_options["log_dir"] = $scope.log_dir;
 
       $log.log('Sending update now.');
-      $.post({
-        url: "/api/config/update",
+      $.ajax({
+        method: "PUT",
+        url: "/api/v1/config",
         contentType: "application/json",
         async: true,
         data: JSON.stringify(sNew),
         success: function() {
           this.getElementsByName("update_msg").hidden = false;
           setCtrl.updates = [];
+          setCtrl.errors = [];
+        },
+        error: function(xhr) {
+          if (xhr.responseJSON && xhr.responseJSON.error) {
+            setCtrl.errors = xhr.responseJSON.error.fields || [];
+          }
+          $log.log(xhr.status, xhr.responseText);
         },
       });
     };
@@ -72,7 +106,7 @@
     showCtrl.newShow = {};
     var showAddForm = false;
 
-    $http.get("/api/shows").success(function(data){
+    $http.get("/api/v1/shows?limit=1000").success(function(data){
       showCtrl.shows = data;
     });
 
@@ -87,7 +121,7 @@
 
     this.addShow = function() {
       this.newShow.episodal = this.boolConv(this.newShow.episodal);
-      $http.post("/api/show/new", this.newShow).success(function(data){
+      $http.post("/api/v1/shows", this.newShow).success(function(data){
         showCtrl.newShow = {};
         showCtrl.showAddForm = false;
         showCtrl.shows.push(data);
@@ -114,7 +148,7 @@
     this.editShow = function(index) {
       newShow = this.shows[index];
       newShow.episodal = this.boolConv(newShow.episodal);
-      $http.post("/api/show/update/" + newShow.ID, newShow).success(function(){
+      $http.put("/api/v1/shows/" + newShow.ID, newShow).success(function(){
         showCtrl.showEditForm(index);
       }).error(function(data, status, headers, config){
         $log.log(data, status, headers, config);
@@ -124,7 +158,7 @@
     this.deleteShow = function(index) {
       title = showCtrl.shows[index].title;
       if(window.confirm("Delete " + title + "?")) {
-        $http.delete("/api/show/delete/" + showCtrl.shows[index].ID).success(function(data){
+        $http.delete("/api/v1/shows/" + showCtrl.shows[index].ID).success(function(data){
           showCtrl.shows.splice(index, 1);
         });
       };
@@ -132,8 +166,36 @@
 
   }]);
 
-  app.controller('StatusController', ['$log', '$http', function($log, $http) {
+  app.controller('StatusController', ['$log', '$http', '$scope', function($log, $http, $scope) {
     var statCtrl = this;
+    statCtrl.Status = "";
+    statCtrl.Events = [];
+
+    // Live activity, newest first. The browser reconnects on its own and
+    // picks up after the last event it saw.
+    if (window.EventSource) {
+      var stream = new EventSource("/api/v1/events");
+      ["announce", "matched", "rejected", "fetch_started", "fetch_completed", "fetch_retry",
+       "fetch_failed", "irc_state", "irc_disconnected", "cookie_expired", "config_reloaded",
+       "config_rejected"].forEach(function(type) {
+        stream.addEventListener(type, function(msg) {
+          $scope.$apply(function() {
+            statCtrl.Events.unshift(JSON.parse(msg.data));
+            statCtrl.Events.length = Math.min(statCtrl.Events.length, 100);
+          });
+        });
+      });
+      $scope.$on("$destroy", function() {
+        stream.close();
+      });
+    }
+
+    $http.get("/status").success(function(data){
+      statCtrl.Status = data;
+    }).error(function(data, status){
+      statCtrl.Status = data;
+      $log.log(data, status);
+    });
   }]);
 
   app.directive("gumshoeTabs", function() {